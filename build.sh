@@ -1,5 +1,11 @@
-GOARCH=arm GOARM=7 GOOS=linux go build -o bin/armv7l ./cmd/client 
-GOARCH=arm64 GOARM="" GOOS=linux go build -o bin/aarch64 ./cmd/client
+VERSION=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+LDFLAGS="-X main.Version=$VERSION"
 
-# $env:GOARCH = "arm"; $env:GOARM = "7"; $env:GOOS = "linux"; go build -o bin/armv7l ./cmd/client
-# $env:GOARCH = "arm64"; $env:GOARM = ""; $env:GOOS = "linux"; go build -o bin/aarch64 ./cmd/client
+GOARCH=arm GOARM=7 GOOS=linux go build -ldflags "$LDFLAGS" -o bin/armv7l ./cmd/client 
+GOARCH=arm64 GOARM="" GOOS=linux go build -ldflags "$LDFLAGS" -o bin/aarch64 ./cmd/client
+
+# Checksums for update_agent commands
+(cd bin && sha256sum armv7l aarch64 > SHA256SUMS)
+
+# $env:GOARCH = "arm"; $env:GOARM = "7"; $env:GOOS = "linux"; go build -ldflags "-X main.Version=dev" -o bin/armv7l ./cmd/client
+# $env:GOARCH = "arm64"; $env:GOARM = ""; $env:GOOS = "linux"; go build -ldflags "-X main.Version=dev" -o bin/aarch64 ./cmd/client
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/dronnayak-core/internal/web"
+)
+
+// execAuditBatchSize is the most audit records sent in one request.
+const execAuditBatchSize = 50
+
+// recordExecAudit logs a command run through a cmd tunnel and queues it for
+// the server. Records are kept on disk until delivered.
+func (d *Dronnayak) recordExecAudit(rec data.ExecAudit) {
+	slog.Info("exec audit",
+		"command", rec.Command,
+		"allowed", rec.Allowed,
+		"run_as", rec.RunAs,
+		"exit_code", rec.ExitCode,
+		"error", rec.Error,
+		"duration_ms", rec.DurationMS)
+
+	if d.auditQueue == nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("failed to marshal exec audit record", "error", err)
+		return
+	}
+	if err := d.auditQueue.Push(b); err != nil {
+		slog.Error("failed to queue exec audit record", "error", err)
+	}
+}
+
+// reportExecAudit posts queued audit records to the server, oldest first.
+// Records stay queued if the server cannot be reached.
+func (d *Dronnayak) reportExecAudit() {
+	if d.auditQueue == nil {
+		return
+	}
+
+	cfg := d.currentConfig()
+	sent := 0
+	for {
+		batch := d.auditQueue.Peek(execAuditBatchSize)
+		if len(batch) == 0 {
+			break
+		}
+		if err := postExecAudit(d.serverURL(), cfg.UUID, d.credential, batch); err != nil {
+			slog.Warn("failed to report exec audit, will retry", "queued", d.auditQueue.Len(), "error", err)
+			break
+		}
+		d.auditQueue.Pop(len(batch))
+		sent += len(batch)
+	}
+
+	if sent > 0 {
+		slog.Info("exec audit reported", "count", sent)
+	}
+}
+
+func postExecAudit(serverURL, uuid string, credential *Credential, records []json.RawMessage) error {
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to marshal exec audit: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/device/%s/exec-audit", serverURL, uuid)
+	_, statusCode, err := web.WebRequest(http.MethodPost, url, string(payload), credential.Headers())
+	if err != nil {
+		return fmt.Errorf("failed to send exec audit: %w", err)
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", statusCode)
+	}
+	return nil
+}
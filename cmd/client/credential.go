@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/KunalDuran/dronnayak-core/internal/web"
+)
+
+// credentialPath returns the path of the device credential kept next to the
+// bootstrap config, e.g. /opt/dronnayak/config.json -> /opt/dronnayak/device.key.
+func credentialPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "device.key")
+}
+
+// Credential is the token the drone authenticates to the server with. The
+// installer writes it to its own file, so it never ends up in the config
+// cache, and it is replaced there when rotated.
+type Credential struct {
+	path string
+
+	mu    sync.RWMutex
+	token string
+}
+
+// LoadCredential reads the credential at path. A missing file gives an empty
+// credential, which only a server with permissive device auth accepts.
+func LoadCredential(path string) (*Credential, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("no device credential, requests will be unauthenticated", "path", path)
+		return &Credential{path: path}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device credential: %w", err)
+	}
+	return &Credential{path: path, token: strings.TrimSpace(string(b))}, nil
+}
+
+// Token returns the credential token, or "" if the drone has none.
+func (c *Credential) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+// Headers returns the request headers that authenticate the drone.
+func (c *Credential) Headers() map[string]string {
+	token := c.Token()
+	if token == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+// Authorize adds the credential to req.
+func (c *Credential) Authorize(req *http.Request) {
+	for key, value := range c.Headers() {
+		req.Header.Set(key, value)
+	}
+}
+
+// Rotate obtains a new credential from serverURL, saves it and switches to
+// it. The server keeps accepting the old credential until the new one is
+// first used, so a failed save leaves the drone on the old one. A drone with
+// no credential cannot rotate; its first one comes with the command.
+func (c *Credential) Rotate(serverURL, uuid string) error {
+	if c.Token() == "" {
+		return fmt.Errorf("no credential to rotate")
+	}
+	url := fmt.Sprintf("%s/device/%s/credentials", serverURL, uuid)
+	resp, statusCode, err := web.WebRequest(http.MethodPost, url, "", c.Headers())
+	if err != nil {
+		return fmt.Errorf("failed to request credential: %w", err)
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", statusCode)
+	}
+
+	return c.Save(resp)
+}
+
+// Save stores the credential in an issued credential document,
+// {"id": ..., "token": ...}, and switches to it.
+func (c *Credential) Save(issued []byte) error {
+	var cred struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(issued, &cred); err != nil || cred.Token == "" {
+		return fmt.Errorf("invalid credential response")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(cred.Token+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write credential: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write credential: %w", err)
+	}
+	c.token = cred.Token
+	slog.Info("device credential saved", "id", cred.ID)
+	return nil
+}
+
+// relayPath returns the relay path for the drone's next tunnel connection to
+// server: a single-use ticket path when the drone has a credential, and the
+// configured relay path otherwise.
+func (d *Dronnayak) relayPath(server string) (string, error) {
+	cfg := d.currentConfig()
+	if d.credential.Token() == "" {
+		return cfg.Tunnel.WSPath, nil
+	}
+
+	url := fmt.Sprintf("%s/device/%s/relay-ticket", server, cfg.UUID)
+	resp, statusCode, err := web.WebRequest(http.MethodPost, url, "", d.credential.Headers())
+	if err != nil {
+		return "", fmt.Errorf("failed to request relay ticket: %w", err)
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return "", fmt.Errorf("relay ticket request failed with status %d", statusCode)
+	}
+	var ticket struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(resp, &ticket); err != nil || ticket.Path == "" {
+		return "", fmt.Errorf("invalid relay ticket response")
+	}
+	return ticket.Path, nil
+}
@@ -2,48 +2,138 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/KunalDuran/dronnayak-core/internal/data"
 	"github.com/KunalDuran/gowsrelay/client"
 	"github.com/bluenviron/gomavlib/v3"
 	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Dronnayak represents the main drone application
 type Dronnayak struct {
-	mavNode        *gomavlib.Node
-	config         *data.Config
+	mavNode   *gomavlib.Node
+	mavMu     sync.RWMutex // guards router, telemetry and tlog, which are replaced on reload
+	router    *MAVLinkRouter
+	telemetry *TelemetryTracker
+	tlog      *TLogRecorder
+	mavCancel context.CancelFunc
+	mavDone   chan struct{}
+
+	configMu     sync.RWMutex // only the config watcher replaces config; other goroutines use currentConfig
+	config       *data.Config
+	configSource string // one of data.ConfigSource*
+	configCache  string // path of the last-known-good server config
+	reloadCh     chan primitive.ObjectID
+	servers      *ServerPool // only the config watcher switches servers
+	credential   *Credential
+
+	statsCancel context.CancelFunc
+	statsDone   chan struct{}
+
+	prober      atomic.Pointer[LinkProber] // nil while probes are off
+	probeCancel context.CancelFunc
+	probeDone   chan struct{}
+
 	ctx            context.Context
 	tunnelManagers map[string]*TunnelManager
 	tunnelMu       sync.Mutex
+	transport      *MuxTransport // shared by tunnels when cfg.Tunnel.Multiplex is set
+	scheduler      *TrafficScheduler
 	wg             sync.WaitGroup
+
+	resultQueue    *DiskQueue // command results awaiting delivery; nil if unavailable
+	resultsMu      sync.Mutex
+	commandResults []json.RawMessage // command results awaiting delivery that are not in resultQueue
+	auditQueue     *DiskQueue        // exec audit records awaiting delivery; nil if unavailable
+
+	pendingUpdate *pendingUpdate // agent update this version is on probation for
+	updating      atomic.Bool
+	checkedIn     atomic.Bool // set once a status report reached the server
+	restartCh     chan struct{}
 }
 
 // NewDronnayak creates a new Dronnayak instance
 func NewDronnayak(configPath string) (*Dronnayak, error) {
+	// Done first so a new version that cannot even load its config still counts an attempt.
+	update, updateResult := resumeAgentUpdate()
+
 	bootstrap, err := data.LoadConfig(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 
-	config, err := data.LoadConfigV2(bootstrap.Server.URL, bootstrap.UUID)
+	credential, err := LoadCredential(credentialPath(configPath))
 	if err != nil {
-		slog.Warn("failed to fetch config from server, falling back to local config", "error", err)
-		config = bootstrap
+		return nil, err
+	}
+
+	cachePath := configCachePath(configPath)
+	source := data.ConfigSourceServer
+
+	servers := bootstrap.Server.Servers()
+	var discovered []string
+	if discoveryURL := bootstrap.Server.DiscoveryURL; discoveryURL != "" {
+		if discovered, err = data.FetchServerDiscovery(discoveryURL); err == nil {
+			servers = discovered
+		} else {
+			slog.Warn("server discovery failed, using configured servers", "url", discoveryURL, "error", err)
+		}
+	}
+
+	config, active, err := loadServerConfig(servers, bootstrap.UUID, credential)
+	if err == nil {
+		if err := data.SaveConfig(cachePath, config); err != nil {
+			slog.Warn("failed to cache server config", "path", cachePath, "error", err)
+		}
+	} else if cached, cacheErr := loadCachedConfig(cachePath, bootstrap.UUID); cacheErr == nil {
+		slog.Warn("failed to fetch config from server, using cached config", "error", err, "path", cachePath, "version", cached.Version)
+		config, source = cached, data.ConfigSourceCache
+	} else {
+		slog.Warn("failed to fetch config from server, falling back to local config", "error", err, "cache_error", cacheErr)
+		config, source = bootstrap, data.ConfigSourceBootstrap
+	}
+
+	if config.Server.DiscoveryURL != bootstrap.Server.DiscoveryURL {
+		discovered = nil // the list is not config's
 	}
 
-	return &Dronnayak{
+	d := &Dronnayak{
 		config:         config,
+		configSource:   source,
+		configCache:    cachePath,
+		reloadCh:       make(chan primitive.ObjectID, 1),
+		servers:        NewServerPool(config.Server, discovered, active),
+		credential:     credential,
 		tunnelManagers: make(map[string]*TunnelManager),
-	}, nil
+		scheduler:      NewTrafficScheduler(),
+		pendingUpdate:  update,
+		restartCh:      make(chan struct{}, 1),
+	}
+	if d.auditQueue, err = NewDiskQueue(config.Exec.AuditDir, config.Exec.AuditLimit); err != nil {
+		slog.Error("exec audit queue unavailable, audit records will only be logged", "error", err)
+	}
+	if d.resultQueue, err = NewDiskQueue(commandResultsDir(configPath), commandResultLimit); err != nil {
+		slog.Error("command result queue unavailable, results will be kept in memory", "error", err)
+	}
+	if updateResult != nil {
+		d.recordCommandResult(updateResult.ID, errors.New(updateResult.Error))
+	}
+	return d, nil
 }
 
 // Run starts the application and blocks until shutdown
@@ -59,35 +149,52 @@ func (d *Dronnayak) Run(ctx context.Context) error {
 
 	// Initialize MAVLink node if enabled in config
 	if d.config.MAVLink.Enabled {
-		if err := d.initMAVLink(); err != nil {
+		if err := d.startMAVLink(ctx); err != nil {
 			return fmt.Errorf("failed to initialize MAVLink: %w", err)
 		}
-		defer d.Close()
-
-		d.wg.Add(1)
-		go func() {
-			defer d.wg.Done()
-			d.processMAVLinkEvents(ctx)
-		}()
 	} else {
 		slog.Info("MAVLink disabled by config, skipping initialization")
 	}
+	defer d.Close()
 
 	// Start WebSocket tunnels
 	d.startTunnels(ctx, d.config.Tunnel.Endpoints)
 
 	// Start stats reporting if enabled
 	if d.config.Stats.Enabled {
+		d.startStats(ctx)
+	}
+
+	// Link probes are reported with stats
+	if d.config.Stats.Enabled && d.config.Probe.Enabled {
+		d.startProbes(ctx)
+	}
+
+	// Apply config changes from the server while running
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.watchConfig(ctx)
+	}()
+
+	// Commit or roll back an agent update once services are running
+	if d.pendingUpdate != nil {
 		d.wg.Add(1)
 		go func() {
 			defer d.wg.Done()
-			d.startStatsReporter(ctx)
+			d.superviseUpdate(ctx, d.pendingUpdate)
 		}()
 	}
 
 	// Wait for shutdown signal
-	sig := <-sigChan
-	slog.Info("received shutdown signal, shutting down gracefully", "signal", sig)
+	var result error
+	select {
+	case sig := <-sigChan:
+		slog.Info("received shutdown signal, shutting down gracefully", "signal", sig)
+	case <-d.restartCh:
+		slog.Info("restart requested, shutting down gracefully")
+		result = errRestart
+	}
 
 	// Cancel context to signal all goroutines to stop
 	cancel()
@@ -96,23 +203,26 @@ func (d *Dronnayak) Run(ctx context.Context) error {
 	d.wg.Wait()
 	slog.Info("all services stopped")
 
-	return nil
+	return result
 }
 
 // initMAVLink initializes the MAVLink node with current configuration
 func (d *Dronnayak) initMAVLink() error {
-	serialPort := d.detectSerialPort()
+	var endpoints []gomavlib.EndpointConf
+	filters := make(map[gomavlib.EndpointConf]*FrameFilter)
+	for _, ep := range d.config.MAVLink.Endpoints {
+		conf, err := d.mavlinkEndpointConf(ep)
+		if err != nil {
+			return fmt.Errorf("invalid %s endpoint: %w", ep.Type, err)
+		}
+		endpoints = append(endpoints, conf)
+		if filter := NewFrameFilter(ep); filter != nil {
+			filters[conf] = filter
+		}
+	}
 
 	nodeConf := gomavlib.NodeConf{
-		Endpoints: []gomavlib.EndpointConf{
-			gomavlib.EndpointSerial{
-				Device: serialPort,
-				Baud:   d.config.MAVLink.BaudRate,
-			},
-			&gomavlib.EndpointTCPServer{
-				Address: d.config.MAVLink.TCPAddress,
-			},
-		},
+		Endpoints:   endpoints,
 		Dialect:     common.Dialect,
 		OutVersion:  gomavlib.V2,
 		OutSystemID: d.config.MAVLink.OutSystemID,
@@ -123,16 +233,104 @@ func (d *Dronnayak) initMAVLink() error {
 		slog.Info("stream frequency configured", "hz", d.config.MAVLink.StreamFrequency)
 	}
 
+	var recorder *TLogRecorder
+	if d.config.MAVLink.TLog.Enabled {
+		var err error
+		recorder, err = NewTLogRecorder(d.config.MAVLink.TLog)
+		if err != nil {
+			return fmt.Errorf("failed to initialize tlog recording: %w", err)
+		}
+	}
+
 	node, err := gomavlib.NewNode(nodeConf)
 	if err != nil {
+		recorder.Close()
 		return fmt.Errorf("failed to create MAVLink node: %w", err)
 	}
 
+	d.mavMu.Lock()
 	d.mavNode = node
-	slog.Info("MAVLink initialized", "port", serialPort, "baud", d.config.MAVLink.BaudRate)
+	d.router = NewMAVLinkRouter(node, filters)
+	d.telemetry = NewTelemetryTracker()
+	d.tlog = recorder
+	d.mavMu.Unlock()
+	slog.Info("MAVLink initialized", "endpoints", len(endpoints))
 	return nil
 }
 
+// startMAVLink initializes the MAVLink node and starts processing its events.
+func (d *Dronnayak) startMAVLink(ctx context.Context) error {
+	if err := d.initMAVLink(); err != nil {
+		return err
+	}
+
+	mavCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	d.mavCancel = cancel
+	d.mavDone = done
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(done)
+		d.processMAVLinkEvents(mavCtx)
+	}()
+	return nil
+}
+
+// stopMAVLink stops the event processor and closes the MAVLink node, if running.
+func (d *Dronnayak) stopMAVLink() {
+	if d.mavCancel == nil {
+		return
+	}
+	d.mavCancel()
+	<-d.mavDone
+	d.mavCancel, d.mavDone = nil, nil
+	d.Close()
+}
+
+// mavlinkState returns the current router, telemetry tracker and tlog
+// recorder; any of them may be nil.
+func (d *Dronnayak) mavlinkState() (*MAVLinkRouter, *TelemetryTracker, *TLogRecorder) {
+	d.mavMu.RLock()
+	defer d.mavMu.RUnlock()
+	return d.router, d.telemetry, d.tlog
+}
+
+// mavlinkEndpointConf converts a configured MAVLink endpoint into its gomavlib equivalent.
+// Add new endpoint types here alongside data.MAVLinkEndpointType.
+func (d *Dronnayak) mavlinkEndpointConf(ep data.MAVLinkEndpoint) (gomavlib.EndpointConf, error) {
+	switch ep.Type {
+	case data.MAVLinkEndpointSerial:
+		device := ep.Address
+		if device == "" {
+			device = d.detectSerialPort()
+		}
+		if serialDeviceInUse(device) {
+			return nil, fmt.Errorf("serial device %s is in use by a tunnel", device)
+		}
+		slog.Info("mavlink endpoint", "type", ep.Type, "device", device, "baud", ep.BaudRate)
+		return gomavlib.EndpointSerial{Device: device, Baud: ep.BaudRate}, nil
+	case data.MAVLinkEndpointTCPServer:
+		slog.Info("mavlink endpoint", "type", ep.Type, "address", ep.Address)
+		return gomavlib.EndpointTCPServer{Address: ep.Address}, nil
+	case data.MAVLinkEndpointTCPClient:
+		slog.Info("mavlink endpoint", "type", ep.Type, "address", ep.Address)
+		return gomavlib.EndpointTCPClient{Address: ep.Address}, nil
+	case data.MAVLinkEndpointUDPServer:
+		slog.Info("mavlink endpoint", "type", ep.Type, "address", ep.Address)
+		return gomavlib.EndpointUDPServer{Address: ep.Address}, nil
+	case data.MAVLinkEndpointUDPClient:
+		slog.Info("mavlink endpoint", "type", ep.Type, "address", ep.Address)
+		return gomavlib.EndpointUDPClient{Address: ep.Address}, nil
+	case data.MAVLinkEndpointUDPBroadcast:
+		slog.Info("mavlink endpoint", "type", ep.Type, "address", ep.Address, "local_address", ep.LocalAddress)
+		return gomavlib.EndpointUDPBroadcast{BroadcastAddress: ep.Address, LocalAddress: ep.LocalAddress}, nil
+	default:
+		return nil, fmt.Errorf("unknown endpoint type %q", ep.Type)
+	}
+}
+
 // detectSerialPort detects the appropriate serial port based on OS
 func (d *Dronnayak) detectSerialPort() string {
 	if d.config.MAVLink.SerialPort != "" {
@@ -140,20 +338,21 @@ func (d *Dronnayak) detectSerialPort() string {
 		return d.config.MAVLink.SerialPort
 	}
 
-	var defaultPort string
+	defaultPort := defaultSerialPort()
+	slog.Info("using auto-detected serial port", "port", defaultPort, "os", runtime.GOOS)
+	return defaultPort
+}
+
+// defaultSerialPort returns the usual autopilot serial port for this OS.
+func defaultSerialPort() string {
 	switch runtime.GOOS {
-	case "linux":
-		defaultPort = "/dev/ttyACM0"
 	case "windows":
-		defaultPort = "COM4"
+		return "COM4"
 	case "darwin":
-		defaultPort = "/dev/tty.usbmodem1"
+		return "/dev/tty.usbmodem1"
 	default:
-		defaultPort = "/dev/ttyACM0"
+		return "/dev/ttyACM0"
 	}
-
-	slog.Info("using auto-detected serial port", "port", defaultPort, "os", runtime.GOOS)
-	return defaultPort
 }
 
 // processMAVLinkEvents handles all MAVLink events
@@ -167,6 +366,7 @@ func (d *Dronnayak) processMAVLinkEvents(ctx context.Context) {
 			switch e := evt.(type) {
 			case *gomavlib.EventChannelOpen:
 				slog.Info("channel opened", "channel", e.Channel)
+				d.router.Open(e.Channel)
 
 			case *gomavlib.EventStreamRequested:
 				slog.Info("stream requested",
@@ -181,11 +381,14 @@ func (d *Dronnayak) processMAVLinkEvents(ctx context.Context) {
 				slog.Warn("parse error", "error", e.Error)
 
 			case *gomavlib.EventFrame:
-				// Forward frame to other endpoints (Pixhawk <-> Mission Planner)
-				d.mavNode.WriteFrameExcept(e.Channel, e.Frame)
+				// Forward frame to the endpoints behind its target (Pixhawk <-> Mission Planner)
+				d.router.Route(e)
+				d.telemetry.Update(e.Frame)
+				d.tlog.Record(e.Frame, time.Now())
 
 			case *gomavlib.EventChannelClose:
 				slog.Info("channel closed", "channel", e.Channel)
+				d.router.Forget(e.Channel)
 			}
 
 		case <-ctx.Done():
@@ -196,19 +399,70 @@ func (d *Dronnayak) processMAVLinkEvents(ctx context.Context) {
 
 // endpointFactory returns an EndpointFactory for the given TunnelEntry.
 // Add new endpoint types here as the client package grows.
-func endpointFactory(entry data.TunnelEntry) (EndpointFactory, error) {
+func (d *Dronnayak) endpointFactory(entry data.TunnelEntry) (EndpointFactory, error) {
 	switch entry.Type {
 	case data.EndpointTypeTCP:
 		if entry.Port == "" {
 			return nil, fmt.Errorf("tcp endpoint requires a port")
 		}
-		port := entry.Port
+		host, port := entry.Host, entry.Port
+		if host == "" {
+			host = "localhost"
+		}
+		return func() (client.LocalEndpoint, error) {
+			return client.TCPEndpoint(host, port)
+		}, nil
+	case data.EndpointTypeUDP:
+		if entry.Port == "" {
+			return nil, fmt.Errorf("udp endpoint requires a port")
+		}
+		host, port := entry.Host, entry.Port
+		if entry.IsLocal() {
+			return func() (client.LocalEndpoint, error) {
+				return NewUDPEndpoint("127.0.0.1", port)
+			}, nil
+		}
 		return func() (client.LocalEndpoint, error) {
-			return client.TCPEndpoint("localhost", port)
+			return DialUDPEndpoint(host, port)
+		}, nil
+	case data.EndpointTypeSerial:
+		if entry.Device == "" {
+			return nil, fmt.Errorf("serial endpoint requires a device")
+		}
+		device, baud := entry.Device, entry.BaudRate
+		if baud == 0 {
+			baud = defaultSerialBaudRate
+		}
+		return func() (client.LocalEndpoint, error) {
+			return NewSerialEndpoint(device, baud)
 		}, nil
 	case data.EndpointTypeCmd:
 		return func() (client.LocalEndpoint, error) {
-			return client.NewCmdEndpoint(), nil
+			return NewExecEndpoint(func() data.ExecPolicy { return d.currentConfig().Exec }, d.recordExecAudit), nil
+		}, nil
+	case data.EndpointTypePTY:
+		return func() (client.LocalEndpoint, error) {
+			return NewPTYEndpoint(d.currentConfig().Exec, d.recordExecAudit)
+		}, nil
+	case data.EndpointTypeFile:
+		return func() (client.LocalEndpoint, error) {
+			return NewFileEndpoint(func() []string { return d.currentConfig().Files.Roots }), nil
+		}, nil
+	case data.EndpointTypeHTTP:
+		if entry.Port == "" {
+			return nil, fmt.Errorf("http endpoint requires a port")
+		}
+		host := entry.Host
+		if host == "" {
+			host = "localhost"
+		}
+		addr := net.JoinHostPort(host, entry.Port)
+		return func() (client.LocalEndpoint, error) {
+			return NewForwardEndpoint(addr), nil
+		}, nil
+	case data.EndpointTypeSOCKS5:
+		return func() (client.LocalEndpoint, error) {
+			return NewSOCKSEndpoint(d.socksTargetCheck), nil
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown endpoint type %q", entry.Type)
@@ -221,20 +475,34 @@ func (d *Dronnayak) makeTunnelID(entry data.TunnelEntry) string {
 	if label == "" {
 		label = string(entry.Type)
 	}
-	return fmt.Sprintf("%s_%s", d.config.UUID, label)
+	return fmt.Sprintf("%s_%s", d.currentConfig().UUID, label)
 }
 
 // stopTunnel gracefully stops the tunnel with the given ID by cancelling its context.
-func (d *Dronnayak) stopTunnel(tunnelID string) {
+func (d *Dronnayak) stopTunnel(tunnelID string) error {
 	d.tunnelMu.Lock()
 	tm, ok := d.tunnelManagers[tunnelID]
 	d.tunnelMu.Unlock()
 
 	if !ok {
 		slog.Warn("stop requested for unknown tunnel", "id", tunnelID)
-		return
+		return fmt.Errorf("unknown tunnel %q", tunnelID)
 	}
 	tm.Stop()
+	return nil
+}
+
+// tunnelHealth returns the health of every running tunnel, ordered by ID.
+func (d *Dronnayak) tunnelHealth() []data.TunnelHealth {
+	d.tunnelMu.Lock()
+	health := make([]data.TunnelHealth, 0, len(d.tunnelManagers))
+	for _, tm := range d.tunnelManagers {
+		health = append(health, tm.Health())
+	}
+	d.tunnelMu.Unlock()
+
+	sort.Slice(health, func(i, j int) bool { return health[i].ID < health[j].ID })
+	return health
 }
 
 // startTunnels starts WebSocket tunnels for the given endpoints with automatic reconnection.
@@ -245,64 +513,126 @@ func (d *Dronnayak) startTunnels(ctx context.Context, endpoints []data.TunnelEnt
 		return
 	}
 
-	serverHost := d.cleanServerURL(d.config.Server.URL)
 	started := 0
-
 	for _, entry := range endpoints {
-		tunnelID := d.makeTunnelID(entry)
-
-		d.tunnelMu.Lock()
-		_, exists := d.tunnelManagers[tunnelID]
-		d.tunnelMu.Unlock()
-
-		if exists {
-			slog.Warn("tunnel already running, skipping", "id", tunnelID)
-			continue
-		}
-
-		factory, err := endpointFactory(entry)
-		if err != nil {
+		if err := d.startTunnel(ctx, entry); err != nil {
 			slog.Warn("skipping tunnel endpoint", "label", entry.Label, "error", err)
 			continue
 		}
+		started++
+	}
 
-		tunnelCtx, tunnelCancel := context.WithCancel(ctx)
-		tm := NewTunnelManager(serverHost, d.config.Tunnel.WSPath, tunnelID, entry.Label, factory, tunnelCancel)
-		if strings.Contains(d.config.Server.URL, "https") {
-			tm.wsScheme = "wss"
-		}
+	slog.Info("tunnels started", "count", started, "auto_reconnect", true)
+}
+
+// startTunnel starts a single tunnel in the background. It fails if the
+// tunnel is already running, its host is not allowed, or the endpoint cannot
+// be built.
+func (d *Dronnayak) startTunnel(ctx context.Context, entry data.TunnelEntry) error {
+	tunnelID := d.makeTunnelID(entry)
 
-		d.tunnelMu.Lock()
-		d.tunnelManagers[tunnelID] = tm
+	cfg := d.currentConfig()
+	if err := checkTunnel(cfg, entry); err != nil {
+		return err
+	}
+
+	factory, err := d.endpointFactory(entry)
+	if err != nil {
+		return err
+	}
+	factory = d.scheduler.Shape(entry, factory)
+
+	tunnelCtx, tunnelCancel := context.WithCancel(ctx)
+	tm, err := d.newTunnelManager(cfg, tunnelID, entry.Label, entry.Priority, factory, tunnelCancel)
+	if err != nil {
+		tunnelCancel()
+		return err
+	}
+	tm.entry = entry
+
+	d.tunnelMu.Lock()
+	if _, exists := d.tunnelManagers[tunnelID]; exists {
 		d.tunnelMu.Unlock()
+		tunnelCancel()
+		return fmt.Errorf("tunnel %q already running", tunnelID)
+	}
+	d.tunnelManagers[tunnelID] = tm
+	d.tunnelMu.Unlock()
 
-		started++
-		d.wg.Add(1)
-		go func(manager *TunnelManager) {
-			defer d.wg.Done()
-			defer func() {
-				d.tunnelMu.Lock()
-				delete(d.tunnelManagers, manager.tunnelID)
-				d.tunnelMu.Unlock()
-			}()
-			manager.Start(tunnelCtx)
-		}(tm)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(tm.done)
+		defer func() {
+			d.tunnelMu.Lock()
+			delete(d.tunnelManagers, tm.tunnelID)
+			d.tunnelMu.Unlock()
+		}()
+		tm.Start(tunnelCtx)
+	}()
+	return nil
+}
+
+// checkTunnel reports whether cfg allows a tunnel for entry: its endpoint
+// must pass the tunnel allowlist, and a serial device must not be in use by
+// MAVLink.
+func checkTunnel(cfg *data.Config, entry data.TunnelEntry) error {
+	if err := cfg.Tunnel.CheckEndpoint(entry); err != nil {
+		return err
 	}
+	if entry.Type == data.EndpointTypeSerial && cfg.MAVLink.Enabled {
+		key := serialDeviceKey(entry.Device)
+		for _, dev := range cfg.MAVLinkSerialDevices(defaultSerialPort()) {
+			if serialDeviceKey(dev) == key {
+				return fmt.Errorf("serial device %s is used by MAVLink", entry.Device)
+			}
+		}
+	}
+	return nil
+}
 
-	slog.Info("tunnels started", "count", started, "auto_reconnect", true)
+// newTunnelManager returns a manager for a tunnel to the server in use, over
+// the shared transport when cfg.Tunnel.Multiplex is set.
+func (d *Dronnayak) newTunnelManager(cfg *data.Config, tunnelID, label string, priority data.TunnelPriority, factory EndpointFactory, cancel context.CancelFunc) (*TunnelManager, error) {
+	tm := NewTunnelManager(d.serverURL, d.relayPath, tunnelID, label, factory, cancel)
+	tm.priority = priority
+	if cfg.Tunnel.Multiplex {
+		if _, err := d.muxTransport(cfg.UUID); err != nil {
+			return nil, err
+		}
+		tm.transport = func() (*MuxTransport, error) { return d.muxTransport(cfg.UUID) }
+	}
+	return tm, nil
 }
 
-// cleanServerURL removes http/https schema from server URL
-func (d *Dronnayak) cleanServerURL(url string) string {
-	url = strings.TrimPrefix(url, "http://")
-	url = strings.TrimPrefix(url, "https://")
-	return url
+// muxTransport returns the shared tunnel transport to the server in use,
+// replacing one left over from a different server.
+func (d *Dronnayak) muxTransport(uuid string) (*MuxTransport, error) {
+	next, err := NewMuxTransport(d.serverURL(), uuid, d.credential, d.scheduler)
+	if err != nil {
+		return nil, err
+	}
+	d.tunnelMu.Lock()
+	defer d.tunnelMu.Unlock()
+	if d.transport != nil && d.transport.url == next.url {
+		return d.transport, nil
+	}
+	if d.transport != nil {
+		d.transport.Close()
+	}
+	d.transport = next
+	return next, nil
 }
 
 // Close gracefully shuts down the MAVLink node
 func (d *Dronnayak) Close() {
+	d.mavMu.Lock()
+	defer d.mavMu.Unlock()
+
 	if d.mavNode != nil {
 		slog.Info("closing MAVLink node")
 		d.mavNode.Close()
 	}
+	d.tlog.Close()
+	d.mavNode, d.router, d.telemetry, d.tlog = nil, nil, nil, nil
 }
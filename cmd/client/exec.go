@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+)
+
+// execKillCommand stops the running command instead of starting a new one.
+const execKillCommand = "exit"
+
+// execResponse is sent to the tunnel once per received command.
+type execResponse struct {
+	Stdout    string `json:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+	ExitCode  int    `json:"exit_code"`
+	Error     string `json:"error,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// ExecEndpoint backs "cmd" tunnels. Each message received is one command
+// line, which runs only if the device's ExecPolicy allows it; its output and
+// exit status are sent back as one JSON message and every command is audited.
+// Sending "exit" kills the running command.
+type ExecEndpoint struct {
+	policy func() data.ExecPolicy
+	audit  func(data.ExecAudit)
+
+	out       chan []byte
+	rest      []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // cancels the running command, if any
+}
+
+// NewExecEndpoint returns an endpoint that looks up the policy for every
+// command, so policy changes apply without reconnecting.
+func NewExecEndpoint(policy func() data.ExecPolicy, audit func(data.ExecAudit)) *ExecEndpoint {
+	return &ExecEndpoint{
+		policy: policy,
+		audit:  audit,
+		out:    make(chan []byte, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// Read returns the next response.
+func (e *ExecEndpoint) Read(p []byte) (int, error) {
+	if len(e.rest) == 0 {
+		select {
+		case msg := <-e.out:
+			e.rest = msg
+		case <-e.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, e.rest)
+	e.rest = e.rest[n:]
+	return n, nil
+}
+
+// Write accepts one command line.
+func (e *ExecEndpoint) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if line == "" {
+		return len(p), nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if line == execKillCommand {
+		if e.cancel == nil {
+			go e.send(execResponse{ExitCode: -1, Error: "no command is running"})
+		} else {
+			e.cancel()
+		}
+		return len(p), nil
+	}
+	if e.cancel != nil {
+		go e.send(execResponse{ExitCode: -1, Error: "a command is already running; send exit to stop it"})
+		return len(p), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go func() {
+		resp := e.run(ctx, line)
+		e.mu.Lock()
+		e.cancel = nil
+		e.mu.Unlock()
+		cancel()
+		e.send(resp)
+	}()
+	return len(p), nil
+}
+
+// Close kills any running command.
+func (e *ExecEndpoint) Close() error {
+	e.closeOnce.Do(func() {
+		e.mu.Lock()
+		if e.cancel != nil {
+			e.cancel()
+		}
+		e.mu.Unlock()
+		close(e.closed)
+	})
+	return nil
+}
+
+func (e *ExecEndpoint) send(resp execResponse) {
+	msg, err := json.Marshal(resp)
+	if err != nil {
+		slog.Error("failed to marshal exec response", "error", err)
+		return
+	}
+	select {
+	case e.out <- msg:
+	case <-e.closed:
+	}
+}
+
+// run checks line against the policy, runs it and audits the outcome.
+func (e *ExecEndpoint) run(ctx context.Context, line string) execResponse {
+	policy := e.policy()
+	record := data.ExecAudit{Command: line, RunAs: policy.RunAs, ExitCode: -1, StartedAt: time.Now()}
+	defer func() {
+		record.DurationMS = time.Since(record.StartedAt).Milliseconds()
+		e.audit(record)
+	}()
+
+	argv, err := authorizeCommand(policy, line)
+	if err != nil {
+		record.Error = err.Error()
+		slog.Warn("command rejected by exec policy", "command", line, "error", err)
+		return execResponse{ExitCode: -1, Error: record.Error}
+	}
+	record.Allowed = true
+
+	ctx, cancel := context.WithTimeout(ctx, policy.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = policy.WorkDir
+	cmd.WaitDelay = time.Second
+	if err := configureExecCmd(cmd, policy.RunAs); err != nil {
+		record.Error = err.Error()
+		return execResponse{ExitCode: -1, Error: record.Error}
+	}
+
+	stdout := &limitedBuffer{max: policy.MaxOutput}
+	stderr := &limitedBuffer{max: policy.MaxOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	slog.Info("executing command", "command", line, "run_as", policy.RunAs)
+	err = cmd.Run()
+
+	resp := execResponse{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		ExitCode:  -1,
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+	if cmd.ProcessState != nil {
+		resp.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		resp.Error = fmt.Sprintf("command timed out after %s", policy.Timeout)
+	case ctx.Err() != nil:
+		resp.Error = "command killed"
+	case err != nil && !errors.As(err, &exitErr):
+		resp.Error = err.Error()
+	}
+
+	record.ExitCode, record.Error = resp.ExitCode, resp.Error
+	return resp
+}
+
+// authorizeCommand splits line into arguments and checks it against the
+// policy: the program must be in AllowedCommands or the whole line must
+// match one of AllowedPatterns.
+func authorizeCommand(policy data.ExecPolicy, line string) ([]string, error) {
+	argv, err := splitCommandLine(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	for _, allowed := range policy.AllowedCommands {
+		// A bare name only matches a bare name, so "uptime" does not allow "/tmp/uptime".
+		if argv[0] == allowed && (filepath.IsAbs(allowed) || !strings.ContainsRune(allowed, '/')) {
+			return argv, nil
+		}
+	}
+
+	patterns, err := policy.CompilePatterns()
+	if err != nil {
+		return nil, err
+	}
+	for _, re := range patterns {
+		if re.MatchString(line) {
+			return argv, nil
+		}
+	}
+	return nil, fmt.Errorf("command %q is not allowed by the exec policy", argv[0])
+}
+
+// splitCommandLine splits a command line into arguments on whitespace,
+// honouring single quotes, double quotes and backslash escapes. Nothing else
+// is interpreted: there are no pipes, redirections, variables or globs.
+func splitCommandLine(line string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("unterminated quote or escape in command")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the rest.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// configureExecCmd only supports running as the agent's own user on this platform.
+func configureExecCmd(cmd *exec.Cmd, runAs string) error {
+	if runAs != "" {
+		return fmt.Errorf("run-as user is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+)
+
+// maxFileChunk caps the data returned by one read request.
+const maxFileChunk = 256 << 10
+
+// FileEndpoint backs "file" tunnels. Requests and responses are JSON values
+// in a stream, so they may arrive split across or combined in tunnel messages.
+//
+// Pulls stat the file with a checksum, then read it in chunks by offset.
+// Pushes call begin_write, which returns how much of an earlier interrupted
+// push is already on disk, write the remaining chunks in order to a hidden
+// .part file next to the target, then commit with the expected SHA-256; the
+// file only replaces the target if the checksum matches.
+type FileEndpoint struct {
+	roots func() []string
+
+	in        *io.PipeWriter
+	out       chan []byte
+	rest      []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFileEndpoint returns an endpoint that looks up the allowed roots for
+// every request, so config changes apply without reconnecting.
+func NewFileEndpoint(roots func() []string) *FileEndpoint {
+	pr, pw := io.Pipe()
+	e := &FileEndpoint{
+		roots:  roots,
+		in:     pw,
+		out:    make(chan []byte, 4),
+		closed: make(chan struct{}),
+	}
+	go e.serve(pr)
+	return e
+}
+
+// Read returns the next part of the response stream.
+func (e *FileEndpoint) Read(p []byte) (int, error) {
+	if len(e.rest) == 0 {
+		select {
+		case msg := <-e.out:
+			e.rest = msg
+		case <-e.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, e.rest)
+	e.rest = e.rest[n:]
+	return n, nil
+}
+
+// Write feeds the request stream.
+func (e *FileEndpoint) Write(p []byte) (int, error) {
+	return e.in.Write(p)
+}
+
+// Close stops serving requests.
+func (e *FileEndpoint) Close() error {
+	e.closeOnce.Do(func() {
+		e.in.Close()
+		close(e.closed)
+	})
+	return nil
+}
+
+func (e *FileEndpoint) serve(r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		var req data.FileRequest
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+				slog.Warn("file tunnel: invalid request stream", "error", err)
+				e.Close()
+			}
+			return
+		}
+
+		resp := e.handle(req)
+		resp.ID = req.ID
+		msg, err := json.Marshal(resp)
+		if err != nil {
+			slog.Error("file tunnel: failed to marshal response", "error", err)
+			continue
+		}
+		select {
+		case e.out <- append(msg, '\n'):
+		case <-e.closed:
+			return
+		}
+	}
+}
+
+func (e *FileEndpoint) handle(req data.FileRequest) data.FileResponse {
+	roots := e.roots()
+	if len(roots) == 0 {
+		return data.FileResponse{Error: "file transfer is disabled on this device"}
+	}
+
+	if req.Op == "list" && req.Path == "" {
+		// The roots themselves are the top of the browser.
+		var resp data.FileResponse
+		for _, root := range roots {
+			entry := data.FileEntry{Name: root, Dir: true}
+			if info, err := os.Stat(root); err == nil {
+				entry.Mode, entry.ModTime = info.Mode().String(), info.ModTime()
+			}
+			resp.Entries = append(resp.Entries, entry)
+		}
+		return resp
+	}
+
+	path, err := resolveFilePath(roots, req.Path)
+	if err != nil {
+		return data.FileResponse{Error: err.Error()}
+	}
+
+	var resp data.FileResponse
+	switch req.Op {
+	case "list":
+		resp, err = listDir(path)
+	case "stat":
+		resp, err = statFile(path, req.Checksum)
+	case "read":
+		resp, err = readChunk(path, req.Offset, req.Length)
+	case "begin_write":
+		resp, err = beginWrite(path, req.Size)
+	case "write":
+		resp, err = writeChunk(path, req.Offset, req.Data)
+	case "commit":
+		resp, err = commitWrite(path, req.SHA256)
+		if err == nil {
+			slog.Info("file received", "path", path, "size", resp.Size)
+		}
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+	if err != nil {
+		// Offset tells a rejected write where to resume.
+		return data.FileResponse{Error: err.Error(), Offset: resp.Offset}
+	}
+	return resp
+}
+
+// resolveFilePath cleans p and resolves symlinks in it, then checks that the
+// result is inside one of roots. The last element may not exist yet.
+func resolveFilePath(roots []string, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("path %q must be absolute", p)
+	}
+	clean := filepath.Clean(p)
+
+	resolved, err := filepath.EvalSymlinks(clean)
+	if errors.Is(err, os.ErrNotExist) {
+		var dir string
+		dir, err = filepath.EvalSymlinks(filepath.Dir(clean))
+		resolved = filepath.Join(dir, filepath.Base(clean))
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", p, err)
+	}
+
+	for _, root := range roots {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		if resolved == realRoot || strings.HasPrefix(resolved, realRoot+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("path %s is outside the allowed directories", p)
+}
+
+func listDir(path string) (data.FileResponse, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return data.FileResponse{}, err
+	}
+	resp := data.FileResponse{Entries: []data.FileEntry{}}
+	for _, de := range entries {
+		if isPartFile(de.Name()) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		resp.Entries = append(resp.Entries, data.FileEntry{
+			Name:    de.Name(),
+			Dir:     info.IsDir(),
+			Size:    info.Size(),
+			Mode:    info.Mode().String(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(resp.Entries, func(i, j int) bool {
+		a, b := resp.Entries[i], resp.Entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		return a.Name < b.Name
+	})
+	return resp, nil
+}
+
+func statFile(path string, checksum bool) (data.FileResponse, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return data.FileResponse{}, err
+	}
+	if info.IsDir() {
+		return data.FileResponse{}, fmt.Errorf("%s is a directory", path)
+	}
+	modTime := info.ModTime()
+	resp := data.FileResponse{Size: info.Size(), ModTime: &modTime}
+	if checksum {
+		if resp.SHA256, err = fileSHA256(path); err != nil {
+			return data.FileResponse{}, err
+		}
+	}
+	return resp, nil
+}
+
+func readChunk(path string, offset int64, length int) (data.FileResponse, error) {
+	if length <= 0 || length > maxFileChunk {
+		length = maxFileChunk
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return data.FileResponse{}, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return data.FileResponse{}, err
+	}
+	return data.FileResponse{Offset: offset + int64(n), Data: buf[:n], EOF: errors.Is(err, io.EOF)}, nil
+}
+
+// partPath is where a push to path is staged until it is committed.
+func partPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".part")
+}
+
+func isPartFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".part")
+}
+
+// beginWrite starts or resumes a push of size bytes and returns the offset
+// to continue from.
+func beginWrite(path string, size int64) (data.FileResponse, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return data.FileResponse{}, fmt.Errorf("%s is a directory", path)
+	}
+	part := partPath(path)
+	info, err := os.Stat(part)
+	if err == nil && info.Size() <= size {
+		return data.FileResponse{Offset: info.Size()}, nil
+	}
+	// No earlier attempt, or one for a different file: start over.
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return data.FileResponse{}, err
+	}
+	return data.FileResponse{}, f.Close()
+}
+
+// writeChunk appends data to the staged push. Chunks must arrive in order;
+// a mismatched offset is rejected with the offset that is expected instead.
+func writeChunk(path string, offset int64, chunk []byte) (data.FileResponse, error) {
+	f, err := os.OpenFile(partPath(path), os.O_WRONLY, 0)
+	if err != nil {
+		return data.FileResponse{}, fmt.Errorf("no push in progress: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return data.FileResponse{}, err
+	}
+	if info.Size() != offset {
+		return data.FileResponse{Offset: info.Size()}, fmt.Errorf("write at offset %d, expected %d", offset, info.Size())
+	}
+	if _, err := f.WriteAt(chunk, offset); err != nil {
+		return data.FileResponse{}, err
+	}
+	return data.FileResponse{Offset: offset + int64(len(chunk))}, nil
+}
+
+// commitWrite moves the staged push into place if its checksum matches.
+func commitWrite(path, expected string) (data.FileResponse, error) {
+	part := partPath(path)
+	sum, err := fileSHA256(part)
+	if err != nil {
+		return data.FileResponse{}, err
+	}
+	if !strings.EqualFold(sum, expected) {
+		os.Remove(part)
+		return data.FileResponse{}, fmt.Errorf("checksum mismatch: got %s, expected %s", sum, expected)
+	}
+	info, err := os.Stat(part)
+	if err != nil {
+		return data.FileResponse{}, err
+	}
+	if err := os.Rename(part, path); err != nil {
+		return data.FileResponse{}, err
+	}
+	return data.FileResponse{Size: info.Size(), SHA256: sum}, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/bluenviron/gomavlib/v3"
+)
+
+// FrameFilter decides which frames may be forwarded to the channels of one
+// configured MAVLink endpoint, applying its allow/deny lists and per-message
+// rate limits. Rate limits are tracked per channel, so every client of a
+// server endpoint gets its own budget.
+type FrameFilter struct {
+	allow       map[uint32]struct{}
+	deny        map[uint32]struct{}
+	minInterval map[uint32]time.Duration
+
+	mu       sync.Mutex
+	lastSent map[*gomavlib.Channel]map[uint32]time.Time
+}
+
+// NewFrameFilter builds the filter for ep. It returns nil when ep has no
+// filtering rules, which Allow treats as "forward everything".
+func NewFrameFilter(ep data.MAVLinkEndpoint) *FrameFilter {
+	if len(ep.AllowMessages) == 0 && len(ep.DenyMessages) == 0 && len(ep.RateLimits) == 0 {
+		return nil
+	}
+
+	f := &FrameFilter{
+		allow:       make(map[uint32]struct{}),
+		deny:        make(map[uint32]struct{}),
+		minInterval: make(map[uint32]time.Duration),
+		lastSent:    make(map[*gomavlib.Channel]map[uint32]time.Time),
+	}
+	for _, id := range ep.AllowMessages {
+		f.allow[id] = struct{}{}
+	}
+	for _, id := range ep.DenyMessages {
+		f.deny[id] = struct{}{}
+	}
+	for _, rl := range ep.RateLimits {
+		f.minInterval[rl.MessageID] = time.Duration(float64(time.Second) / rl.MaxRate)
+	}
+	return f
+}
+
+// Allow reports whether a message with msgID may be written to ch now, and
+// records the write when it may.
+func (f *FrameFilter) Allow(ch *gomavlib.Channel, msgID uint32, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.allow) > 0 {
+		if _, ok := f.allow[msgID]; !ok {
+			return false
+		}
+	}
+	if _, denied := f.deny[msgID]; denied {
+		return false
+	}
+
+	interval, limited := f.minInterval[msgID]
+	if !limited {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sent, ok := f.lastSent[ch]
+	if !ok {
+		sent = make(map[uint32]time.Time)
+		f.lastSent[ch] = sent
+	}
+	if last, seen := sent[msgID]; seen && now.Sub(last) < interval {
+		return false
+	}
+	sent[msgID] = now
+	return true
+}
+
+// Forget drops the rate-limit state kept for ch.
+func (f *FrameFilter) Forget(ch *gomavlib.Channel) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	delete(f.lastSent, ch)
+	f.mu.Unlock()
+}
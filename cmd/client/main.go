@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 )
@@ -11,8 +13,16 @@ func main() {
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 
 	configPath := flag.String("config", "config.json", "Path to configuration file")
+	showVersion := flag.Bool("version", false, "Print the agent version and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(Version)
+		return
+	}
+
+	slog.Info("starting dronnayak", "version", Version)
+
 	app, err := NewDronnayak(*configPath)
 	if err != nil {
 		slog.Error("failed to initialize", "error", err)
@@ -20,6 +30,13 @@ func main() {
 	}
 
 	if err := app.Run(context.Background()); err != nil {
+		if errors.Is(err, errRestart) {
+			slog.Info("restarting agent")
+			if err := restartAgent(); err != nil {
+				slog.Error("restart failed", "error", err)
+			}
+			os.Exit(1) // let the service manager restart us
+		}
 		slog.Error("application error", "error", err)
 		os.Exit(1)
 	}
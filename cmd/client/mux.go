@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/mux"
+)
+
+// MuxEndpoint carries mux streams over one tunnel, so a single tunnel can
+// serve many TCP connections. Each stream the server opens is passed to
+// serve on its own goroutine.
+type MuxEndpoint struct {
+	sess  *mux.Session
+	serve func(*mux.Stream)
+
+	in        *io.PipeWriter
+	out       chan []byte
+	rest      []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMuxEndpoint returns an endpoint that accepts streams and hands them to
+// serve, which must close them.
+func NewMuxEndpoint(serve func(*mux.Stream)) *MuxEndpoint {
+	pr, pw := io.Pipe()
+	e := &MuxEndpoint{
+		serve:  serve,
+		in:     pw,
+		out:    make(chan []byte, 64),
+		closed: make(chan struct{}),
+	}
+	e.sess = mux.NewSession(pr, frameWriter{e}, true)
+	go e.acceptLoop()
+	return e
+}
+
+// frameWriter queues each outgoing mux frame for the tunnel to read.
+type frameWriter struct{ e *MuxEndpoint }
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	select {
+	case w.e.out <- p:
+		return len(p), nil
+	case <-w.e.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Read returns the next part of the outgoing frame stream.
+func (e *MuxEndpoint) Read(p []byte) (int, error) {
+	if len(e.rest) == 0 {
+		select {
+		case msg := <-e.out:
+			e.rest = msg
+		case <-e.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, e.rest)
+	e.rest = e.rest[n:]
+	return n, nil
+}
+
+// Write feeds incoming frames to the session.
+func (e *MuxEndpoint) Write(p []byte) (int, error) {
+	return e.in.Write(p)
+}
+
+// Close ends the session and every stream on it.
+func (e *MuxEndpoint) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.in.Close()
+		e.sess.Close()
+	})
+	return nil
+}
+
+func (e *MuxEndpoint) acceptLoop() {
+	for {
+		st, err := e.sess.Accept()
+		if err != nil {
+			return
+		}
+		go e.serve(st)
+	}
+}
+
+// pipeStream relays data between st and conn until either side closes.
+func pipeStream(st *mux.Stream, conn net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, st)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(st, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// NewForwardEndpoint returns an endpoint that connects every stream to addr,
+// for services such as onboard web UIs that need several connections.
+func NewForwardEndpoint(addr string) *MuxEndpoint {
+	return NewMuxEndpoint(func(st *mux.Stream) {
+		defer st.Close()
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			slog.Warn("forward: dial failed", "addr", addr, "error", err)
+			return
+		}
+		defer conn.Close()
+		pipeStream(st, conn)
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/gowsrelay/client"
+)
+
+// probeMagic starts every tunnel path probe.
+var probeMagic = []byte("DNPR")
+
+// maxProbeSamples bounds the RTTs kept per window in case stats are not
+// collected for a while.
+const maxProbeSamples = 4096
+
+// LinkProber measures round-trip time, jitter and loss between the drone and
+// the server. Control path probes are HTTP requests answered by the server;
+// tunnel path probes travel through the relay on their own tunnel and are
+// echoed back by a server-side subscriber, so they see what tunnel traffic
+// sees, including the multiplexed transport when it is on.
+type LinkProber struct {
+	control *probeStats
+	tunnel  *probeStats
+}
+
+// NewLinkProber returns a prober that counts probes unanswered after timeout
+// as lost.
+func NewLinkProber(timeout time.Duration) *LinkProber {
+	return &LinkProber{
+		control: newProbeStats(data.LinkPathControl, timeout),
+		tunnel:  newProbeStats(data.LinkPathTunnel, timeout),
+	}
+}
+
+// Stats returns the measurements since the previous call, skipping paths
+// with nothing to report.
+func (p *LinkProber) Stats() []data.LinkStats {
+	if p == nil {
+		return nil
+	}
+	var stats []data.LinkStats
+	for _, s := range []*probeStats{p.control, p.tunnel} {
+		if window := s.window(); window.Sent > 0 {
+			stats = append(stats, window)
+		}
+	}
+	return stats
+}
+
+// startProbes runs the link prober in the background until stopProbes is
+// called or ctx is cancelled.
+func (d *Dronnayak) startProbes(ctx context.Context) {
+	cfg := d.currentConfig()
+	prober := NewLinkProber(cfg.Probe.Timeout)
+	probeCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	d.prober.Store(prober)
+	d.probeCancel = cancel
+	d.probeDone = done
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(done)
+		d.runProbes(probeCtx, cfg, prober)
+	}()
+}
+
+// stopProbes stops the prober, if running, and waits for it to exit.
+func (d *Dronnayak) stopProbes() {
+	if d.probeCancel == nil {
+		return
+	}
+	d.probeCancel()
+	<-d.probeDone
+	d.prober.Store(nil)
+	d.probeCancel, d.probeDone = nil, nil
+}
+
+// runProbes sends a control path probe every interval. The tunnel path is
+// probed once a control probe has been answered, since that is what
+// subscribes the server's echo to the probe tunnel.
+func (d *Dronnayak) runProbes(ctx context.Context, cfg *data.Config, prober *LinkProber) {
+	slog.Info("link probes enabled", "interval", cfg.Probe.Interval)
+
+	httpClient := &http.Client{Timeout: cfg.Probe.Timeout}
+	probeURL := fmt.Sprintf("%s/device/%s/probe", d.serverURL(), cfg.UUID)
+	answered := make(chan struct{}, 1)
+
+	var probes sync.WaitGroup
+	defer probes.Wait()
+
+	var tm *TunnelManager
+	defer func() {
+		if tm != nil {
+			tm.Stop()
+			<-tm.Done()
+		}
+	}()
+
+	ticker := time.NewTicker(cfg.Probe.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			probes.Add(1)
+			go func() {
+				defer probes.Done()
+				if probeControl(ctx, httpClient, probeURL, d.credential, prober.control) {
+					select {
+					case answered <- struct{}{}:
+					default:
+					}
+				}
+			}()
+
+		case <-answered:
+			if tm != nil {
+				continue
+			}
+			tunnelID := fmt.Sprintf("%s_%s", cfg.UUID, data.ProbeTunnelLabel)
+			factory := func() (client.LocalEndpoint, error) {
+				return newProbeEndpoint(prober.tunnel, cfg.Probe.Interval), nil
+			}
+			tunnelCtx, tunnelCancel := context.WithCancel(ctx)
+			var err error
+			if tm, err = d.newTunnelManager(cfg, tunnelID, data.ProbeTunnelLabel, data.TunnelPriorityNormal, factory, tunnelCancel); err != nil {
+				tunnelCancel()
+				slog.Warn("tunnel path probes unavailable", "error", err)
+				continue
+			}
+			go func(tm *TunnelManager) {
+				defer close(tm.done)
+				tm.Start(tunnelCtx)
+			}(tm)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeControl sends one control path probe and reports whether it was answered.
+func probeControl(ctx context.Context, httpClient *http.Client, url string, credential *Credential, stats *probeStats) bool {
+	seq := stats.send()
+	body, _ := json.Marshal(map[string]int64{"seq": int64(seq), "sent_at": time.Now().UnixNano()})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	credential.Authorize(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		slog.Debug("control probe failed", "seq", seq, "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	stats.ack(seq)
+	return true
+}
+
+// probeEndpoint is the local end of the probe tunnel: each Read produces a
+// probe once per interval, and each echoed probe written back is timed.
+type probeEndpoint struct {
+	stats  *probeStats
+	ticker *time.Ticker
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newProbeEndpoint(stats *probeStats, interval time.Duration) *probeEndpoint {
+	return &probeEndpoint{stats: stats, ticker: time.NewTicker(interval), closed: make(chan struct{})}
+}
+
+func (e *probeEndpoint) Read(p []byte) (int, error) {
+	select {
+	case <-e.ticker.C:
+	case <-e.closed:
+		return 0, io.EOF
+	}
+	if len(p) < len(probeMagic)+8 {
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(p, probeMagic)
+	binary.BigEndian.PutUint64(p[n:], e.stats.send())
+	return n + 8, nil
+}
+
+func (e *probeEndpoint) Write(p []byte) (int, error) {
+	if len(p) == len(probeMagic)+8 && bytes.HasPrefix(p, probeMagic) {
+		e.stats.ack(binary.BigEndian.Uint64(p[len(probeMagic):]))
+	}
+	return len(p), nil
+}
+
+func (e *probeEndpoint) Close() error {
+	e.once.Do(func() {
+		e.ticker.Stop()
+		close(e.closed)
+	})
+	return nil
+}
+
+// probeStats tracks the probes on one path over the current window.
+type probeStats struct {
+	path    string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]time.Time // sent, not yet answered or lost
+	lost    int
+	rtts    []time.Duration
+}
+
+func newProbeStats(path string, timeout time.Duration) *probeStats {
+	return &probeStats{path: path, timeout: timeout, pending: make(map[uint64]time.Time)}
+}
+
+// send records a probe as sent and returns its sequence number.
+func (s *probeStats) send() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	s.seq++
+	s.pending[s.seq] = time.Now()
+	return s.seq
+}
+
+// ack records the answer to probe seq. Answers to probes already counted as
+// lost, or never sent, are ignored.
+func (s *probeStats) ack(seq uint64) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sentAt, ok := s.pending[seq]
+	if !ok {
+		return
+	}
+	delete(s.pending, seq)
+	if rtt := now.Sub(sentAt); rtt > s.timeout {
+		s.lost++
+	} else if len(s.rtts) < maxProbeSamples {
+		s.rtts = append(s.rtts, rtt)
+	}
+}
+
+// expire counts probes unanswered for longer than the timeout as lost.
+// Called with s.mu held.
+func (s *probeStats) expire(now time.Time) {
+	for seq, sentAt := range s.pending {
+		if now.Sub(sentAt) > s.timeout {
+			delete(s.pending, seq)
+			s.lost++
+		}
+	}
+}
+
+// window summarises the probes resolved since the previous call and resets
+// the counters.
+func (s *probeStats) window() data.LinkStats {
+	s.mu.Lock()
+	s.expire(time.Now())
+	rtts, lost := s.rtts, s.lost
+	s.rtts, s.lost = nil, 0
+	s.mu.Unlock()
+
+	stats := data.LinkStats{Path: s.path, Sent: len(rtts) + lost, Lost: lost}
+	if len(rtts) == 0 {
+		return stats
+	}
+	lo, hi, sum, jitter := math.Inf(1), 0.0, 0.0, 0.0
+	for i, rtt := range rtts {
+		ms := float64(rtt) / float64(time.Millisecond)
+		lo, hi, sum = math.Min(lo, ms), math.Max(hi, ms), sum+ms
+		if i > 0 {
+			jitter += math.Abs(ms - float64(rtts[i-1])/float64(time.Millisecond))
+		}
+	}
+	stats.RTTMinMS, stats.RTTMaxMS = lo, hi
+	stats.RTTAvgMS = sum / float64(len(rtts))
+	if len(rtts) > 1 {
+		stats.JitterMS = jitter / float64(len(rtts)-1)
+	}
+	return stats
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+)
+
+// PTY tunnel protocol. Shell output is sent to the tunnel as raw bytes. Input
+// from the tunnel is framed so terminal control messages travel alongside
+// keystrokes:
+//
+//	[1 byte kind][4 byte big-endian length][payload]
+//
+// Kind 0 carries keystrokes. Kind 1 carries a JSON control message, either
+// {"type":"resize","cols":120,"rows":40} or {"type":"signal","signal":"INT"}.
+const (
+	ptyFrameData    = 0
+	ptyFrameControl = 1
+	ptyFrameHeader  = 5
+	maxPTYFrameSize = 1 << 20
+)
+
+// ptyExitTimeout is how long Close waits for the shell to exit after hangup
+// before killing it.
+const ptyExitTimeout = 2 * time.Second
+
+type ptyControl struct {
+	Type   string `json:"type"`
+	Cols   uint16 `json:"cols"`
+	Rows   uint16 `json:"rows"`
+	Signal string `json:"signal"`
+}
+
+// PTYEndpoint runs a login shell in a pseudo-terminal and bridges it over a tunnel.
+type PTYEndpoint struct {
+	term    *os.File // pseudo-terminal master
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	pending []byte // input not yet forming a whole frame
+
+	closeOnce sync.Once
+}
+
+// NewPTYEndpoint starts a login shell in a new pseudo-terminal, as the
+// policy's run-as user, if the policy allows pty shells. Every session,
+// refused or not, is passed to audit when it ends.
+func NewPTYEndpoint(policy data.ExecPolicy, audit func(data.ExecAudit)) (*PTYEndpoint, error) {
+	rec := data.ExecAudit{Command: "pty shell", RunAs: policy.RunAs, ExitCode: -1, StartedAt: time.Now()}
+	if !policy.AllowPTY {
+		rec.Error = "pty shells are not allowed by the exec policy"
+		audit(rec)
+		return nil, errors.New(rec.Error)
+	}
+	rec.Allowed = true
+
+	term, cmd, err := startPTYShell(policy.RunAs, policy.WorkDir)
+	if err != nil {
+		rec.Error = err.Error()
+		audit(rec)
+		return nil, fmt.Errorf("failed to start pty shell: %w", err)
+	}
+	rec.Command = "pty shell " + cmd.Path
+
+	e := &PTYEndpoint{term: term, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		slog.Info("pty shell exited", "pid", cmd.Process.Pid, "error", err)
+		rec.DurationMS = time.Since(rec.StartedAt).Milliseconds()
+		rec.ExitCode = cmd.ProcessState.ExitCode()
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		audit(rec)
+		close(e.exited)
+	}()
+
+	slog.Info("pty shell started", "shell", cmd.Path, "pid", cmd.Process.Pid, "run_as", policy.RunAs)
+	return e, nil
+}
+
+// Read returns shell output. It reports io.EOF once the shell has exited.
+func (e *PTYEndpoint) Read(p []byte) (int, error) {
+	n, err := e.term.Read(p)
+	if n == 0 && errors.Is(err, syscall.EIO) {
+		// The master reads EIO once no process holds the terminal open.
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// Write consumes framed input, passing keystrokes to the shell and applying
+// control messages. Frames may be split across or packed into writes.
+func (e *PTYEndpoint) Write(p []byte) (int, error) {
+	e.pending = append(e.pending, p...)
+	for len(e.pending) >= ptyFrameHeader {
+		size := int(binary.BigEndian.Uint32(e.pending[1:ptyFrameHeader]))
+		if size > maxPTYFrameSize {
+			return 0, fmt.Errorf("pty frame too large: %d bytes", size)
+		}
+		if len(e.pending) < ptyFrameHeader+size {
+			break
+		}
+		if err := e.handleFrame(e.pending[0], e.pending[ptyFrameHeader:ptyFrameHeader+size]); err != nil {
+			return 0, err
+		}
+		e.pending = e.pending[ptyFrameHeader+size:]
+	}
+	if len(e.pending) == 0 {
+		e.pending = nil
+	}
+	return len(p), nil
+}
+
+func (e *PTYEndpoint) handleFrame(kind byte, payload []byte) error {
+	switch kind {
+	case ptyFrameData:
+		_, err := e.term.Write(payload)
+		return err
+	case ptyFrameControl:
+		var ctl ptyControl
+		if err := json.Unmarshal(payload, &ctl); err != nil {
+			slog.Warn("invalid pty control message", "error", err)
+			return nil
+		}
+		switch ctl.Type {
+		case "resize":
+			if ctl.Cols == 0 || ctl.Rows == 0 {
+				return nil
+			}
+			if err := setPTYSize(e.term, ctl.Cols, ctl.Rows); err != nil {
+				slog.Warn("pty resize failed", "cols", ctl.Cols, "rows", ctl.Rows, "error", err)
+			}
+		case "signal":
+			if err := signalPTY(e.term, e.cmd, ctl.Signal); err != nil {
+				slog.Warn("pty signal failed", "signal", ctl.Signal, "error", err)
+			}
+		default:
+			slog.Warn("unknown pty control message", "type", ctl.Type)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown pty frame kind %d", kind)
+	}
+}
+
+// Close hangs up the terminal and waits for the shell to exit, killing it if
+// it does not.
+func (e *PTYEndpoint) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		err = e.term.Close()
+		select {
+		case <-e.exited:
+		case <-time.After(ptyExitTimeout):
+			slog.Warn("pty shell ignored hangup, killing", "pid", e.cmd.Process.Pid)
+			killPTYShell(e.cmd)
+		}
+	})
+	return err
+}
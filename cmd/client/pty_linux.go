@@ -0,0 +1,155 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptySignals are the signals a terminal client may send to the foreground job.
+var ptySignals = map[string]unix.Signal{
+	"INT":  unix.SIGINT,
+	"QUIT": unix.SIGQUIT,
+	"TSTP": unix.SIGTSTP,
+	"CONT": unix.SIGCONT,
+	"HUP":  unix.SIGHUP,
+	"TERM": unix.SIGTERM,
+	"KILL": unix.SIGKILL,
+}
+
+// startPTYShell opens a pseudo-terminal and starts a login shell as the
+// session leader on its slave side, as runAs when set and in dir, or the
+// shell user's home, when not. It returns the master.
+func startPTYShell(runAs, dir string) (*os.File, *exec.Cmd, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ptn uint32
+	err = ptyControlFd(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("unlock pty: %w", err)
+		}
+		n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+		if err != nil {
+			return fmt.Errorf("get pty number: %w", err)
+		}
+		ptn = n
+		return nil
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptn), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	// The child holds its own copies; ours would keep the terminal open after the shell exits.
+	defer slave.Close()
+
+	shell := loginShell()
+	cmd := &exec.Cmd{
+		Path:   shell,
+		Args:   []string{"-" + filepath.Base(shell)}, // leading dash makes it a login shell
+		Stdin:  slave,
+		Stdout: slave,
+		Stderr: slave,
+	}
+	if err := configureExecCmd(cmd, runAs); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	// A session leader already leads its own process group.
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid, cmd.SysProcAttr.Setctty, cmd.SysProcAttr.Ctty = true, true, 0
+	cmd.Cancel = nil
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+
+	if dir == "" {
+		dir = "/"
+		if runAs == "" {
+			if home, err := os.UserHomeDir(); err == nil {
+				dir = home
+			}
+		} else if u, err := user.Lookup(runAs); err == nil {
+			dir = u.HomeDir
+		}
+	}
+	cmd.Dir = dir
+
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, cmd, nil
+}
+
+// loginShell picks $SHELL, falling back to bash and then sh.
+func loginShell() string {
+	for _, shell := range []string{os.Getenv("SHELL"), "/bin/bash", "/bin/sh"} {
+		if shell == "" {
+			continue
+		}
+		if info, err := os.Stat(shell); err == nil && !info.IsDir() && info.Mode()&0o111 != 0 {
+			return shell
+		}
+	}
+	return "/bin/sh"
+}
+
+// setPTYSize sets the terminal size; the kernel notifies the foreground job with SIGWINCH.
+func setPTYSize(term *os.File, cols, rows uint16) error {
+	return ptyControlFd(term, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Col: cols, Row: rows})
+	})
+}
+
+// signalPTY sends the named signal to the terminal's foreground process group,
+// falling back to the shell's group.
+func signalPTY(term *os.File, cmd *exec.Cmd, name string) error {
+	sig, ok := ptySignals[name]
+	if !ok {
+		return fmt.Errorf("unsupported signal %q", name)
+	}
+	pgrp := cmd.Process.Pid
+	_ = ptyControlFd(term, func(fd int) error {
+		fg, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+		if err == nil && fg > 0 {
+			pgrp = fg
+		}
+		return err
+	})
+	return unix.Kill(-pgrp, sig)
+}
+
+// killPTYShell kills the shell's whole process group.
+func killPTYShell(cmd *exec.Cmd) {
+	_ = unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+}
+
+// ptyControlFd runs fn on the file's descriptor without switching it to
+// blocking mode, so Close still interrupts a pending Read.
+func ptyControlFd(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := rc.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// errPTYUnsupported is returned on platforms without pty support.
+var errPTYUnsupported = fmt.Errorf("pty endpoints are not supported on %s", runtime.GOOS)
+
+func startPTYShell(runAs, dir string) (*os.File, *exec.Cmd, error) {
+	return nil, nil, errPTYUnsupported
+}
+
+func setPTYSize(term *os.File, cols, rows uint16) error {
+	return errPTYUnsupported
+}
+
+func signalPTY(term *os.File, cmd *exec.Cmd, name string) error {
+	return errPTYUnsupported
+}
+
+func killPTYShell(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const queueExt = ".json"
+
+// DiskQueue is a bounded FIFO of JSON records persisted one file per record,
+// so queued samples survive restarts and power loss. When full, the oldest
+// records are dropped.
+type DiskQueue struct {
+	dir        string
+	maxRecords int
+
+	mu      sync.Mutex
+	nextSeq uint64
+	seqs    []uint64 // sorted, oldest first
+}
+
+// NewDiskQueue opens (or creates) a queue in dir holding at most maxRecords.
+func NewDiskQueue(dir string, maxRecords int) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create queue dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read queue dir: %w", err)
+	}
+
+	q := &DiskQueue{dir: dir, maxRecords: maxRecords}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, queueExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.seqs = append(q.seqs, seq)
+	}
+	sort.Slice(q.seqs, func(i, j int) bool { return q.seqs[i] < q.seqs[j] })
+	if n := len(q.seqs); n > 0 {
+		q.nextSeq = q.seqs[n-1] + 1
+		slog.Info("queue restored", "dir", dir, "records", n)
+	}
+
+	return q, nil
+}
+
+// Len returns the number of queued records.
+func (q *DiskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.seqs)
+}
+
+// Push appends a record, dropping the oldest records if the queue is full.
+func (q *DiskQueue) Push(record []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	seq := q.nextSeq
+	path := q.path(seq)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, record, 0644); err != nil {
+		return fmt.Errorf("write queue record: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("commit queue record: %w", err)
+	}
+	q.nextSeq++
+	q.seqs = append(q.seqs, seq)
+
+	for len(q.seqs) > q.maxRecords {
+		if err := os.Remove(q.path(q.seqs[0])); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to drop oldest queue record", "error", err)
+		}
+		q.seqs = q.seqs[1:]
+		slog.Warn("queue full, dropped oldest record", "dir", q.dir, "max", q.maxRecords)
+	}
+	return nil
+}
+
+// Peek returns up to n of the oldest records without removing them. Records
+// that can no longer be read are discarded.
+func (q *DiskQueue) Peek(n int) []json.RawMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var records []json.RawMessage
+	for i := 0; i < len(q.seqs) && len(records) < n; {
+		b, err := os.ReadFile(q.path(q.seqs[i]))
+		if err != nil || !json.Valid(b) {
+			slog.Warn("discarding unreadable queue record", "seq", q.seqs[i], "error", err)
+			os.Remove(q.path(q.seqs[i]))
+			q.seqs = append(q.seqs[:i], q.seqs[i+1:]...)
+			continue
+		}
+		records = append(records, b)
+		i++
+	}
+	return records
+}
+
+// Pop removes the n oldest records, typically after they were delivered.
+func (q *DiskQueue) Pop(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > len(q.seqs) {
+		n = len(q.seqs)
+	}
+	for _, seq := range q.seqs[:n] {
+		if err := os.Remove(q.path(seq)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove queue record", "seq", seq, "error", err)
+		}
+	}
+	q.seqs = q.seqs[n:]
+}
+
+func (q *DiskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueExt))
+}
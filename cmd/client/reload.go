@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+)
+
+// currentConfig returns the running config. The returned value must not be modified.
+func (d *Dronnayak) currentConfig() *data.Config {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+	return d.config
+}
+
+// currentConfigSource returns where the running config was loaded from.
+func (d *Dronnayak) currentConfigSource() string {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+	return d.configSource
+}
+
+// configCachePath returns the path of the server config cache kept next to
+// the bootstrap config, e.g. config.json -> config.cache.json.
+func configCachePath(configPath string) string {
+	ext := filepath.Ext(configPath)
+	return strings.TrimSuffix(configPath, ext) + ".cache" + ext
+}
+
+// loadCachedConfig reads the cached server config, rejecting a cache that
+// belongs to a different device.
+func loadCachedConfig(path, uuid string) (*data.Config, error) {
+	cached, err := data.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if cached.UUID != uuid {
+		return nil, fmt.Errorf("cached config is for %q, not %q", cached.UUID, uuid)
+	}
+	return cached, nil
+}
+
+// watchConfig polls the server for a new config version, applies reload_config
+// commands and health checks the servers. It is the only goroutine that
+// replaces d.config or switches servers.
+func (d *Dronnayak) watchConfig(ctx context.Context) {
+	interval := d.config.Server.ConfigCheckInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	healthInterval := d.config.Server.HealthCheckInterval
+	healthTicker := time.NewTicker(healthInterval)
+	defer healthTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.reloadConfig(ctx, false); err != nil {
+				slog.Warn("config check failed", "error", err)
+			}
+
+		case id := <-d.reloadCh:
+			err := d.reloadConfig(ctx, true)
+			if err != nil {
+				slog.Error("config reload failed", "error", err)
+			}
+			d.recordCommandResult(id, err)
+
+		case <-healthTicker.C:
+			if d.servers.Check(ctx) {
+				d.switchServer(ctx)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+
+		if next := d.config.Server.ConfigCheckInterval; next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+		if next := d.config.Server.HealthCheckInterval; next != healthInterval {
+			healthInterval = next
+			healthTicker.Reset(healthInterval)
+		}
+	}
+}
+
+// reloadConfig fetches the config from the server and applies it. Unless
+// force is set, the config is only applied when its version has changed.
+func (d *Dronnayak) reloadConfig(ctx context.Context, force bool) error {
+	current := d.config
+	next, err := data.LoadConfigV2(d.serverURL(), current.UUID, d.credential.Token())
+	if err != nil {
+		return err
+	}
+	if next.UUID != current.UUID {
+		return fmt.Errorf("server returned config for %q, expected %q", next.UUID, current.UUID)
+	}
+
+	unchanged := next.Version == current.Version
+	if !unchanged || d.currentConfigSource() != data.ConfigSourceServer {
+		if err := data.SaveConfig(d.configCache, next); err != nil {
+			slog.Warn("failed to cache server config", "path", d.configCache, "error", err)
+		}
+	}
+
+	if !force && unchanged {
+		// Same version as the running config, which may have come from the cache or bootstrap file.
+		d.configMu.Lock()
+		d.configSource = data.ConfigSourceServer
+		d.configMu.Unlock()
+		return nil
+	}
+
+	slog.Info("applying new config", "version", next.Version, "previous_version", current.Version)
+	return d.applyConfig(ctx, current, next)
+}
+
+// applyConfig switches the running services from current to next, restarting
+// only what changed.
+func (d *Dronnayak) applyConfig(ctx context.Context, current, next *data.Config) error {
+	serverChanged := d.servers.Update(next.Server)
+	mavlinkChanged := !reflect.DeepEqual(current.MAVLink, next.MAVLink)
+	statsChanged := serverChanged || current.Stats != next.Stats
+	restartTunnels := serverChanged || current.Tunnel.WSPath != next.Tunnel.WSPath || current.Tunnel.Multiplex != next.Tunnel.Multiplex
+	probesChanged := restartTunnels || current.Probe != next.Probe || current.Stats.Enabled != next.Stats.Enabled
+
+	d.configMu.Lock()
+	d.config = next
+	d.configSource = data.ConfigSourceServer
+	d.configMu.Unlock()
+
+	// Running tunnels, configured or started by command, keep running while
+	// next still allows them; configured tunnels that were removed or changed
+	// are stopped too. New or changed ones are started once MAVLink has been
+	// restarted, so a serial tunnel never races the old node for its port.
+	oldTunnels := d.tunnelsByID(current.Tunnel.Endpoints)
+	newTunnels := d.tunnelsByID(next.Tunnel.Endpoints)
+
+	stopped := 0
+	for id, entry := range d.runningTunnels() {
+		if _, configured := oldTunnels[id]; configured {
+			if newEntry, ok := newTunnels[id]; !ok || newEntry != entry || restartTunnels {
+				d.stopTunnelAndWait(id)
+				continue
+			}
+		}
+		if err := checkTunnel(next, entry); err != nil {
+			slog.Warn("stopping tunnel the new config does not allow", "tunnel", id, "error", err)
+			d.stopTunnelAndWait(id)
+			stopped++
+		}
+	}
+
+	var mavlinkErr error
+	if mavlinkChanged {
+		d.stopMAVLink()
+		if next.MAVLink.Enabled {
+			if err := d.startMAVLink(ctx); err != nil {
+				mavlinkErr = fmt.Errorf("failed to restart MAVLink: %w", err)
+			}
+		}
+	}
+
+	var started []data.TunnelEntry
+	for id, entry := range newTunnels {
+		if oldEntry, ok := oldTunnels[id]; ok && oldEntry == entry && !restartTunnels {
+			continue
+		}
+		started = append(started, entry)
+	}
+	if len(started) > 0 {
+		d.startTunnels(ctx, started)
+	}
+
+	if statsChanged {
+		d.stopStats()
+		if next.Stats.Enabled {
+			d.startStats(ctx)
+		}
+	}
+
+	if probesChanged {
+		d.stopProbes()
+		if next.Stats.Enabled && next.Probe.Enabled {
+			d.startProbes(ctx)
+		}
+	}
+
+	if mavlinkErr != nil {
+		return mavlinkErr
+	}
+	slog.Info("config applied",
+		"version", next.Version,
+		"mavlink_restarted", mavlinkChanged,
+		"stats_restarted", statsChanged,
+		"probes_restarted", probesChanged,
+		"tunnels_started", len(started),
+		"tunnels_disallowed", stopped)
+	return nil
+}
+
+// tunnelsByID keys tunnel entries by the tunnel ID they run under.
+func (d *Dronnayak) tunnelsByID(entries []data.TunnelEntry) map[string]data.TunnelEntry {
+	byID := make(map[string]data.TunnelEntry, len(entries))
+	for _, entry := range entries {
+		byID[d.makeTunnelID(entry)] = entry
+	}
+	return byID
+}
+
+// runningTunnels returns the entries of the running tunnels by tunnel ID.
+func (d *Dronnayak) runningTunnels() map[string]data.TunnelEntry {
+	d.tunnelMu.Lock()
+	defer d.tunnelMu.Unlock()
+	running := make(map[string]data.TunnelEntry, len(d.tunnelManagers))
+	for id, tm := range d.tunnelManagers {
+		running[id] = tm.entry
+	}
+	return running
+}
+
+// stopTunnelAndWait stops the tunnel, if running, and blocks until it has shut down.
+func (d *Dronnayak) stopTunnelAndWait(tunnelID string) {
+	d.tunnelMu.Lock()
+	tm, ok := d.tunnelManagers[tunnelID]
+	d.tunnelMu.Unlock()
+
+	if !ok {
+		return
+	}
+	tm.Stop()
+	<-tm.Done()
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// restartAgent exits so the service manager starts the updated binary; this
+// platform cannot replace the running process in place.
+func restartAgent() error {
+	os.Exit(1)
+	return nil
+}
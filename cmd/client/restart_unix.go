@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// restartAgent replaces the running process with a fresh copy of the binary
+// on disk, keeping the same PID and arguments.
+func restartAgent() error {
+	exe, err := executablePath()
+	if err != nil {
+		return err
+	}
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to restart agent: %w", err)
+	}
+	return nil
+}
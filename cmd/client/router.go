@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/bluenviron/gomavlib/v3"
+	"github.com/bluenviron/gomavlib/v3/pkg/message"
+)
+
+// routeKey identifies a MAVLink system/component pair.
+type routeKey struct {
+	systemID    byte
+	componentID byte
+}
+
+// MAVLinkRouter forwards frames between node channels using the system and
+// component IDs it has seen on each channel, instead of flooding every frame
+// to every channel.
+type MAVLinkRouter struct {
+	node    *gomavlib.Node
+	filters map[gomavlib.EndpointConf]*FrameFilter
+
+	mu       sync.Mutex
+	channels map[*gomavlib.Channel]struct{}
+	routes   map[routeKey]map[*gomavlib.Channel]time.Time
+}
+
+// NewMAVLinkRouter creates a router that writes frames through node. filters
+// maps endpoint configurations to the filter applied to their channels;
+// endpoints without an entry receive every frame.
+func NewMAVLinkRouter(node *gomavlib.Node, filters map[gomavlib.EndpointConf]*FrameFilter) *MAVLinkRouter {
+	return &MAVLinkRouter{
+		node:     node,
+		filters:  filters,
+		channels: make(map[*gomavlib.Channel]struct{}),
+		routes:   make(map[routeKey]map[*gomavlib.Channel]time.Time),
+	}
+}
+
+// Open registers a newly opened channel as a forwarding destination.
+func (r *MAVLinkRouter) Open(ch *gomavlib.Channel) {
+	r.mu.Lock()
+	r.channels[ch] = struct{}{}
+	r.mu.Unlock()
+}
+
+// Route learns the sender of a received frame and forwards it. Untargeted
+// messages and messages for unknown destinations are broadcast to every other
+// channel; targeted messages only go to the channels their target lives behind.
+// Each destination's endpoint filter is applied before writing.
+func (r *MAVLinkRouter) Route(evt *gomavlib.EventFrame) {
+	r.learn(evt.Channel, routeKey{systemID: evt.SystemID(), componentID: evt.ComponentID()})
+
+	var destinations []*gomavlib.Channel
+	if targetSystem, targetComponent, ok := messageTarget(evt.Message()); ok && targetSystem != 0 {
+		destinations = r.lookup(targetSystem, targetComponent)
+	}
+	if len(destinations) == 0 {
+		destinations = r.openChannels()
+	}
+
+	msgID := evt.Message().GetID()
+	now := time.Now()
+	for _, ch := range destinations {
+		if ch == evt.Channel {
+			continue
+		}
+		if !r.filters[ch.Endpoint().Conf()].Allow(ch, msgID, now) {
+			continue
+		}
+		r.node.WriteFrameTo(ch, evt.Frame)
+	}
+}
+
+// Forget drops ch and every route learned through it. Call it when a channel closes.
+func (r *MAVLinkRouter) Forget(ch *gomavlib.Channel) {
+	r.filters[ch.Endpoint().Conf()].Forget(ch)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.channels, ch)
+	for key, channels := range r.routes {
+		delete(channels, ch)
+		if len(channels) == 0 {
+			delete(r.routes, key)
+		}
+	}
+}
+
+// Routes returns a snapshot of the routing table, sorted by system and component ID.
+func (r *MAVLinkRouter) Routes() []data.MAVLinkRoute {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var routes []data.MAVLinkRoute
+	for key, channels := range r.routes {
+		for ch, lastSeen := range channels {
+			routes = append(routes, data.MAVLinkRoute{
+				SystemID:    key.systemID,
+				ComponentID: key.componentID,
+				Channel:     ch.String(),
+				LastSeen:    lastSeen.Unix(),
+			})
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].SystemID != routes[j].SystemID {
+			return routes[i].SystemID < routes[j].SystemID
+		}
+		if routes[i].ComponentID != routes[j].ComponentID {
+			return routes[i].ComponentID < routes[j].ComponentID
+		}
+		return routes[i].Channel < routes[j].Channel
+	})
+	return routes
+}
+
+func (r *MAVLinkRouter) learn(ch *gomavlib.Channel, key routeKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	channels, ok := r.routes[key]
+	if !ok {
+		channels = make(map[*gomavlib.Channel]time.Time)
+		r.routes[key] = channels
+	}
+	if _, known := channels[ch]; !known {
+		slog.Info("mavlink route learned", "system_id", key.systemID, "component_id", key.componentID, "channel", ch.String())
+	}
+	channels[ch] = time.Now()
+}
+
+func (r *MAVLinkRouter) openChannels() []*gomavlib.Channel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]*gomavlib.Channel, 0, len(r.channels))
+	for ch := range r.channels {
+		result = append(result, ch)
+	}
+	return result
+}
+
+// lookup returns the channels behind the given target. A target component of
+// 0 addresses every component of the target system.
+func (r *MAVLinkRouter) lookup(systemID, componentID byte) []*gomavlib.Channel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[*gomavlib.Channel]struct{})
+	var result []*gomavlib.Channel
+	for key, channels := range r.routes {
+		if key.systemID != systemID {
+			continue
+		}
+		if componentID != 0 && key.componentID != componentID {
+			continue
+		}
+		for ch := range channels {
+			if _, dup := seen[ch]; dup {
+				continue
+			}
+			seen[ch] = struct{}{}
+			result = append(result, ch)
+		}
+	}
+	return result
+}
+
+// targetFields caches, per message type, the indices of the TargetSystem and
+// TargetComponent fields (-1 when absent).
+var targetFields sync.Map // reflect.Type -> [2]int
+
+// messageTarget extracts the target system and component from msg. ok is
+// false for messages that carry no target system.
+func messageTarget(msg message.Message) (targetSystem, targetComponent byte, ok bool) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0, 0, false
+	}
+
+	var idx [2]int
+	if cached, found := targetFields.Load(v.Type()); found {
+		idx = cached.([2]int)
+	} else {
+		idx = [2]int{-1, -1}
+		for i, name := range []string{"TargetSystem", "TargetComponent"} {
+			if f, exists := v.Type().FieldByName(name); exists && f.Type.Kind() == reflect.Uint8 && len(f.Index) == 1 {
+				idx[i] = f.Index[0]
+			}
+		}
+		targetFields.Store(v.Type(), idx)
+	}
+
+	if idx[0] < 0 {
+		return 0, 0, false
+	}
+	targetSystem = byte(v.Field(idx[0]).Uint())
+	if idx[1] >= 0 {
+		targetComponent = byte(v.Field(idx[1]).Uint())
+	}
+	return targetSystem, targetComponent, true
+}
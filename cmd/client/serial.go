@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// defaultSerialBaudRate is used for serial tunnels that do not set a baud rate.
+const defaultSerialBaudRate = 57600
+
+// serialReadTimeout bounds each read on the port so Read can notice Close;
+// closing the device does not interrupt a blocked read.
+const serialReadTimeout = 200 * time.Millisecond
+
+// Serial devices held open by tunnels, keyed by resolved path, so two tunnels
+// or a tunnel and the MAVLink node never share a port.
+var (
+	serialMu      sync.Mutex
+	serialDevices = make(map[string]bool)
+)
+
+// serialDeviceKey resolves symlinks such as /dev/serial/by-id/... so the
+// same port is recognised under different names.
+func serialDeviceKey(device string) string {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		return resolved
+	}
+	return device
+}
+
+// serialDeviceInUse reports whether a tunnel currently holds device open.
+func serialDeviceInUse(device string) bool {
+	serialMu.Lock()
+	defer serialMu.Unlock()
+	return serialDevices[serialDeviceKey(device)]
+}
+
+// SerialEndpoint bridges the raw bytes of a serial device over a tunnel.
+type SerialEndpoint struct {
+	port   *serial.Port
+	key    string
+	closed atomic.Bool
+}
+
+// NewSerialEndpoint opens device at baud. It fails if another tunnel already
+// holds the device.
+func NewSerialEndpoint(device string, baud int) (*SerialEndpoint, error) {
+	key := serialDeviceKey(device)
+
+	serialMu.Lock()
+	defer serialMu.Unlock()
+	if serialDevices[key] {
+		return nil, fmt.Errorf("serial device %s is already in use by another tunnel", device)
+	}
+
+	port, err := serial.OpenPort(&serial.Config{Name: device, Baud: baud, ReadTimeout: serialReadTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("open serial device %s: %w", device, err)
+	}
+	serialDevices[key] = true
+	return &SerialEndpoint{port: port, key: key}, nil
+}
+
+// Read blocks until bytes arrive from the device or the endpoint is closed.
+func (e *SerialEndpoint) Read(p []byte) (int, error) {
+	for {
+		n, err := e.port.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		// A read timeout returns no data; keep waiting unless we were closed.
+		if e.closed.Load() {
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write sends p to the device.
+func (e *SerialEndpoint) Write(p []byte) (int, error) {
+	return e.port.Write(p)
+}
+
+// Close closes the device and releases it for other tunnels.
+func (e *SerialEndpoint) Close() error {
+	if e.closed.Swap(true) {
+		return nil
+	}
+	err := e.port.Close()
+
+	serialMu.Lock()
+	delete(serialDevices, e.key)
+	serialMu.Unlock()
+	return err
+}
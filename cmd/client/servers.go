@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+)
+
+// serverCheckTimeout bounds a single server health check.
+const serverCheckTimeout = 5 * time.Second
+
+// ServerPool picks the server the drone talks to out of an ordered list. It
+// fails over once the active server has failed FailoverAfter health checks in
+// a row, and fails back once a more preferred server has passed as many.
+type ServerPool struct {
+	httpClient *http.Client
+
+	mu         sync.RWMutex
+	cfg        data.ServerConfig
+	servers    []string // most preferred first
+	discovered bool     // servers came from the discovery document
+	active     string
+	since      time.Time
+	failovers  int
+	failures   int            // consecutive failed checks of active
+	recovered  map[string]int // consecutive passed checks of servers preferred over active
+	lastError  string
+}
+
+// NewServerPool returns a pool over discovered, the list fetched from cfg's
+// discovery document, or over the servers in cfg if nothing was discovered.
+// It starts on active if that is one of them and on the most preferred server
+// otherwise.
+func NewServerPool(cfg data.ServerConfig, discovered []string, active string) *ServerPool {
+	p := &ServerPool{
+		httpClient: &http.Client{Timeout: serverCheckTimeout},
+		recovered:  make(map[string]int),
+	}
+	if cfg.DiscoveryURL != "" && len(discovered) > 0 {
+		p.setServers(cfg, discovered, true)
+	} else {
+		p.setServers(cfg, cfg.Servers(), false)
+	}
+	if slices.Contains(p.servers, active) {
+		p.active = active
+	}
+	return p
+}
+
+// Active returns the base URL of the server in use.
+func (p *ServerPool) Active() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.active
+}
+
+// Status reports the active server and the servers it was chosen from.
+func (p *ServerPool) Status() *data.ServerStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return &data.ServerStatus{
+		Active:      p.active,
+		Servers:     slices.Clone(p.servers),
+		Discovered:  p.discovered,
+		ActiveSince: p.since.Unix(),
+		Failovers:   p.failovers,
+		LastError:   p.lastError,
+	}
+}
+
+// Update switches to the server list in cfg and reports whether the active
+// server changed. A discovered list is kept while cfg has the same
+// discovery URL.
+func (p *ServerPool) Update(cfg data.ServerConfig) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous := p.active
+	if p.discovered && cfg.DiscoveryURL == p.cfg.DiscoveryURL {
+		p.setServers(cfg, p.servers, true)
+	} else {
+		p.setServers(cfg, cfg.Servers(), false)
+	}
+	return p.active != previous
+}
+
+// setServers replaces the server list, keeping the active server if it is
+// still listed. Called with p.mu held, or before p is shared.
+func (p *ServerPool) setServers(cfg data.ServerConfig, servers []string, discovered bool) {
+	p.cfg, p.servers, p.discovered = cfg, servers, discovered
+	clear(p.recovered)
+	if !slices.Contains(servers, p.active) {
+		p.switchTo(servers[0])
+	}
+}
+
+// switchTo makes server active. Called with p.mu held.
+func (p *ServerPool) switchTo(server string) {
+	if p.active != "" {
+		p.failovers++
+	}
+	p.active, p.since = server, time.Now()
+	p.failures = 0
+	clear(p.recovered)
+}
+
+// Check refreshes the discovery document, if any, health checks the servers
+// and reports whether the active server changed. It must not be called
+// concurrently with itself or Update.
+func (p *ServerPool) Check(ctx context.Context) bool {
+	p.mu.RLock()
+	cfg, active := p.cfg, p.active
+	p.mu.RUnlock()
+
+	if cfg.DiscoveryURL != "" {
+		servers, err := data.FetchServerDiscovery(cfg.DiscoveryURL)
+		if err != nil {
+			slog.Debug("server discovery failed, keeping server list", "url", cfg.DiscoveryURL, "error", err)
+		} else {
+			p.mu.Lock()
+			if !p.discovered || !slices.Equal(servers, p.servers) {
+				slog.Info("server list discovered", "servers", servers)
+				p.setServers(cfg, servers, true)
+			}
+			p.mu.Unlock()
+		}
+	}
+
+	p.mu.RLock()
+	servers := p.servers
+	p.mu.RUnlock()
+	if len(servers) < 2 {
+		return p.Active() != active // nothing to fail over to
+	}
+
+	err := p.check(ctx, p.Active())
+	p.mu.Lock()
+	if err != nil {
+		p.failures++
+		p.lastError = err.Error()
+	} else {
+		p.failures = 0
+	}
+	failing := p.failures >= max(cfg.FailoverAfter, 1)
+	p.mu.Unlock()
+
+	if failing {
+		p.failover(ctx, servers)
+	} else {
+		p.failback(ctx, servers)
+	}
+	return p.Active() != active
+}
+
+// failover switches to the most preferred other server that passes a
+// health check, if any.
+func (p *ServerPool) failover(ctx context.Context, servers []string) {
+	current := p.Active()
+	for _, server := range servers {
+		if server == current {
+			continue
+		}
+		if err := p.check(ctx, server); err != nil {
+			slog.Debug("failover candidate unhealthy", "server", server, "error", err)
+			continue
+		}
+		p.mu.Lock()
+		slog.Warn("server unreachable, failing over", "from", current, "to", server, "error", p.lastError)
+		p.switchTo(server)
+		p.mu.Unlock()
+		return
+	}
+	slog.Warn("server unreachable and no other server is healthy", "server", current)
+}
+
+// failback checks the servers preferred over the active one, most preferred
+// first, and switches to the first that has passed enough checks in a row.
+func (p *ServerPool) failback(ctx context.Context, servers []string) {
+	current := p.Active()
+	for _, server := range servers {
+		if server == current {
+			return
+		}
+		err := p.check(ctx, server)
+
+		p.mu.Lock()
+		if err != nil {
+			delete(p.recovered, server)
+			p.mu.Unlock()
+			continue
+		}
+		p.recovered[server]++
+		if p.recovered[server] >= max(p.cfg.FailoverAfter, 1) {
+			slog.Info("preferred server healthy again, failing back", "from", current, "to", server)
+			p.switchTo(server)
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
+
+// check reports whether server answers its health endpoint.
+func (p *ServerPool) check(ctx context.Context, server string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// loadServerConfig fetches the device config from the first of servers that
+// serves it, and returns the server it came from.
+func loadServerConfig(servers []string, uuid string, credential *Credential) (*data.Config, string, error) {
+	lastErr := fmt.Errorf("no servers configured")
+	for _, server := range servers {
+		config, err := data.LoadConfigV2(server, uuid, credential.Token())
+		if err == nil {
+			return config, server, nil
+		}
+		if len(servers) > 1 {
+			slog.Warn("failed to fetch config, trying next server", "server", server, "error", err)
+		}
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
+
+// serverURL returns the base URL of the server in use.
+func (d *Dronnayak) serverURL() string {
+	return d.servers.Active()
+}
+
+// switchServer moves everything that talks to the server over to the active
+// one. Tunnels and the stats reporter resolve the server on every connection
+// or report, so only the probes need restarting.
+func (d *Dronnayak) switchServer(ctx context.Context) {
+	server := d.serverURL()
+	slog.Info("switching server", "server", server)
+
+	d.tunnelMu.Lock()
+	for _, tm := range d.tunnelManagers {
+		tm.Reconnect()
+	}
+	d.tunnelMu.Unlock()
+
+	if d.probeCancel != nil {
+		d.stopProbes()
+		d.startProbes(ctx)
+	}
+
+	if err := d.reloadConfig(ctx, false); err != nil {
+		slog.Warn("config check on new server failed", "server", server, "error", err)
+	}
+}
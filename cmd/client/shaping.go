@@ -0,0 +1,343 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/gowsrelay/client"
+)
+
+const (
+	// priorityWait bounds how long a chunk waits for higher-priority chunks
+	// in flight, so a stalled control tunnel cannot block the others.
+	priorityWait = 100 * time.Millisecond
+
+	// congestionDelay is how long sending one chunk, or a frame waiting in
+	// the multiplexed uplink queue, may take before the uplink counts as
+	// saturated.
+	congestionDelay = 300 * time.Millisecond
+
+	minBulkRate      = 8 << 10 // bytes/s bulk tunnels keep when backed off
+	bulkRecoverAfter = 2 * time.Second
+)
+
+var priorityRank = map[data.TunnelPriority]int{
+	data.TunnelPriorityControl: 0,
+	data.TunnelPriorityNormal:  1,
+	data.TunnelPriorityBulk:    2,
+}
+
+// rankOf returns the scheduling rank of priority, normal if unset.
+func rankOf(priority data.TunnelPriority) int {
+	if rank, ok := priorityRank[priority]; ok {
+		return rank
+	}
+	return priorityRank[data.TunnelPriorityNormal]
+}
+
+// TrafficScheduler shapes the uplink traffic of all tunnels, i.e. what their
+// endpoints produce for the server.
+//
+// A chunk is held back while bytes of a higher priority are still unsent.
+// With a multiplexed transport those are the frames waiting in its uplink
+// queue (see uplinkQueue), which also sends them highest priority first, and
+// the time a frame waited is the congestion signal. With a WebSocket per
+// tunnel the socket buffers are out of sight: a tunnel pulls one chunk from
+// its endpoint and sends it before pulling the next, so a chunk counts as
+// unsent until then, and the time between the two is the congestion signal.
+//
+// Bulk tunnels share a rate that halves when the uplink is congested and
+// grows back slowly once it is not, until it no longer limits them.
+type TrafficScheduler struct {
+	mu       sync.Mutex
+	inFlight [3]int        // chunks read from endpoints and not yet sent
+	queued   [3]int        // bytes waiting in the uplink queue
+	changed  chan struct{} // closed and replaced whenever inFlight or queued drops
+
+	bulk           *tokenBucket // nil while bulk tunnels are not limited
+	bulkThroughput float64      // bytes/s, smoothed
+	bulkBytes      int
+	bulkSince      time.Time
+	lastCongestion time.Time
+	lastIncrease   time.Time
+}
+
+func NewTrafficScheduler() *TrafficScheduler {
+	return &TrafficScheduler{changed: make(chan struct{}), bulkSince: time.Now()}
+}
+
+// BulkRate returns the rate bulk tunnels are limited to in bytes/s, or 0 if
+// they are not limited.
+func (s *TrafficScheduler) BulkRate() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bulk == nil {
+		return 0
+	}
+	return int(s.bulk.rate)
+}
+
+// admit waits until a chunk of n bytes of the given priority may be sent,
+// or until abort is closed, and marks it in flight.
+func (s *TrafficScheduler) admit(rank, n int, abort <-chan struct{}) {
+	deadline := time.NewTimer(priorityWait)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		busy := false
+		for r := 0; r < rank; r++ {
+			busy = busy || s.inFlight[r] > 0 || s.queued[r] > 0
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		if !busy {
+			break
+		}
+		select {
+		case <-changed:
+			continue
+		case <-deadline.C:
+		case <-abort:
+		}
+		break
+	}
+
+	s.mu.Lock()
+	var delay time.Duration
+	if rank == priorityRank[data.TunnelPriorityBulk] {
+		s.recoverBulk(time.Now())
+		if s.bulk != nil {
+			delay = s.bulk.reserve(n)
+		}
+	}
+	s.inFlight[rank]++
+	s.mu.Unlock()
+
+	if delay > 0 {
+		wait(delay, abort)
+	}
+}
+
+// sent records that a chunk passed by admit took the given time to send.
+func (s *TrafficScheduler) sent(rank, n int, took time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight[rank]--
+	s.notify()
+
+	bulk := rank == priorityRank[data.TunnelPriorityBulk]
+	if bulk {
+		s.bulkBytes += n
+		if elapsed := now.Sub(s.bulkSince); elapsed >= time.Second {
+			rate := float64(s.bulkBytes) / elapsed.Seconds()
+			s.bulkThroughput = (s.bulkThroughput + rate) / 2
+			s.bulkBytes, s.bulkSince = 0, now
+		}
+	}
+
+	slow := took > congestionDelay
+	if bulk && s.bulk != nil {
+		// A large bulk chunk on a limited rate legitimately takes a while.
+		slow = slow && took > 2*time.Duration(float64(n)/s.bulk.rate*float64(time.Second))
+	}
+	if slow && now.Sub(s.lastCongestion) >= time.Second {
+		s.backOffBulk(now)
+	}
+}
+
+// queue records n bytes of the given rank entering the uplink queue.
+func (s *TrafficScheduler) queue(rank, n int) {
+	s.mu.Lock()
+	s.queued[rank] += n
+	s.mu.Unlock()
+}
+
+// dequeue records n bytes of the given rank leaving the uplink queue after
+// waiting there for waited.
+func (s *TrafficScheduler) dequeue(rank, n int, waited time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued[rank] -= n
+	s.notify()
+	if waited > congestionDelay && now.Sub(s.lastCongestion) >= time.Second {
+		s.backOffBulk(now)
+	}
+}
+
+// notify wakes chunks waiting in admit. Called with s.mu held.
+func (s *TrafficScheduler) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// backOffBulk halves the bulk rate. Called with s.mu held.
+func (s *TrafficScheduler) backOffBulk(now time.Time) {
+	s.lastCongestion = now
+	rate := s.bulkThroughput
+	if s.bulk != nil {
+		rate = s.bulk.rate
+	}
+	rate = max(rate/2, minBulkRate)
+	if s.bulk == nil {
+		s.bulk = newTokenBucket(rate)
+	} else {
+		s.bulk.setRate(rate)
+	}
+	slog.Info("uplink saturated, backing off bulk tunnels", "bulk_rate_kbps", int(rate*8/1000))
+}
+
+// recoverBulk raises the bulk rate once sends have been quick for a while,
+// and lifts the limit when it is well above what bulk tunnels use. Called
+// with s.mu held.
+func (s *TrafficScheduler) recoverBulk(now time.Time) {
+	if s.bulk == nil || now.Sub(s.lastCongestion) < bulkRecoverAfter || now.Sub(s.lastIncrease) < time.Second {
+		return
+	}
+	s.lastIncrease = now
+	rate := s.bulk.rate + max(s.bulk.rate/8, minBulkRate)
+	if rate > 4*max(s.bulkThroughput, minBulkRate) {
+		s.bulk = nil
+		slog.Info("uplink recovered, bulk tunnels no longer limited")
+		return
+	}
+	s.bulk.setRate(rate)
+}
+
+// Shape wraps the endpoints made by factory so their uplink traffic is
+// scheduled as entry's priority and capped at entry.MaxKbps across all
+// connections of the tunnel.
+func (s *TrafficScheduler) Shape(entry data.TunnelEntry, factory EndpointFactory) EndpointFactory {
+	rank := rankOf(entry.Priority)
+	limit := newTunnelLimit(entry.MaxKbps)
+	return func() (client.LocalEndpoint, error) {
+		ep, err := factory()
+		if err != nil {
+			return nil, err
+		}
+		return &shapedEndpoint{
+			LocalEndpoint: ep,
+			sched:         s,
+			rank:          rank,
+			limit:         limit,
+			closed:        make(chan struct{}),
+		}, nil
+	}
+}
+
+// shapedEndpoint passes each chunk read from the endpoint through the
+// scheduler before handing it to the tunnel.
+type shapedEndpoint struct {
+	client.LocalEndpoint
+	sched *TrafficScheduler
+	rank  int
+	limit *tokenBucket // nil if uncapped
+
+	mu        sync.Mutex
+	inFlight  bool
+	sentAt    time.Time
+	sentBytes int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (e *shapedEndpoint) Read(p []byte) (int, error) {
+	e.finishSend()
+	n, err := e.LocalEndpoint.Read(p)
+	if n > 0 {
+		if e.limit != nil {
+			wait(e.limit.reserve(n), e.closed)
+		}
+		e.sched.admit(e.rank, n, e.closed)
+		e.mu.Lock()
+		e.inFlight, e.sentAt, e.sentBytes = true, time.Now(), n
+		e.mu.Unlock()
+	}
+	return n, err
+}
+
+func (e *shapedEndpoint) Close() error {
+	e.closeOnce.Do(func() { close(e.closed) })
+	e.mu.Lock()
+	if e.inFlight {
+		// Whether the last chunk went out is unknown; don't count it as slow.
+		e.inFlight = false
+		e.sched.sent(e.rank, e.sentBytes, 0)
+	}
+	e.mu.Unlock()
+	return e.LocalEndpoint.Close()
+}
+
+// finishSend reports the chunk handed out by the last Read as sent.
+func (e *shapedEndpoint) finishSend() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.inFlight {
+		e.inFlight = false
+		e.sched.sent(e.rank, e.sentBytes, time.Since(e.sentAt))
+	}
+}
+
+// newTunnelLimit returns the bucket enforcing a kbit/s cap, or nil for none.
+func newTunnelLimit(kbps int) *tokenBucket {
+	if kbps <= 0 {
+		return nil
+	}
+	return newTokenBucket(float64(kbps) * 1000 / 8)
+}
+
+// tokenBucket limits a byte rate. A chunk larger than the bucket is let
+// through and paid for by waiting afterwards, so chunks are never split.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/s
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate / 4, last: time.Now()}
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	b.refill()
+	b.rate = rate
+	b.mu.Unlock()
+}
+
+// reserve takes n bytes and returns how long to wait before sending them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate/4)
+	b.last = now
+}
+
+// wait sleeps for d or until abort is closed.
+func wait(d time.Duration, abort <-chan struct{}) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-abort:
+	}
+}
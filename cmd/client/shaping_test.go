@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(1000) // 250 bytes of burst
+
+	if d := b.reserve(250); d != 0 {
+		t.Fatalf("reserve within burst: wait %v, want 0", d)
+	}
+	d := b.reserve(500)
+	if d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("reserve beyond burst: wait %v, want about 500ms", d)
+	}
+}
+
+func TestTokenBucketRefillCapped(t *testing.T) {
+	b := newTokenBucket(1000)
+	b.tokens = 0
+	b.last = time.Now().Add(-time.Hour)
+
+	if d := b.reserve(250); d != 0 {
+		t.Fatalf("reserve after refill: wait %v, want 0", d)
+	}
+	if d := b.reserve(100); d == 0 {
+		t.Fatal("refill exceeded the burst size")
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	b := newTokenBucket(1000)
+	b.reserve(250)
+	b.setRate(2000)
+
+	d := b.reserve(1000)
+	if d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("reserve at new rate: wait %v, want about 500ms", d)
+	}
+}
+
+func TestBackOffBulkHalvesToFloor(t *testing.T) {
+	s := NewTrafficScheduler()
+	s.bulkThroughput = 64 << 10
+
+	now := time.Now()
+	s.backOffBulk(now)
+	if got := s.BulkRate(); got != 32<<10 {
+		t.Fatalf("first back-off: rate %d, want %d", got, 32<<10)
+	}
+	for range 10 {
+		s.backOffBulk(now)
+	}
+	if got := s.BulkRate(); got != minBulkRate {
+		t.Fatalf("repeated back-off: rate %d, want floor %d", got, minBulkRate)
+	}
+}
+
+func TestRecoverBulk(t *testing.T) {
+	s := NewTrafficScheduler()
+	s.bulkThroughput = 64 << 10
+	start := time.Now()
+	s.backOffBulk(start)
+	rate := s.BulkRate()
+
+	s.recoverBulk(start.Add(bulkRecoverAfter / 2))
+	if got := s.BulkRate(); got != rate {
+		t.Fatalf("recovered %v after congestion: rate %d, want %d", bulkRecoverAfter/2, got, rate)
+	}
+
+	now := start.Add(bulkRecoverAfter)
+	s.recoverBulk(now)
+	if got, want := s.BulkRate(), rate+max(rate/8, minBulkRate); got != want {
+		t.Fatalf("first increase: rate %d, want %d", got, want)
+	}
+	rate = s.BulkRate()
+	s.recoverBulk(now.Add(time.Second / 2))
+	if got := s.BulkRate(); got != rate {
+		t.Fatalf("increased twice within a second: rate %d, want %d", got, rate)
+	}
+
+	for i := 1; i < 100 && s.BulkRate() != 0; i++ {
+		s.recoverBulk(now.Add(time.Duration(i) * time.Second))
+	}
+	if got := s.BulkRate(); got != 0 {
+		t.Fatalf("limit not lifted: rate %d", got)
+	}
+}
+
+func TestSlowSendBacksOffBulk(t *testing.T) {
+	s := NewTrafficScheduler()
+	normal := rankOf(data.TunnelPriorityNormal)
+
+	s.admit(normal, 100, nil)
+	s.sent(normal, 100, congestionDelay/2)
+	if s.BulkRate() != 0 {
+		t.Fatal("quick send limited bulk tunnels")
+	}
+	s.admit(normal, 100, nil)
+	s.sent(normal, 100, 2*congestionDelay)
+	if s.BulkRate() == 0 {
+		t.Fatal("slow send did not limit bulk tunnels")
+	}
+}
+
+func TestQueueDelayBacksOffBulk(t *testing.T) {
+	s := NewTrafficScheduler()
+	control := rankOf(data.TunnelPriorityControl)
+
+	s.queue(control, 100)
+	s.dequeue(control, 100, congestionDelay/2)
+	if s.BulkRate() != 0 {
+		t.Fatal("short queue wait limited bulk tunnels")
+	}
+	s.queue(control, 100)
+	s.dequeue(control, 100, 2*congestionDelay)
+	if s.BulkRate() == 0 {
+		t.Fatal("long queue wait did not limit bulk tunnels")
+	}
+}
+
+func TestAdmitWaitsForQueuedHigherPriority(t *testing.T) {
+	s := NewTrafficScheduler()
+	control, bulk := rankOf(data.TunnelPriorityControl), rankOf(data.TunnelPriorityBulk)
+
+	s.queue(control, 100)
+	admitted := make(chan struct{})
+	go func() {
+		s.admit(bulk, 100, nil)
+		close(admitted)
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("bulk chunk admitted while control bytes were queued")
+	case <-time.After(priorityWait / 4):
+	}
+	s.dequeue(control, 100, 0)
+	select {
+	case <-admitted:
+	case <-time.After(priorityWait / 2):
+		t.Fatal("bulk chunk not admitted once the queue drained")
+	}
+}
+
+func TestAdmitBoundedByPriorityWait(t *testing.T) {
+	s := NewTrafficScheduler()
+	s.queue(rankOf(data.TunnelPriorityControl), 100)
+
+	start := time.Now()
+	s.admit(rankOf(data.TunnelPriorityNormal), 100, nil)
+	if took := time.Since(start); took < priorityWait || took > 5*priorityWait {
+		t.Fatalf("admit took %v, want about %v", took, priorityWait)
+	}
+}
+
+func TestAdmitIgnoresLowerPriority(t *testing.T) {
+	s := NewTrafficScheduler()
+	s.queue(rankOf(data.TunnelPriorityBulk), 100)
+	s.admit(rankOf(data.TunnelPriorityBulk), 100, nil)
+
+	start := time.Now()
+	s.admit(rankOf(data.TunnelPriorityControl), 100, nil)
+	if took := time.Since(start); took >= priorityWait {
+		t.Fatalf("control chunk waited %v behind bulk traffic", took)
+	}
+}
+
+// dataFrame builds a mux data frame for stream id.
+func dataFrame(id uint32, payload string) []byte {
+	f := []byte{2, 0, 0, 0, byte(id), 0, 0, 0, byte(len(payload))}
+	return append(f, payload...)
+}
+
+func TestUplinkQueueOrder(t *testing.T) {
+	s := NewTrafficScheduler()
+	sent := make(chan []byte)
+	release := make(chan struct{})
+	q := newUplinkQueue(s, func(f []byte) error {
+		sent <- f
+		<-release
+		return nil
+	})
+	q.setRank(1, rankOf(data.TunnelPriorityBulk))
+	q.setRank(3, rankOf(data.TunnelPriorityControl))
+
+	done := make(chan struct{})
+	defer close(done)
+	go q.run(done)
+
+	// Hold the sender on a first frame while the rest queue up.
+	q.Write(dataFrame(1, "b0"))
+	<-sent
+	q.Write(dataFrame(1, "b1"))
+	q.Write(dataFrame(2, "n1"))
+	open := []byte{1, 0, 0, 0, 4, 0, 0, 0, 0}
+	q.Write(open)
+	q.Write(dataFrame(3, "c1"))
+	q.Write(dataFrame(1, "b2"))
+
+	want := [][]byte{open, dataFrame(3, "c1"), dataFrame(2, "n1"), dataFrame(1, "b1"), dataFrame(1, "b2")}
+	for i, w := range want {
+		release <- struct{}{}
+		if got := <-sent; !bytes.Equal(got, w) {
+			t.Fatalf("frame %d: got %x, want %x", i, got, w)
+		}
+	}
+	release <- struct{}{}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		queued := s.queued
+		s.mu.Unlock()
+		if queued == [3]int{} {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued bytes after draining: %v", queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUplinkQueueSendError(t *testing.T) {
+	s := NewTrafficScheduler()
+	errSend := errors.New("send failed")
+	block := make(chan struct{})
+	q := newUplinkQueue(s, func([]byte) error {
+		<-block
+		return errSend
+	})
+
+	result := make(chan error, 1)
+	go func() { result <- q.run(nil) }()
+	q.Write(dataFrame(1, "a"))
+	q.Write(dataFrame(1, "b"))
+	close(block)
+
+	if err := <-result; !errors.Is(err, errSend) {
+		t.Fatalf("run returned %v, want %v", err, errSend)
+	}
+	if _, err := q.Write(dataFrame(1, "c")); !errors.Is(err, errSend) {
+		t.Fatalf("write after failure returned %v, want %v", err, errSend)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued != [3]int{} {
+		t.Fatalf("queued bytes after failure: %v", s.queued)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/dronnayak-core/internal/mux"
+)
+
+const socksDialTimeout = 10 * time.Second
+
+// SOCKS5 reply codes (RFC 1928).
+const (
+	socksSucceeded          byte = 0x00
+	socksGeneralFailure     byte = 0x01
+	socksNotAllowed         byte = 0x02
+	socksNetworkUnreachable byte = 0x03
+	socksHostUnreachable    byte = 0x04
+	socksConnectionRefused  byte = 0x05
+	socksCommandUnsupported byte = 0x07
+	socksAddressUnsupported byte = 0x08
+)
+
+// NewSOCKSEndpoint returns the endpoint for "socks5" tunnels. Each mux
+// stream is served as a SOCKS5 connection (no authentication, CONNECT only)
+// from the drone, so one tunnel reaches any host the tunnel allowlist
+// permits; authenticating operators is left to the server side. check is
+// called for every connection so config changes apply without reconnecting.
+func NewSOCKSEndpoint(check func(host, port string) error) *MuxEndpoint {
+	s := &socksServer{check: check}
+	return NewMuxEndpoint(s.serveConn)
+}
+
+type socksServer struct {
+	check func(host, port string) error
+}
+
+// serveConn runs the SOCKS5 handshake on st, connects to the requested
+// target and relays data until either side closes.
+func (s *socksServer) serveConn(st *mux.Stream) {
+	defer st.Close()
+
+	// Greeting: VER NMETHODS METHODS...
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(st, hdr); err != nil || hdr[0] != 5 {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(st, methods); err != nil {
+		return
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0x00
+	}
+	if !noAuth {
+		st.Write([]byte{5, 0xff})
+		return
+	}
+	if _, err := st.Write([]byte{5, 0x00}); err != nil {
+		return
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(st, req); err != nil || req[0] != 5 {
+		return
+	}
+	host, err := readSOCKSAddr(st, req[3])
+	if err != nil {
+		socksReply(st, socksAddressUnsupported, nil)
+		return
+	}
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(st, portBuf); err != nil {
+		return
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(portBuf)))
+	if req[1] != 0x01 {
+		socksReply(st, socksCommandUnsupported, nil)
+		return
+	}
+
+	target, code := s.dial(host, port)
+	if target == nil {
+		socksReply(st, code, nil)
+		return
+	}
+	defer target.Close()
+	if err := socksReply(st, socksSucceeded, target.LocalAddr()); err != nil {
+		return
+	}
+
+	pipeStream(st, target)
+}
+
+// dial resolves host, picks the first address the allowlist permits and
+// connects to it, returning the SOCKS reply code on failure.
+func (s *socksServer) dial(host, port string) (net.Conn, byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), socksDialTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		slog.Debug("socks: resolve failed", "host", host, "error", err)
+		return nil, socksHostUnreachable
+	}
+
+	var target string
+	for _, addr := range addrs {
+		if err := s.check(addr.IP.String(), port); err == nil {
+			target = net.JoinHostPort(addr.IP.String(), port)
+			break
+		}
+	}
+	if target == "" {
+		slog.Warn("socks: target not allowed", "host", host, "port", port)
+		return nil, socksNotAllowed
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", target)
+	switch {
+	case err == nil:
+		return conn, socksSucceeded
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return nil, socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return nil, socksNetworkUnreachable
+	default:
+		slog.Debug("socks: dial failed", "target", target, "error", err)
+		return nil, socksHostUnreachable
+	}
+}
+
+func readSOCKSAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case 0x01, 0x04: // IPv4, IPv6
+		ip := make(net.IP, 4)
+		if atyp == 0x04 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case 0x03: // domain name
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		return string(name), nil
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp)
+	}
+}
+
+// socksReply sends a reply with the bound address, or 0.0.0.0:0 if bound is nil.
+func socksReply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{5, code, 0, 0x01, 0, 0, 0, 0, 0, 0}
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := tcp.IP.To4(); ip4 != nil {
+			copy(reply[4:8], ip4)
+		} else {
+			reply = append([]byte{5, code, 0, 0x04}, tcp.IP.To16()...)
+			reply = append(reply, 0, 0)
+		}
+		binary.BigEndian.PutUint16(reply[len(reply)-2:], uint16(tcp.Port))
+	}
+	_, err := w.Write(reply)
+	return err
+}
+
+// socksTargetCheck applies the tunnel allowlist to a SOCKS target.
+func (d *Dronnayak) socksTargetCheck(host, port string) error {
+	return d.currentConfig().Tunnel.CheckEndpoint(data.TunnelEntry{Type: data.EndpointTypeTCP, Host: host, Port: port})
+}
@@ -6,38 +6,107 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"path/filepath"
 	"time"
 
 	"github.com/KunalDuran/devstat"
 	"github.com/KunalDuran/dronnayak-core/internal/data"
 	"github.com/KunalDuran/dronnayak-core/internal/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const (
-	EventStartTunnel = "start_tunnel"
-	EventStopTunnel  = "stop_tunnel"
+	EventStartTunnel      = "start_tunnel"
+	EventStopTunnel       = "stop_tunnel"
+	EventUploadTLog       = "upload_tlog"
+	EventReloadConfig     = "reload_config"
+	EventUpdateAgent      = "update_agent"
+	EventRotateCredential = "rotate_credential"
 )
 
+const (
+	// commandResultLimit bounds the undelivered command results kept on disk.
+	commandResultLimit = 1000
+
+	// commandResultBatchSize is the most command results sent in one request.
+	commandResultBatchSize = 50
+)
+
+// commandResultsDir is where command results await delivery, next to the
+// config so they survive restarts.
+func commandResultsDir(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "command-results")
+}
+
+// statusReport is the payload posted to the stats endpoint: host metrics from
+// devstat plus client-side state.
+type statusReport struct {
+	*devstat.ResourceStats
+	SampledAt     int64                  `json:"sampled_at"`
+	AgentVersion  string                 `json:"agent_version"`
+	ConfigSource  string                 `json:"config_source"`
+	ConfigVersion int64                  `json:"config_version"`
+	MAVLinkRoutes []data.MAVLinkRoute    `json:"mavlink_routes,omitempty"`
+	Telemetry     *data.VehicleTelemetry `json:"telemetry,omitempty"`
+	TLogs         []data.TLogFile        `json:"tlogs,omitempty"`
+	Tunnels       []data.TunnelHealth    `json:"tunnels,omitempty"`
+	Link          []data.LinkStats       `json:"link,omitempty"`
+	Server        *data.ServerStatus     `json:"server,omitempty"`
+}
+
+// startStats runs the stats reporter in the background until stopStats is
+// called or ctx is cancelled.
+func (d *Dronnayak) startStats(ctx context.Context) {
+	statsCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	d.statsCancel = cancel
+	d.statsDone = done
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(done)
+		d.startStatsReporter(statsCtx)
+	}()
+}
+
+// stopStats stops the stats reporter, if running, and waits for it to exit.
+func (d *Dronnayak) stopStats() {
+	if d.statsCancel == nil {
+		return
+	}
+	d.statsCancel()
+	<-d.statsDone
+	d.statsCancel, d.statsDone = nil, nil
+}
+
 func (d *Dronnayak) startStatsReporter(ctx context.Context) {
-	endpoint := d.config.Server.URL + d.config.Stats.Endpoint
+	cfg := d.currentConfig()
 
-	slog.Info("stats reporting enabled", "interval", d.config.Stats.Interval, "endpoint", endpoint)
+	slog.Info("stats reporting enabled", "interval", cfg.Stats.Interval, "endpoint", cfg.Stats.Endpoint)
+
+	queue, err := NewDiskQueue(cfg.Stats.QueueDir, cfg.Stats.QueueLimit)
+	if err != nil {
+		slog.Error("offline stats queue unavailable, failed samples will be dropped", "error", err)
+	}
 
 	// Initial stats collection (warm-up)
 	devstat.Stats()
 
-	ticker := time.NewTicker(d.config.Stats.Interval)
+	ticker := time.NewTicker(cfg.Stats.Interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			resp, err := sendStats(endpoint)
+			sample, err := d.collectStats()
 			if err != nil {
-				slog.Error("stats reporting error", "error", err)
+				slog.Error("stats collection error", "error", err)
+				continue
 			}
-
-			d.processEvent(resp)
+			d.reportStats(ctx, d.serverURL()+cfg.Stats.Endpoint, queue, sample)
+			d.reportCommandResults()
+			d.reportExecAudit()
 
 		case <-ctx.Done():
 			slog.Info("stats reporter shutting down")
@@ -46,18 +115,99 @@ func (d *Dronnayak) startStatsReporter(ctx context.Context) {
 	}
 }
 
-func sendStats(endpoint string) ([]byte, error) {
+// collectStats builds a timestamped status report and returns it marshalled.
+func (d *Dronnayak) collectStats() ([]byte, error) {
 	statsData, err := devstat.Stats()
 	if err != nil {
 		return nil, fmt.Errorf("failed to collect stats: %w", err)
 	}
 
-	jsonData, err := json.Marshal(statsData)
+	router, telemetry, tlog := d.mavlinkState()
+	report := statusReport{
+		ResourceStats: statsData,
+		SampledAt:     time.Now().Unix(),
+		AgentVersion:  Version,
+		ConfigSource:  d.currentConfigSource(),
+		ConfigVersion: d.currentConfig().Version,
+		MAVLinkRoutes: router.Routes(),
+		Telemetry:     telemetry.Snapshot(),
+		TLogs:         tlog.Logs(),
+		Tunnels:       d.tunnelHealth(),
+		Link:          d.prober.Load().Stats(),
+		Server:        d.servers.Status(),
+	}
+
+	jsonData, err := json.Marshal(report)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal stats: %w", err)
 	}
+	return jsonData, nil
+}
+
+// reportStats sends sample to the server. If the server is unreachable the
+// sample is queued on disk, and while anything is queued new samples are
+// appended behind it and replayed in order, in batches.
+func (d *Dronnayak) reportStats(ctx context.Context, endpoint string, queue *DiskQueue, sample []byte) {
+	if queue == nil || queue.Len() == 0 {
+		resp, err := sendStats(endpoint, d.credential, sample)
+		if err == nil {
+			d.checkedIn.Store(true)
+			d.processEvent(resp)
+			return
+		}
+		if queue == nil {
+			slog.Error("stats reporting error", "error", err)
+			return
+		}
+		slog.Warn("stats reporting failed, queueing sample", "error", err)
+		if err := queue.Push(sample); err != nil {
+			slog.Error("failed to queue stats sample", "error", err)
+		}
+		return
+	}
+
+	if err := queue.Push(sample); err != nil {
+		slog.Error("failed to queue stats sample", "error", err)
+	}
+	d.flushStatsQueue(ctx, endpoint, queue)
+}
+
+// flushStatsQueue replays queued samples oldest first until the queue is
+// empty, a request fails, or ctx is cancelled.
+func (d *Dronnayak) flushStatsQueue(ctx context.Context, endpoint string, queue *DiskQueue) {
+	sent := 0
+	for ctx.Err() == nil {
+		batch := queue.Peek(d.currentConfig().Stats.BatchSize)
+		if len(batch) == 0 {
+			break
+		}
+
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			slog.Error("failed to marshal stats batch", "error", err)
+			return
+		}
+
+		resp, err := sendStats(endpoint, d.credential, payload)
+		if err != nil {
+			slog.Warn("stats replay failed, will retry", "queued", queue.Len(), "error", err)
+			return
+		}
+
+		queue.Pop(len(batch))
+		sent += len(batch)
+		d.checkedIn.Store(true)
+		d.processEvent(resp)
+	}
+
+	if sent > 0 {
+		slog.Info("replayed queued stats samples", "count", sent, "remaining", queue.Len())
+	}
+}
 
-	resp, statusCode, err := web.WebRequest(http.MethodPost, endpoint, string(jsonData), nil)
+// sendStats posts a single sample or a JSON array of samples to endpoint.
+func sendStats(endpoint string, credential *Credential, payload []byte) ([]byte, error) {
+	resp, statusCode, err := web.WebRequest(http.MethodPost, endpoint, string(payload), credential.Headers())
 	if err != nil {
 		return nil, fmt.Errorf("failed to send stats: %w", err)
 	}
@@ -82,17 +232,173 @@ func (d *Dronnayak) processEvent(resp []byte) {
 			var evt data.TunnelEntry
 			if err := json.Unmarshal(cmd.Payload, &evt); err != nil {
 				slog.Error("failed to unmarshal start_tunnel payload", "error", err)
+				d.recordCommandResult(cmd.ID, fmt.Errorf("invalid payload: %w", err))
 				continue
 			}
-			d.startTunnels(d.ctx, []data.TunnelEntry{evt})
+			err := d.startTunnel(d.ctx, evt)
+			if err != nil {
+				slog.Warn("start_tunnel failed", "label", evt.Label, "error", err)
+			}
+			d.recordCommandResult(cmd.ID, err)
 
 		case EventStopTunnel:
 			var evt data.TunnelEntry
 			if err := json.Unmarshal(cmd.Payload, &evt); err != nil {
 				slog.Error("failed to unmarshal stop_tunnel payload", "error", err)
+				d.recordCommandResult(cmd.ID, fmt.Errorf("invalid payload: %w", err))
+				continue
+			}
+			d.recordCommandResult(cmd.ID, d.stopTunnel(d.makeTunnelID(evt)))
+
+		case EventUploadTLog:
+			var evt struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(cmd.Payload, &evt); err != nil {
+				slog.Error("failed to unmarshal upload_tlog payload", "error", err)
+				d.recordCommandResult(cmd.ID, fmt.Errorf("invalid payload: %w", err))
+				continue
+			}
+			_, _, tlog := d.mavlinkState()
+			cfg := d.currentConfig()
+			d.wg.Add(1)
+			go func(id primitive.ObjectID) {
+				defer d.wg.Done()
+				err := tlog.Upload(d.ctx, d.serverURL(), cfg.UUID, evt.Name, d.credential)
+				if err != nil {
+					slog.Error("tlog upload failed", "name", evt.Name, "error", err)
+				} else {
+					slog.Info("tlog uploaded", "name", evt.Name)
+				}
+				d.recordCommandResult(id, err)
+			}(cmd.ID)
+
+		case EventUpdateAgent:
+			var evt data.AgentUpdate
+			if err := json.Unmarshal(cmd.Payload, &evt); err != nil {
+				slog.Error("failed to unmarshal update_agent payload", "error", err)
+				d.recordCommandResult(cmd.ID, fmt.Errorf("invalid payload: %w", err))
 				continue
 			}
-			d.stopTunnel(d.makeTunnelID(evt))
+			d.wg.Add(1)
+			go func(id primitive.ObjectID) {
+				defer d.wg.Done()
+				// On success the result is reported by the new version once it checks in.
+				if err := d.updateAgent(d.ctx, id, evt); err != nil {
+					slog.Error("agent update failed", "version", evt.Version, "error", err)
+					d.recordCommandResult(id, err)
+				}
+			}(cmd.ID)
+
+		case EventRotateCredential:
+			cfg := d.currentConfig()
+			d.wg.Add(1)
+			go func(id primitive.ObjectID, payload json.RawMessage) {
+				defer d.wg.Done()
+				var err error
+				if d.credential.Token() == "" {
+					err = d.credential.Save(payload)
+				} else {
+					err = d.credential.Rotate(d.serverURL(), cfg.UUID)
+				}
+				if err != nil {
+					slog.Error("credential rotation failed", "error", err)
+				}
+				d.recordCommandResult(id, err)
+			}(cmd.ID, cmd.Payload)
+
+		case EventReloadConfig:
+			// The watcher reports the result once the new config has been applied.
+			select {
+			case d.reloadCh <- cmd.ID:
+			default:
+				d.recordCommandResult(cmd.ID, fmt.Errorf("a config reload is already in progress"))
+			}
+
+		default:
+			slog.Warn("unknown command type", "type", cmd.Type)
+			d.recordCommandResult(cmd.ID, fmt.Errorf("unknown command type %q", cmd.Type))
+		}
+	}
+}
+
+// recordCommandResult queues the outcome of a command for the next report.
+// Results are kept on disk until delivered, or in memory if they cannot be.
+func (d *Dronnayak) recordCommandResult(id primitive.ObjectID, err error) {
+	result := data.CommandResult{ID: id, Success: err == nil, ExecutedAt: time.Now()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("failed to marshal command result", "id", id.Hex(), "error", err)
+		return
+	}
+
+	if d.resultQueue != nil {
+		err := d.resultQueue.Push(b)
+		if err == nil {
+			return
+		}
+		slog.Error("failed to queue command result, keeping it in memory", "id", id.Hex(), "error", err)
+	}
+	d.resultsMu.Lock()
+	d.commandResults = append(d.commandResults, b)
+	d.resultsMu.Unlock()
+}
+
+// reportCommandResults posts queued command results to the server, oldest
+// first. Results stay queued if the server cannot be reached.
+func (d *Dronnayak) reportCommandResults() {
+	cfg := d.currentConfig()
+	sent := 0
+
+	d.resultsMu.Lock()
+	results := d.commandResults
+	d.commandResults = nil
+	d.resultsMu.Unlock()
+	if len(results) > 0 {
+		if err := postCommandResults(d.serverURL(), cfg.UUID, d.credential, results); err != nil {
+			slog.Warn("failed to report command results, will retry", "count", len(results), "error", err)
+			d.resultsMu.Lock()
+			d.commandResults = append(results, d.commandResults...)
+			d.resultsMu.Unlock()
+			return
+		}
+		sent += len(results)
+	}
+
+	for d.resultQueue != nil {
+		batch := d.resultQueue.Peek(commandResultBatchSize)
+		if len(batch) == 0 {
+			break
 		}
+		if err := postCommandResults(d.serverURL(), cfg.UUID, d.credential, batch); err != nil {
+			slog.Warn("failed to report command results, will retry", "queued", d.resultQueue.Len(), "error", err)
+			break
+		}
+		d.resultQueue.Pop(len(batch))
+		sent += len(batch)
+	}
+
+	if sent > 0 {
+		slog.Info("command results reported", "count", sent)
+	}
+}
+
+func postCommandResults(serverURL, uuid string, credential *Credential, results []json.RawMessage) error {
+	payload, err := json.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command results: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/device/%s/commands/results", serverURL, uuid)
+	_, statusCode, err := web.WebRequest(http.MethodPost, url, string(payload), credential.Headers())
+	if err != nil {
+		return fmt.Errorf("failed to send command results: %w", err)
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", statusCode)
 	}
+	return nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+	"github.com/bluenviron/gomavlib/v3/pkg/frame"
+)
+
+// TelemetryTracker keeps the latest decoded state of the autopilot seen on the
+// MAVLink node. It locks onto the first system that sends an autopilot
+// heartbeat and ignores everything else (ground stations, gimbals, ...),
+// except RADIO_STATUS, which telemetry radios send under their own system ID.
+type TelemetryTracker struct {
+	mu       sync.Mutex
+	systemID byte
+	snapshot data.VehicleTelemetry
+	radio    data.RadioStatus // LastUpdated is 0 until one is seen
+}
+
+// NewTelemetryTracker creates an empty tracker.
+func NewTelemetryTracker() *TelemetryTracker {
+	return &TelemetryTracker{}
+}
+
+// Update folds a received frame into the snapshot.
+func (t *TelemetryTracker) Update(fr frame.Frame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if msg, ok := fr.GetMessage().(*common.MessageRadioStatus); ok {
+		t.radio = data.RadioStatus{
+			RSSI:        msg.Rssi,
+			RemoteRSSI:  msg.Remrssi,
+			Noise:       msg.Noise,
+			RemoteNoise: msg.Remnoise,
+			TxBuffer:    msg.Txbuf,
+			RxErrors:    msg.Rxerrors,
+			Fixed:       msg.Fixed,
+			LastUpdated: time.Now().Unix(),
+		}
+		return
+	}
+
+	if hb, ok := fr.GetMessage().(*common.MessageHeartbeat); ok && t.systemID == 0 {
+		if hb.Autopilot == common.MAV_AUTOPILOT_INVALID {
+			return
+		}
+		t.systemID = fr.GetSystemID()
+		t.snapshot.SystemID = t.systemID
+	}
+	if t.systemID == 0 || fr.GetSystemID() != t.systemID {
+		return
+	}
+
+	now := time.Now().Unix()
+	s := &t.snapshot
+
+	switch msg := fr.GetMessage().(type) {
+	case *common.MessageHeartbeat:
+		if msg.Autopilot == common.MAV_AUTOPILOT_INVALID {
+			return // heartbeat from a companion component of the same system
+		}
+		s.VehicleType = msg.Type.String()
+		s.Autopilot = msg.Autopilot.String()
+		s.Armed = msg.BaseMode&common.MAV_MODE_FLAG_SAFETY_ARMED != 0
+		s.CustomMode = msg.CustomMode
+		s.SystemStatus = msg.SystemStatus.String()
+		s.LastHeartbeat = now
+
+	case *common.MessageSysStatus:
+		s.CPULoad = float64(msg.Load) / 10
+		if msg.VoltageBattery != math.MaxUint16 {
+			s.BatteryVoltage = float64(msg.VoltageBattery) / 1000
+		}
+		s.BatteryCurrent = centiampsToAmps(msg.CurrentBattery)
+		s.BatteryRemaining = msg.BatteryRemaining
+
+	case *common.MessageGlobalPositionInt:
+		s.Latitude = float64(msg.Lat) / 1e7
+		s.Longitude = float64(msg.Lon) / 1e7
+		s.AltitudeMSL = float64(msg.Alt) / 1000
+		s.AltitudeRel = float64(msg.RelativeAlt) / 1000
+		s.GroundSpeed = math.Hypot(float64(msg.Vx), float64(msg.Vy)) / 100
+		s.ClimbRate = -float64(msg.Vz) / 100
+		if msg.Hdg != math.MaxUint16 {
+			s.Heading = float64(msg.Hdg) / 100
+		}
+
+	case *common.MessageAttitude:
+		s.Roll = radToDeg(msg.Roll)
+		s.Pitch = radToDeg(msg.Pitch)
+		s.Yaw = radToDeg(msg.Yaw)
+
+	case *common.MessageGpsRawInt:
+		s.GPSFixType = msg.FixType.String()
+		if msg.SatellitesVisible != math.MaxUint8 {
+			s.GPSSatellites = msg.SatellitesVisible
+		}
+		if msg.Eph != math.MaxUint16 {
+			s.GPSHDOP = float64(msg.Eph) / 100
+		}
+
+	case *common.MessageBatteryStatus:
+		if msg.Id != 0 {
+			return // only the primary battery is tracked
+		}
+		var millivolts uint32
+		for _, v := range msg.Voltages {
+			if v == math.MaxUint16 {
+				break
+			}
+			millivolts += uint32(v)
+		}
+		if millivolts > 0 {
+			s.BatteryVoltage = float64(millivolts) / 1000
+		}
+		s.BatteryCurrent = centiampsToAmps(msg.CurrentBattery)
+		s.BatteryRemaining = msg.BatteryRemaining
+		s.BatteryConsumed = msg.CurrentConsumed
+
+	default:
+		return
+	}
+
+	s.LastUpdated = now
+}
+
+// Snapshot returns a copy of the latest telemetry, or nil if no autopilot
+// has been seen yet.
+func (t *TelemetryTracker) Snapshot() *data.VehicleTelemetry {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.systemID == 0 {
+		return nil
+	}
+	snapshot := t.snapshot
+	if t.radio.LastUpdated != 0 {
+		radio := t.radio
+		snapshot.Radio = &radio
+	}
+	return &snapshot
+}
+
+func radToDeg(rad float32) float64 {
+	return float64(rad) * 180 / math.Pi
+}
+
+func centiampsToAmps(current int16) float64 {
+	if current == -1 {
+		return -1
+	}
+	return float64(current) / 100
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialect"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+	"github.com/bluenviron/gomavlib/v3/pkg/frame"
+)
+
+const (
+	tlogExt = ".tlog"
+
+	// tlogFlushInterval bounds how long recorded frames stay buffered in
+	// memory before they are written to the log file.
+	tlogFlushInterval = time.Second
+	tlogBufferSize    = 64 << 10
+
+	// tlogUploadTimeout bounds a whole log upload, long enough for a full
+	// default-sized log over a slow link.
+	tlogUploadTimeout = 30 * time.Minute
+)
+
+var tlogUploadClient = &http.Client{Timeout: tlogUploadTimeout}
+
+// validTLogName matches file names produced by TLogRecorder.
+var validTLogName = regexp.MustCompile(`^[0-9TZ-]+\.tlog$`)
+
+// TLogRecorder writes every MAVLink frame to rotating .tlog files: each record
+// is a big-endian uint64 timestamp in microseconds since the Unix epoch
+// followed by the raw frame bytes. Records are buffered and written out at
+// least every tlogFlushInterval.
+type TLogRecorder struct {
+	conf data.TLogConfig
+
+	mu           sync.Mutex
+	buf          bytes.Buffer
+	writer       *frame.Writer
+	file         *os.File
+	out          *bufio.Writer // buffers writes to file
+	flushPending bool          // a flush of out is scheduled
+	opened       time.Time
+	size         int64
+}
+
+// NewTLogRecorder creates the log directory and returns a recorder. The first
+// file is opened lazily on the first frame.
+func NewTLogRecorder(conf data.TLogConfig) (*TLogRecorder, error) {
+	if err := os.MkdirAll(conf.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("create tlog dir: %w", err)
+	}
+
+	dialectRW, err := dialect.NewReadWriter(common.Dialect)
+	if err != nil {
+		return nil, fmt.Errorf("create dialect: %w", err)
+	}
+
+	r := &TLogRecorder{conf: conf}
+	r.writer, err = frame.NewWriter(frame.WriterConf{
+		Writer:      &r.buf,
+		DialectRW:   dialectRW,
+		OutVersion:  frame.V2,
+		OutSystemID: 1, // unused, frames are written as received
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create frame writer: %w", err)
+	}
+
+	slog.Info("tlog recording enabled", "dir", conf.Directory, "max_file_size", conf.MaxFileSize, "max_file_age", conf.MaxFileAge, "max_total_size", conf.MaxTotalSize)
+	return r, nil
+}
+
+// Record appends fr, received at ts, to the current log file, rotating first
+// if the file is too large or too old.
+func (r *TLogRecorder) Record(fr frame.Frame, ts time.Time) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf.Reset()
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(ts.UnixMicro()))
+	r.buf.Write(stamp[:])
+
+	// WriteFrame replaces the frame's message with its encoded form, so encode a copy.
+	var err error
+	switch ff := fr.(type) {
+	case *frame.V1Frame:
+		cp := *ff
+		err = r.writer.WriteFrame(&cp)
+	case *frame.V2Frame:
+		cp := *ff
+		err = r.writer.WriteFrame(&cp)
+	default:
+		err = fmt.Errorf("unsupported frame type %T", fr)
+	}
+	if err != nil {
+		slog.Debug("tlog: failed to encode frame", "error", err)
+		return
+	}
+
+	if r.file == nil || r.size+int64(r.buf.Len()) > r.conf.MaxFileSize || ts.Sub(r.opened) > r.conf.MaxFileAge {
+		if err := r.rotate(ts); err != nil {
+			slog.Error("tlog: rotation failed", "error", err)
+			return
+		}
+	}
+
+	n, err := r.out.Write(r.buf.Bytes())
+	r.size += int64(n)
+	if err != nil {
+		slog.Error("tlog: write failed", "file", r.file.Name(), "error", err)
+	}
+	if !r.flushPending {
+		r.flushPending = true
+		time.AfterFunc(tlogFlushInterval, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.flush()
+		})
+	}
+}
+
+// flush writes the buffered records to the current file. Called with r.mu
+// held.
+func (r *TLogRecorder) flush() {
+	r.flushPending = false
+	if r.file == nil {
+		return
+	}
+	if err := r.out.Flush(); err != nil {
+		slog.Error("tlog: write failed", "file", r.file.Name(), "error", err)
+	}
+}
+
+// rotate closes the current file, enforces the disk quota and opens a new file.
+func (r *TLogRecorder) rotate(now time.Time) error {
+	if r.file != nil {
+		r.flush()
+		if err := r.file.Close(); err != nil {
+			slog.Warn("tlog: close failed", "file", r.file.Name(), "error", err)
+		}
+		slog.Info("tlog rotated", "file", r.file.Name(), "size", r.size)
+		r.file = nil
+	}
+
+	r.enforceQuota()
+
+	name := now.UTC().Format("20060102T150405.000000Z")
+	name = strings.Replace(name, ".", "-", 1) + tlogExt
+	f, err := os.OpenFile(filepath.Join(r.conf.Directory, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open tlog file: %w", err)
+	}
+
+	r.file = f
+	if r.out == nil {
+		r.out = bufio.NewWriterSize(f, tlogBufferSize)
+	} else {
+		r.out.Reset(f)
+	}
+	r.opened = now
+	r.size = 0
+	return nil
+}
+
+// enforceQuota deletes the oldest closed logs until the directory, plus room
+// for one more full file, fits within MaxTotalSize.
+func (r *TLogRecorder) enforceQuota() {
+	logs, err := r.list()
+	if err != nil {
+		slog.Warn("tlog: failed to list logs for quota", "error", err)
+		return
+	}
+
+	var total int64
+	for _, l := range logs {
+		total += l.Size
+	}
+
+	// logs are sorted oldest first
+	for _, l := range logs {
+		if total+r.conf.MaxFileSize <= r.conf.MaxTotalSize {
+			return
+		}
+		if err := os.Remove(filepath.Join(r.conf.Directory, l.Name)); err != nil {
+			slog.Warn("tlog: failed to delete old log", "file", l.Name, "error", err)
+			continue
+		}
+		slog.Info("tlog: deleted old log to stay within quota", "file", l.Name, "size", l.Size)
+		total -= l.Size
+	}
+}
+
+// Logs returns the recorded logs, oldest first.
+func (r *TLogRecorder) Logs() []data.TLogFile {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.flush() // so the active log's size is current
+	logs, err := r.list()
+	if err != nil {
+		slog.Warn("tlog: failed to list logs", "error", err)
+		return nil
+	}
+	return logs
+}
+
+func (r *TLogRecorder) list() ([]data.TLogFile, error) {
+	entries, err := os.ReadDir(r.conf.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var active string
+	if r.file != nil {
+		active = filepath.Base(r.file.Name())
+	}
+
+	var logs []data.TLogFile
+	for _, e := range entries {
+		if e.IsDir() || !validTLogName.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		logs = append(logs, data.TLogFile{
+			Name:     e.Name(),
+			Size:     info.Size(),
+			Modified: info.ModTime().Unix(),
+			Active:   e.Name() == active,
+		})
+	}
+
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Name < logs[j].Name })
+	return logs, nil
+}
+
+// Upload posts the named log to the server's tlog endpoint for this device,
+// authenticated with credential. It gives up when ctx is cancelled or after
+// tlogUploadTimeout.
+func (r *TLogRecorder) Upload(ctx context.Context, serverURL, uuid, name string, credential *Credential) error {
+	if r == nil {
+		return fmt.Errorf("tlog recording is disabled")
+	}
+	if !validTLogName.MatchString(name) {
+		return fmt.Errorf("invalid tlog name %q", name)
+	}
+
+	r.mu.Lock()
+	r.flush()
+	r.mu.Unlock()
+	f, err := os.Open(filepath.Join(r.conf.Directory, name))
+	if err != nil {
+		return fmt.Errorf("open tlog: %w", err)
+	}
+	defer f.Close()
+
+	url := fmt.Sprintf("%s/device/%s/tlogs/%s", serverURL, uuid, name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, f)
+	if err != nil {
+		return fmt.Errorf("upload tlog: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	credential.Authorize(req)
+	resp, err := tlogUploadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload tlog: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close flushes and closes the current log file.
+func (r *TLogRecorder) Close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil {
+		r.flush()
+		r.file.Close()
+		slog.Info("tlog closed", "file", r.file.Name(), "size", r.size)
+		r.file = nil
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/dronnayak-core/internal/mux"
+	"github.com/KunalDuran/gowsrelay/client"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	muxPingInterval = 30 * time.Second
+	muxWriteTimeout = 30 * time.Second
+
+	// muxPongWait is how long the connection may go without a pong before it
+	// counts as dead; it spans two pings so one lost pong is tolerated.
+	muxPongWait = 2*muxPingInterval + muxWriteTimeout
+)
+
+// MuxTransport carries every tunnel of the drone over one WebSocket to the
+// server as named mux streams, instead of one WebSocket per tunnel. The
+// server relays each stream to its topic, so subscribers see no difference.
+// The connection is dialled when the first tunnel needs it and again after it
+// drops; tunnels reconnect with their usual backoff.
+type MuxTransport struct {
+	url        string
+	credential *Credential
+	sched      *TrafficScheduler
+
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	sess   *mux.Session
+	uplink *uplinkQueue
+	closed bool
+}
+
+// NewMuxTransport returns a transport for the drone with the given UUID on
+// serverURL (http:// or https://), authenticated with credential. Its uplink
+// is sent in sched's priority order.
+func NewMuxTransport(serverURL, uuid string, credential *Credential, sched *TrafficScheduler) (*MuxTransport, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/device/" + uuid + "/mux"
+	return &MuxTransport{url: u.String(), credential: credential, sched: sched}, nil
+}
+
+// Tunnel relays ep over a stream named topic, sent with the given priority,
+// until either side closes or ctx is cancelled. It closes ep.
+func (t *MuxTransport) Tunnel(ctx context.Context, topic string, priority data.TunnelPriority, ep client.LocalEndpoint) error {
+	defer ep.Close()
+
+	sess, uplink, err := t.session(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := sess.OpenNamed(topic)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	uplink.setRank(st.ID(), rankOf(priority))
+	defer uplink.forget(st.ID()) // after Close has queued the close frame
+	defer st.Close()
+
+	errc := make(chan error, 2)
+	go func() { errc <- copyChunks(st, ep) }()
+	go func() { errc <- copyChunks(ep, st) }()
+
+	select {
+	case err := <-errc:
+		if err == nil && sess.Err() != nil {
+			err = sess.Err()
+		}
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// Close drops the connection, ending every tunnel on it.
+func (t *MuxTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.sess != nil {
+		t.sess.Close()
+		t.conn.Close()
+	}
+	return nil
+}
+
+func (t *MuxTransport) session(ctx context.Context) (*mux.Session, *uplinkQueue, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, nil, mux.ErrSessionClosed
+	}
+	if t.sess != nil {
+		select {
+		case <-t.sess.Done():
+			t.conn.Close()
+			t.sess = nil
+		default:
+			return t.sess, t.uplink, nil
+		}
+	}
+
+	header := http.Header{}
+	for key, value := range t.credential.Headers() {
+		header.Set(key, value)
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, t.url, header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial %s: %w", t.url, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(muxPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(muxPongWait))
+	})
+	uplink := newUplinkQueue(t.sched, func(frame []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+		return conn.WriteMessage(websocket.BinaryMessage, frame)
+	})
+	sess := mux.NewSession(&wsReader{conn: conn}, uplink, false)
+	go func() {
+		if err := uplink.run(sess.Done()); err != nil {
+			sess.Close()
+		}
+	}()
+	t.conn, t.sess, t.uplink = conn, sess, uplink
+	slog.Info("multiplexed tunnel connection established", "url", t.url)
+
+	go func() {
+		ticker := time.NewTicker(muxPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(muxWriteTimeout)); err != nil {
+					sess.Close()
+					return
+				}
+			case <-sess.Done():
+				conn.Close()
+				slog.Warn("multiplexed tunnel connection closed", "url", t.url, "error", sess.Err())
+				return
+			}
+		}
+	}()
+	return sess, uplink, nil
+}
+
+// copyChunks copies src to dst one Read at a time, so each chunk read from a
+// datagram or serial endpoint reaches the relay as one message.
+func copyChunks(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, mux.MaxPayload)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// wsReader reads the payloads of consecutive WebSocket messages as one stream.
+type wsReader struct {
+	conn *websocket.Conn
+	cur  io.Reader
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			_, rd, err := r.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			r.cur = rd
+		}
+		n, err := r.cur.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// uplinkQueue holds the frames of a mux session until they can be sent,
+// and sends them highest priority first, each as one message. Writes never
+// block: the streams' windows bound how much each can queue.
+type uplinkQueue struct {
+	sched *TrafficScheduler
+	send  func(frame []byte) error
+
+	mu     sync.Mutex
+	ranks  map[uint32]int // stream ID -> rank, for streams not of normal rank
+	frames [3][]queuedFrame
+	ready  chan struct{} // signalled when a frame is queued
+	err    error         // set once sending failed
+}
+
+type queuedFrame struct {
+	data     []byte
+	queuedAt time.Time
+}
+
+func newUplinkQueue(sched *TrafficScheduler, send func([]byte) error) *uplinkQueue {
+	return &uplinkQueue{sched: sched, send: send, ranks: make(map[uint32]int), ready: make(chan struct{}, 1)}
+}
+
+// setRank sends the stream's frames with the given rank.
+func (q *uplinkQueue) setRank(id uint32, rank int) {
+	q.mu.Lock()
+	q.ranks[id] = rank
+	q.mu.Unlock()
+}
+
+// forget drops the stream's rank once it has queued its last frame.
+func (q *uplinkQueue) forget(id uint32) {
+	q.mu.Lock()
+	delete(q.ranks, id)
+	q.mu.Unlock()
+}
+
+// Write queues one frame.
+func (q *uplinkQueue) Write(frame []byte) (int, error) {
+	id, urgent := mux.FrameStream(frame)
+	q.mu.Lock()
+	if q.err != nil {
+		q.mu.Unlock()
+		return 0, q.err
+	}
+	rank := 0
+	if !urgent {
+		rank = rankOf(data.TunnelPriorityNormal)
+		if r, ok := q.ranks[id]; ok {
+			rank = r
+		}
+	}
+	q.frames[rank] = append(q.frames[rank], queuedFrame{data: frame, queuedAt: time.Now()})
+	q.mu.Unlock()
+
+	q.sched.queue(rank, len(frame))
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return len(frame), nil
+}
+
+// run sends queued frames until done is closed or a send fails.
+func (q *uplinkQueue) run(done <-chan struct{}) error {
+	for {
+		q.mu.Lock()
+		rank := slices.IndexFunc(q.frames[:], func(f []queuedFrame) bool { return len(f) > 0 })
+		if rank < 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.ready:
+				continue
+			case <-done:
+				q.fail(mux.ErrSessionClosed)
+				return nil
+			}
+		}
+		f := q.frames[rank][0]
+		q.frames[rank][0] = queuedFrame{}
+		q.frames[rank] = q.frames[rank][1:]
+		q.mu.Unlock()
+
+		err := q.send(f.data)
+		q.sched.dequeue(rank, len(f.data), time.Since(f.queuedAt))
+		if err != nil {
+			q.fail(err)
+			return err
+		}
+	}
+}
+
+// fail rejects further frames and releases the queued ones.
+func (q *uplinkQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.err = err
+	for rank, frames := range q.frames {
+		n := 0
+		for _, f := range frames {
+			n += len(f.data)
+		}
+		if n > 0 {
+			q.sched.dequeue(rank, n, 0)
+		}
+		q.frames[rank] = nil
+	}
+}
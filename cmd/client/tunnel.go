@@ -2,43 +2,77 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/dronnayak-core/internal/web"
 	"github.com/KunalDuran/gowsrelay/client"
 )
 
+// tunnelSettleTime is how long a connection must last, if no data moves on
+// it, before the tunnel counts as up. The relay client gives no signal once
+// its handshake is done, but a failed dial returns well within this.
+const tunnelSettleTime = 2 * time.Second
+
+// errReconnect ends a connection dropped by Reconnect.
+var errReconnect = errors.New("reconnect requested")
+
 // EndpointFactory creates a fresh LocalEndpoint for each tunnel connection attempt.
 type EndpointFactory func() (client.LocalEndpoint, error)
 
 // TunnelManager handles WebSocket tunnel lifecycle with reconnection
 type TunnelManager struct {
-	serverHost      string
-	wsPath          string
+	server          func() string                       // base server URL, looked up on every connection attempt
+	relayPath       func(server string) (string, error) // relay path on server, looked up on every connection attempt
 	tunnelID        string
-	wsScheme        string
 	label           string
+	entry           data.TunnelEntry // what the tunnel was started for; zero for link probes
 	endpointFactory EndpointFactory
+	transport       func() (*MuxTransport, error) // nil for a WebSocket of its own
+	priority        data.TunnelPriority           // of the stream on transport
 	cancel          context.CancelFunc
+	done            chan struct{} // closed once the tunnel has fully shut down
+	kick            chan struct{} // cuts a reconnect wait short
 
 	maxRetries int
 	baseDelay  time.Duration
 	maxDelay   time.Duration
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	healthMu    sync.Mutex
+	state       string
+	attempt     int // connection attempts so far
+	startedAt   time.Time
+	connectedAt time.Time // zero unless up
+	uptime      time.Duration
+	lastError   string
+	lastErrorAt time.Time
+	reconnect   context.CancelFunc // ends the current connection attempt
 }
 
 // NewTunnelManager creates a new tunnel manager instance
-func NewTunnelManager(serverHost, wsPath, tunnelID, label string, factory EndpointFactory, cancel context.CancelFunc) *TunnelManager {
+func NewTunnelManager(server func() string, relayPath func(string) (string, error), tunnelID, label string, factory EndpointFactory, cancel context.CancelFunc) *TunnelManager {
 	return &TunnelManager{
-		serverHost:      serverHost,
-		wsPath:          wsPath,
-		wsScheme:        "ws",
+		server:          server,
+		relayPath:       relayPath,
 		tunnelID:        tunnelID,
 		label:           label,
 		endpointFactory: factory,
 		cancel:          cancel,
+		done:            make(chan struct{}),
+		kick:            make(chan struct{}, 1),
 		maxRetries:      -1, // infinite retries
 		baseDelay:       2 * time.Second,
 		maxDelay:        2 * time.Minute,
+		state:           data.TunnelStateConnecting,
+		startedAt:       time.Now(),
 	}
 }
 
@@ -48,6 +82,26 @@ func (tm *TunnelManager) Stop() {
 	tm.cancel()
 }
 
+// Reconnect drops the current connection, or cuts a reconnect wait short, so
+// the tunnel connects again right away, to whichever server is then in use.
+func (tm *TunnelManager) Reconnect() {
+	tm.healthMu.Lock()
+	reconnect := tm.reconnect
+	tm.healthMu.Unlock()
+	if reconnect != nil {
+		reconnect()
+	}
+	select {
+	case tm.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Done returns a channel that is closed once the tunnel has fully shut down.
+func (tm *TunnelManager) Done() <-chan struct{} {
+	return tm.done
+}
+
 // Start begins the tunnel connection with automatic reconnection
 func (tm *TunnelManager) Start(ctx context.Context) {
 	slog.Info("starting tunnel", "label", tm.label, "id", tm.tunnelID)
@@ -60,21 +114,23 @@ func (tm *TunnelManager) Start(ctx context.Context) {
 			slog.Info("tunnel shutting down", "label", tm.label, "id", tm.tunnelID)
 			return
 		default:
-			tunConfig := client.TunnelConfig{
-				Topic:  tm.tunnelID,
-				Host:   tm.serverHost,
-				Path:   tm.wsPath,
-				Scheme: tm.wsScheme,
-			}
 			ep, err := tm.endpointFactory()
 			if err != nil {
+				tm.recordError(err)
 				slog.Error("endpoint creation failed, shutting down tunnel", "label", tm.label, "id", tm.tunnelID, "error", err)
 				return
 			}
 
-			if err := client.CreateWebSocketTunnel(ctx, tunConfig, ep); err != nil {
+			err = tm.run(ctx, ep)
+			if errors.Is(err, errReconnect) {
+				retryCount = 0
+				slog.Info("tunnel reconnecting", "label", tm.label, "id", tm.tunnelID)
+				continue
+			}
+			if err != nil {
 				retryCount++
 				delay := tm.calculateBackoff(retryCount)
+				tm.recordError(err)
 
 				slog.Warn("tunnel error, reconnecting",
 					"label", tm.label,
@@ -87,6 +143,8 @@ func (tm *TunnelManager) Start(ctx context.Context) {
 				select {
 				case <-time.After(delay):
 					continue
+				case <-tm.kick:
+					continue
 				case <-ctx.Done():
 					slog.Info("tunnel shutting down during reconnect wait", "label", tm.label, "id", tm.tunnelID)
 					return
@@ -108,6 +166,141 @@ func (tm *TunnelManager) Start(ctx context.Context) {
 	}
 }
 
+// run makes one connection attempt and tracks its health. The tunnel is in
+// backoff once it returns.
+func (tm *TunnelManager) run(ctx context.Context, ep client.LocalEndpoint) error {
+	attemptCtx, reconnect := context.WithCancel(ctx)
+	defer reconnect()
+
+	tm.healthMu.Lock()
+	tm.attempt++
+	attempt := tm.attempt
+	tm.state = data.TunnelStateConnecting
+	tm.reconnect = reconnect
+	tm.healthMu.Unlock()
+
+	select {
+	case <-tm.kick: // this attempt already uses the latest server
+	default:
+	}
+	server := tm.server()
+	cfg := client.TunnelConfig{
+		Topic:  tm.tunnelID,
+		Host:   web.CleanServerURL(server),
+		Scheme: "ws",
+	}
+	if strings.Contains(server, "https") {
+		cfg.Scheme = "wss"
+	}
+
+	var err error
+	if tm.transport == nil {
+		cfg.Path, err = tm.relayPath(server)
+	}
+	if err == nil {
+		settled := time.AfterFunc(tunnelSettleTime, func() { tm.markUp(attempt) })
+		err = tm.connect(attemptCtx, cfg, &countingEndpoint{LocalEndpoint: ep, tm: tm, attempt: attempt})
+		settled.Stop()
+	} else {
+		ep.Close()
+	}
+
+	tm.healthMu.Lock()
+	if !tm.connectedAt.IsZero() {
+		tm.uptime += time.Since(tm.connectedAt)
+		tm.connectedAt = time.Time{}
+	}
+	tm.state = data.TunnelStateBackoff
+	tm.reconnect = nil
+	tm.healthMu.Unlock()
+
+	if attemptCtx.Err() != nil && ctx.Err() == nil {
+		return errReconnect
+	}
+	return err
+}
+
+// markUp records that connection attempt is up, unless it already ended.
+func (tm *TunnelManager) markUp(attempt int) {
+	tm.healthMu.Lock()
+	defer tm.healthMu.Unlock()
+	if tm.attempt == attempt && tm.state == data.TunnelStateConnecting {
+		tm.state = data.TunnelStateUp
+		tm.connectedAt = time.Now()
+	}
+}
+
+func (tm *TunnelManager) recordError(err error) {
+	tm.healthMu.Lock()
+	tm.lastError, tm.lastErrorAt = err.Error(), time.Now()
+	tm.healthMu.Unlock()
+}
+
+// Health returns the tunnel's current state and counters.
+func (tm *TunnelManager) Health() data.TunnelHealth {
+	tm.healthMu.Lock()
+	defer tm.healthMu.Unlock()
+
+	uptime := tm.uptime
+	h := data.TunnelHealth{
+		ID:         tm.tunnelID,
+		Label:      tm.label,
+		State:      tm.state,
+		StartedAt:  tm.startedAt.Unix(),
+		Reconnects: max(tm.attempt-1, 0),
+		BytesIn:    tm.bytesIn.Load(),
+		BytesOut:   tm.bytesOut.Load(),
+		LastError:  tm.lastError,
+	}
+	if !tm.connectedAt.IsZero() {
+		h.ConnectedAt = tm.connectedAt.Unix()
+		uptime += time.Since(tm.connectedAt)
+	}
+	h.UptimeSec = int64(uptime / time.Second)
+	if !tm.lastErrorAt.IsZero() {
+		h.LastErrorAt = tm.lastErrorAt.Unix()
+	}
+	return h
+}
+
+// countingEndpoint counts the bytes moving through a tunnel connection and
+// marks it up once data flows.
+type countingEndpoint struct {
+	client.LocalEndpoint
+	tm      *TunnelManager
+	attempt int
+}
+
+func (e *countingEndpoint) Read(p []byte) (int, error) {
+	n, err := e.LocalEndpoint.Read(p)
+	if n > 0 {
+		e.tm.bytesOut.Add(int64(n))
+	}
+	return n, err
+}
+
+func (e *countingEndpoint) Write(p []byte) (int, error) {
+	n, err := e.LocalEndpoint.Write(p)
+	if n > 0 {
+		e.tm.bytesIn.Add(int64(n))
+		e.tm.markUp(e.attempt)
+	}
+	return n, err
+}
+
+// connect runs one tunnel connection, over the shared transport if there is one.
+func (tm *TunnelManager) connect(ctx context.Context, cfg client.TunnelConfig, ep client.LocalEndpoint) error {
+	if tm.transport != nil {
+		transport, err := tm.transport()
+		if err != nil {
+			ep.Close()
+			return err
+		}
+		return transport.Tunnel(ctx, cfg.Topic, tm.priority, ep)
+	}
+	return client.CreateWebSocketTunnel(ctx, cfg, ep)
+}
+
 // calculateBackoff implements exponential backoff with jitter
 func (tm *TunnelManager) calculateBackoff(retryCount int) time.Duration {
 	delay := tm.baseDelay * time.Duration(1<<uint(retryCount-1))
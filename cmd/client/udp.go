@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// maxDatagramSize is the largest UDP payload over IPv4.
+const maxDatagramSize = 65507
+
+// UDPEndpoint relays datagrams between a local UDP port and a tunnel. The
+// tunnel sends each Read as one WebSocket message and writes each message it
+// receives with a single Write, so returning exactly one datagram per Read and
+// sending one per Write keeps datagram boundaries intact end to end.
+//
+// It listens on the port and replies to whoever sent the most recent
+// datagram, which fits local producers such as a MAVLink UDP output or an RTP
+// video sender.
+//
+// An endpoint created with DialUDPEndpoint instead exchanges datagrams with a
+// fixed remote host, such as a camera on the drone's LAN.
+type UDPEndpoint struct {
+	conn      *net.UDPConn
+	connected bool // conn was dialed and only talks to its remote address
+	buf       []byte
+	rest      []byte // unread tail of a datagram larger than the caller's buffer
+
+	mu   sync.Mutex
+	peer *net.UDPAddr
+}
+
+// NewUDPEndpoint listens on host:port for local datagrams.
+func NewUDPEndpoint(host, port string) (*UDPEndpoint, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("resolve udp address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen udp: %w", err)
+	}
+	return &UDPEndpoint{conn: conn, buf: make([]byte, maxDatagramSize)}, nil
+}
+
+// DialUDPEndpoint exchanges datagrams with host:port.
+func DialUDPEndpoint(host, port string) (*UDPEndpoint, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("resolve udp address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial udp: %w", err)
+	}
+	return &UDPEndpoint{conn: conn, connected: true, buf: make([]byte, maxDatagramSize)}, nil
+}
+
+// Read returns the next datagram. A datagram larger than p is returned over
+// several reads and therefore arrives split on the other side.
+func (e *UDPEndpoint) Read(p []byte) (int, error) {
+	if len(e.rest) > 0 {
+		n := copy(p, e.rest)
+		e.rest = e.rest[n:]
+		return n, nil
+	}
+
+	n, addr, err := e.conn.ReadFromUDP(e.buf)
+	for e.connected && errors.Is(err, syscall.ECONNREFUSED) {
+		// The remote host has nothing listening yet; keep waiting for it.
+		n, addr, err = e.conn.ReadFromUDP(e.buf)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	e.peer = addr
+	e.mu.Unlock()
+
+	copied := copy(p, e.buf[:n])
+	if copied < n {
+		slog.Warn("udp datagram larger than tunnel buffer, splitting", "size", n, "buffer", len(p))
+		e.rest = e.buf[copied:n]
+	}
+	return copied, nil
+}
+
+// Write sends p as one datagram to the remote host, or for a listening
+// endpoint to the most recent local sender. Until a local sender has been seen
+// there is nowhere to deliver it, so it is dropped.
+func (e *UDPEndpoint) Write(p []byte) (int, error) {
+	if e.connected {
+		if _, err := e.conn.Write(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	e.mu.Lock()
+	peer := e.peer
+	e.mu.Unlock()
+
+	if peer == nil {
+		return len(p), nil
+	}
+	if _, err := e.conn.WriteToUDP(p, peer); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close stops listening.
+func (e *UDPEndpoint) Close() error {
+	return e.conn.Close()
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Version is the agent version, set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+const (
+	updateStatePending    = "pending"
+	updateStateRolledBack = "rolled_back"
+
+	// maxUpdateAttempts is how many times a new version may start without
+	// checking in before it is rolled back, so a crash loop does not wait out
+	// the whole check-in timeout.
+	maxUpdateAttempts = 3
+)
+
+// errRestart is returned by Run when the agent should re-exec its binary.
+var errRestart = errors.New("agent restart requested")
+
+// pendingUpdate is persisted next to the binary while a new version is on
+// probation, so the new process can commit it and the old one can report a
+// rollback.
+type pendingUpdate struct {
+	CommandID       primitive.ObjectID `json:"command_id"`
+	Version         string             `json:"version"`
+	PreviousVersion string             `json:"previous_version"`
+	Deadline        int64              `json:"deadline"` // unix seconds
+	Attempts        int                `json:"attempts"`
+	State           string             `json:"state"`
+	Error           string             `json:"error,omitempty"`
+}
+
+// agentArch returns the architecture name used for release binaries, matching `uname -m`.
+func agentArch() string {
+	switch runtime.GOARCH {
+	case "arm":
+		return "armv7l"
+	case "arm64":
+		return "aarch64"
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i686"
+	default:
+		return runtime.GOARCH
+	}
+}
+
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate executable: %w", err)
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func updateStatePath(exe string) string  { return exe + ".update.json" }
+func updateBackupPath(exe string) string { return exe + ".old" }
+
+// updateAgent downloads and verifies the requested version, swaps it in for
+// the running binary and asks Run to restart. The command result is reported
+// by the new version once it checks in, or by this version after a rollback.
+func (d *Dronnayak) updateAgent(ctx context.Context, id primitive.ObjectID, upd data.AgentUpdate) error {
+	if !d.updating.CompareAndSwap(false, true) {
+		return fmt.Errorf("an update is already in progress")
+	}
+	defer d.updating.Store(false)
+
+	if upd.Version == "" || upd.URL == "" {
+		return fmt.Errorf("version and url are required")
+	}
+	if upd.Version == Version {
+		return fmt.Errorf("already running version %s", Version)
+	}
+
+	arch := agentArch()
+	checksum, ok := upd.SHA256[arch]
+	if !ok {
+		return fmt.Errorf("no checksum for architecture %s", arch)
+	}
+	want, err := hex.DecodeString(strings.TrimSpace(checksum))
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("invalid sha256 checksum for %s", arch)
+	}
+
+	exe, err := executablePath()
+	if err != nil {
+		return err
+	}
+
+	url := strings.ReplaceAll(upd.URL, "{arch}", arch)
+	slog.Info("downloading agent update", "version", upd.Version, "url", url)
+
+	newPath := exe + ".new"
+	defer os.Remove(newPath)
+
+	digest, err := downloadFile(ctx, url, newPath)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(digest, want) != 1 {
+		return fmt.Errorf("checksum mismatch: got %x", digest)
+	}
+
+	cfg := d.currentConfig().Update
+	if err := verifyUpdateSignature(cfg.PublicKey, upd.Signatures[arch], digest); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(newPath, 0755); err != nil {
+		return fmt.Errorf("failed to make update executable: %w", err)
+	}
+
+	// Make sure the binary runs on this device before replacing anything.
+	checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	out, err := exec.CommandContext(checkCtx, newPath, "-version").Output()
+	cancel()
+	if err != nil {
+		return fmt.Errorf("new binary failed to run: %w", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != upd.Version {
+		return fmt.Errorf("new binary reports version %q, expected %q", got, upd.Version)
+	}
+
+	backup := updateBackupPath(exe)
+	os.Remove(backup)
+	if err := os.Link(exe, backup); err != nil {
+		if err := copyFile(exe, backup); err != nil {
+			return fmt.Errorf("failed to back up current binary: %w", err)
+		}
+	}
+
+	state := &pendingUpdate{
+		CommandID:       id,
+		Version:         upd.Version,
+		PreviousVersion: Version,
+		Deadline:        time.Now().Add(cfg.CheckInTimeout).Unix(),
+		State:           updateStatePending,
+	}
+	if err := saveUpdateState(exe, state); err != nil {
+		return err
+	}
+
+	if err := os.Rename(newPath, exe); err != nil {
+		os.Remove(updateStatePath(exe))
+		return fmt.Errorf("failed to install new binary: %w", err)
+	}
+
+	slog.Info("agent update installed, restarting", "version", upd.Version, "previous_version", Version)
+	d.requestRestart()
+	return nil
+}
+
+// downloadFile writes url to path and returns the SHA-256 of its contents.
+func downloadFile(ctx context.Context, url, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid update url: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download update: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("update download returned status %d", resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create update file: %w", err)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download update: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyUpdateSignature checks signature over digest when a public key is
+// configured. Without a key, updates are verified by checksum only.
+func verifyUpdateSignature(publicKey, signature string, digest []byte) error {
+	if publicKey == "" {
+		if signature != "" {
+			slog.Warn("update is signed but no public key is configured, skipping signature check")
+		}
+		return nil
+	}
+	if signature == "" {
+		return fmt.Errorf("update is not signed")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid update public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid update signature encoding: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), digest, sig) {
+		return fmt.Errorf("update signature verification failed")
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func loadUpdateState(exe string) (*pendingUpdate, error) {
+	b, err := os.ReadFile(updateStatePath(exe))
+	if err != nil {
+		return nil, err
+	}
+	var state pendingUpdate
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode update state: %w", err)
+	}
+	return &state, nil
+}
+
+func saveUpdateState(exe string, state *pendingUpdate) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode update state: %w", err)
+	}
+	path := updateStatePath(exe)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("failed to write update state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write update state: %w", err)
+	}
+	return nil
+}
+
+// resumeAgentUpdate inspects the update state left by a previous run. It
+// returns the update this version is on probation for, or the result of an
+// update that was rolled back so it can be reported. A new version that has
+// run out of attempts or time is rolled back here and does not return.
+func resumeAgentUpdate() (*pendingUpdate, *data.CommandResult) {
+	exe, err := executablePath()
+	if err != nil {
+		slog.Warn("cannot check for pending agent update", "error", err)
+		return nil, nil
+	}
+
+	state, err := loadUpdateState(exe)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		slog.Warn("discarding unreadable agent update state", "error", err)
+		os.Remove(updateStatePath(exe))
+		return nil, nil
+	}
+
+	if state.State == updateStateRolledBack || state.Version != Version {
+		// Running the previous version again: the update did not stick.
+		os.Remove(updateStatePath(exe))
+		reason := state.Error
+		if reason == "" {
+			reason = "new version did not start"
+		}
+		slog.Warn("agent update was rolled back", "version", state.Version, "running", Version, "reason", reason)
+		return nil, &data.CommandResult{
+			ID:         state.CommandID,
+			Error:      fmt.Sprintf("rolled back to %s: %s", Version, reason),
+			ExecutedAt: time.Now(),
+		}
+	}
+
+	state.Attempts++
+	switch {
+	case state.Attempts > maxUpdateAttempts:
+		err = rollbackAgent(exe, state, fmt.Sprintf("failed to check in after %d starts", maxUpdateAttempts))
+	case time.Now().Unix() > state.Deadline:
+		err = rollbackAgent(exe, state, "check-in timeout expired")
+	default:
+		if err := saveUpdateState(exe, state); err != nil {
+			slog.Warn("failed to record agent update attempt", "error", err)
+		}
+		slog.Info("agent update on probation", "version", Version, "previous_version", state.PreviousVersion, "attempt", state.Attempts)
+		return state, nil
+	}
+
+	if err == nil {
+		err = restartAgent()
+	}
+	slog.Error("agent rollback failed, continuing with new version", "error", err)
+	return nil, nil
+}
+
+// rollbackAgent restores the previous binary and records why. The caller
+// restarts the agent afterwards.
+func rollbackAgent(exe string, state *pendingUpdate, reason string) error {
+	slog.Error("rolling back agent update", "version", state.Version, "previous_version", state.PreviousVersion, "reason", reason)
+
+	if err := os.Rename(updateBackupPath(exe), exe); err != nil {
+		return fmt.Errorf("failed to restore previous binary: %w", err)
+	}
+	state.State = updateStateRolledBack
+	state.Error = reason
+	return saveUpdateState(exe, state)
+}
+
+// superviseUpdate commits the update once this version has checked in with
+// the server, or rolls it back when the deadline passes.
+func (d *Dronnayak) superviseUpdate(ctx context.Context, state *pendingUpdate) {
+	exe, err := executablePath()
+	if err != nil {
+		slog.Error("cannot supervise agent update", "error", err)
+		return
+	}
+
+	deadline := time.NewTimer(time.Until(time.Unix(state.Deadline, 0)))
+	defer deadline.Stop()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !d.updateCheckIn() {
+				continue
+			}
+			os.Remove(updateStatePath(exe))
+			os.Remove(updateBackupPath(exe))
+			slog.Info("agent update committed", "version", Version, "previous_version", state.PreviousVersion)
+			d.recordCommandResult(state.CommandID, nil)
+			return
+
+		case <-deadline.C:
+			if err := rollbackAgent(exe, state, "check-in timeout expired"); err != nil {
+				slog.Error("agent rollback failed, continuing with new version", "error", err)
+				return
+			}
+			d.requestRestart()
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateCheckIn reports whether this version has reached the server: a
+// delivered status report, or a config fetch when stats are disabled.
+func (d *Dronnayak) updateCheckIn() bool {
+	if d.checkedIn.Load() {
+		return true
+	}
+	cfg := d.currentConfig()
+	if cfg.Stats.Enabled {
+		return false
+	}
+	_, err := data.LoadConfigV2(d.serverURL(), cfg.UUID, d.credential.Token())
+	return err == nil
+}
+
+// requestRestart makes Run shut down and return errRestart.
+func (d *Dronnayak) requestRestart() {
+	select {
+	case d.restartCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/gowsrelay/server"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	enrollmentTTL  = 24 * time.Hour
+	relayTicketTTL = 30 * time.Second
+
+	// relayTokenHeader carries relayInternalToken on the server's own relay connections.
+	relayTokenHeader = "X-Relay-Token"
+)
+
+var (
+	errMissingCredential = errors.New("missing device credential")
+	errInvalidCredential = errors.New("invalid device credential")
+)
+
+// deviceAuthPermissive lets drones with no credential on record through, so a
+// fleet can be upgraded before every drone is re-enrolled. An operator can
+// issue such a drone its first credential with a rotate_credential command,
+// which then carries the token; see firstCredentialPayload. Set with
+// DEVICE_AUTH=permissive.
+var deviceAuthPermissive bool
+
+// relayInternalToken lets the server's own connections subscribe to the relay.
+var relayInternalToken = newSecret()
+
+// newSecret returns 32 random bytes, base64url encoded.
+func newSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newCredential returns a credential to store and the token the drone presents for it.
+func newCredential() (data.DeviceCredential, string) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	cred := data.DeviceCredential{ID: hex.EncodeToString(id), CreatedAt: time.Now()}
+	secret := newSecret()
+	cred.Hash = hashSecret(secret)
+	return cred, cred.ID + "." + secret
+}
+
+// bearerToken returns the token in the request's Authorization header.
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticateDevice checks the request's credential against the drone's.
+// The first use of a credential drops any older ones, which completes a
+// rotation.
+func authenticateDevice(r *http.Request, droneID string) error {
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		return errInvalidCredential
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		if deviceAuthPermissive && len(drone.Credentials) == 0 {
+			return nil
+		}
+		return errMissingCredential
+	}
+
+	id, secret, _ := strings.Cut(token, ".")
+	hash := hashSecret(secret)
+	for _, cred := range drone.Credentials {
+		if cred.ID != id || subtle.ConstantTimeCompare([]byte(cred.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		var current []data.DeviceCredential
+		for _, c := range drone.Credentials {
+			if !c.CreatedAt.Before(cred.CreatedAt) {
+				current = append(current, c)
+			}
+		}
+		if len(current) < len(drone.Credentials) {
+			if err := data.UpdateOne("drone", map[string]interface{}{"uid": droneID}, map[string]interface{}{"credentials": current}); err != nil {
+				slog.Warn("failed to drop rotated credentials", "drone_id", droneID, "error", err)
+			} else {
+				slog.Info("credential rotation completed", "drone_id", droneID, "credential_id", cred.ID)
+			}
+		}
+		return nil
+	}
+	return errInvalidCredential
+}
+
+// DeviceAuth rejects requests that do not carry one of the {drone_id}'s credentials.
+func DeviceAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		droneID := chi.URLParam(r, "drone_id")
+		if err := authenticateDevice(r, droneID); err != nil {
+			slog.Warn("unauthenticated device request", "drone_id", droneID, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DeviceOrSessionAuth is DeviceAuth for device endpoints the web UI reads too.
+func DeviceOrSessionAuth(next http.Handler) http.Handler {
+	device := DeviceAuth(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) == "" && GetUserIDFromSession(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		device.ServeHTTP(w, r)
+	})
+}
+
+// issueEnrollment replaces the drone's enrollment token and returns it.
+func issueEnrollment(droneID string) (string, error) {
+	token := newSecret()
+	enrollment := data.DeviceEnrollment{Hash: hashSecret(token), ExpiresAt: time.Now().Add(enrollmentTTL)}
+	if err := data.UpdateOne("drone", map[string]interface{}{"uid": droneID}, map[string]interface{}{"enrollment": enrollment}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// validEnrollment reports whether token is the drone's unexpired enrollment token.
+func validEnrollment(drone data.Drone, token string) bool {
+	e := drone.Enrollment
+	return e != nil && token != "" && time.Now().Before(e.ExpiresAt) &&
+		subtle.ConstantTimeCompare([]byte(e.Hash), []byte(hashSecret(token))) == 1
+}
+
+// enrollDevice exchanges an enrollment token for a new credential, which
+// replaces any the drone had. The token can only be used once.
+//
+// POST /device/{drone_id}/enroll (Authorization: Bearer <enrollment token>)
+func enrollDevice(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil || !validEnrollment(drone, bearerToken(r)) {
+		slog.Warn("rejected device enrollment", "drone_id", droneID, "remote_addr", r.RemoteAddr)
+		http.Error(w, "invalid or expired enrollment token", http.StatusUnauthorized)
+		return
+	}
+
+	cred, token := newCredential()
+	update := map[string]interface{}{"credentials": []data.DeviceCredential{cred}, "enrollment": nil}
+	if err := data.UpdateOne("drone", map[string]interface{}{"uid": droneID}, update); err != nil {
+		slog.Error("failed to enroll device", "drone_id", droneID, "error", err)
+		http.Error(w, "failed to enroll device", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("device enrolled", "drone_id", droneID, "credential_id", cred.ID)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+}
+
+// rotateCredential issues the drone an additional credential. The one it
+// authenticated with stays valid until the new one is first used, so a drone
+// that fails to save the new credential is not locked out; credentials from
+// earlier unfinished rotations are dropped. Drones without a credential get
+// their first one from an enrollment or a rotate_credential command instead.
+//
+// POST /device/{drone_id}/credentials (device credential)
+func rotateCredential(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	if bearerToken(r) == "" {
+		http.Error(w, errMissingCredential.Error(), http.StatusUnauthorized)
+		return
+	}
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		http.Error(w, "drone not found", http.StatusNotFound)
+		return
+	}
+
+	usedID, _, _ := strings.Cut(bearerToken(r), ".")
+	var kept []data.DeviceCredential
+	for _, c := range drone.Credentials {
+		if c.ID == usedID {
+			kept = append(kept, c)
+		}
+	}
+	cred, token := newCredential()
+	kept = append(kept, cred)
+	if err := data.UpdateOne("drone", map[string]interface{}{"uid": droneID}, map[string]interface{}{"credentials": kept}); err != nil {
+		slog.Error("failed to rotate credential", "drone_id", droneID, "error", err)
+		http.Error(w, "failed to rotate credential", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("credential issued", "drone_id", droneID, "credential_id", cred.ID, "replaces", usedID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": cred.ID, "token": token})
+}
+
+// firstCredentialPayload issues a drone with no credential its first one and
+// returns the rotate_credential payload that delivers the token. It is only
+// called while delivering a command an operator queued, so the credential
+// goes out once, on the status response, never on request.
+func firstCredentialPayload(droneID string) (json.RawMessage, error) {
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		return nil, err
+	}
+	if len(drone.Credentials) > 0 {
+		return nil, errors.New("drone already has a credential")
+	}
+	cred, token := newCredential()
+	if err := data.UpdateOne("drone", map[string]interface{}{"uid": droneID}, map[string]interface{}{"credentials": []data.DeviceCredential{cred}}); err != nil {
+		return nil, err
+	}
+	slog.Info("first credential issued", "drone_id", droneID, "credential_id", cred.ID)
+	return json.Marshal(map[string]string{"id": cred.ID, "token": token})
+}
+
+// revokeCredential deletes one of the drone's credentials. Requests made with
+// it are rejected from then on, and connections opened with it are closed.
+//
+// DELETE /device/{drone_id}/credentials/{credential_id}
+func revokeCredential(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	credID := chi.URLParam(r, "credential_id")
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		http.Error(w, "drone not found", http.StatusNotFound)
+		return
+	}
+
+	var kept []data.DeviceCredential
+	for _, c := range drone.Credentials {
+		if c.ID != credID {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(drone.Credentials) {
+		http.Error(w, "credential not found", http.StatusNotFound)
+		return
+	}
+	if err := data.UpdateOne("drone", map[string]interface{}{"uid": droneID}, map[string]interface{}{"credentials": kept}); err != nil {
+		slog.Error("failed to revoke credential", "drone_id", droneID, "error", err)
+		http.Error(w, "failed to revoke credential", http.StatusInternalServerError)
+		return
+	}
+	closed := closeDeviceConns(droneID, credID)
+	slog.Info("credential revoked", "drone_id", droneID, "credential_id", credID, "closed_connections", closed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// credentialID returns the ID of the credential the request carries, if any.
+func credentialID(r *http.Request) string {
+	id, _, _ := strings.Cut(bearerToken(r), ".")
+	return id
+}
+
+// deviceConns holds the long-lived connections drones opened, by drone UID,
+// so revoking a credential can close the ones authenticated with it.
+var deviceConns = struct {
+	sync.Mutex
+	m map[string]map[*deviceConn]struct{}
+}{m: make(map[string]map[*deviceConn]struct{})}
+
+type deviceConn struct {
+	credID string
+	close  func() error
+}
+
+// trackDeviceConn registers a connection the drone opened with credential
+// credID. The returned func unregisters it.
+func trackDeviceConn(droneID, credID string, close func() error) func() {
+	c := &deviceConn{credID: credID, close: close}
+	deviceConns.Lock()
+	if deviceConns.m[droneID] == nil {
+		deviceConns.m[droneID] = make(map[*deviceConn]struct{})
+	}
+	deviceConns.m[droneID][c] = struct{}{}
+	deviceConns.Unlock()
+
+	return func() {
+		deviceConns.Lock()
+		defer deviceConns.Unlock()
+		delete(deviceConns.m[droneID], c)
+		if len(deviceConns.m[droneID]) == 0 {
+			delete(deviceConns.m, droneID)
+		}
+	}
+}
+
+// closeDeviceConns closes the drone's connections opened with credential
+// credID and returns how many there were.
+func closeDeviceConns(droneID, credID string) int {
+	deviceConns.Lock()
+	var conns []*deviceConn
+	for c := range deviceConns.m[droneID] {
+		if c.credID == credID {
+			conns = append(conns, c)
+		}
+	}
+	deviceConns.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+	return len(conns)
+}
+
+// hijackTracker passes the connection a handler hijacks to track, for
+// handlers such as the relay's that upgrade the connection themselves.
+type hijackTracker struct {
+	http.ResponseWriter
+	track func(net.Conn)
+}
+
+func (h hijackTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err == nil {
+		h.track(conn)
+	}
+	return conn, rw, err
+}
+
+// relayTickets are single-use passes for publishing to a drone's relay
+// topics. The relay keeps its topics in memory, so a ticket is redeemed by
+// the same server process that issued it.
+var relayTickets = struct {
+	sync.Mutex
+	m map[string]relayTicket
+}{m: make(map[string]relayTicket)}
+
+type relayTicket struct {
+	droneID string
+	credID  string // credential the ticket was issued to, "" for the server's own producers
+	expires time.Time
+}
+
+func issueRelayTicket(droneID, credID string) string {
+	ticket := newSecret()
+	now := time.Now()
+	relayTickets.Lock()
+	defer relayTickets.Unlock()
+	for t, rt := range relayTickets.m {
+		if now.After(rt.expires) {
+			delete(relayTickets.m, t)
+		}
+	}
+	relayTickets.m[ticket] = relayTicket{droneID: droneID, credID: credID, expires: now.Add(relayTicketTTL)}
+	return ticket
+}
+
+// redeemRelayTicket uses up ticket and returns the credential it was issued to.
+func redeemRelayTicket(ticket, droneID string) (string, bool) {
+	relayTickets.Lock()
+	defer relayTickets.Unlock()
+	rt, ok := relayTickets.m[ticket]
+	delete(relayTickets.m, ticket)
+	return rt.credID, ok && rt.droneID == droneID && time.Now().Before(rt.expires)
+}
+
+// relayPath returns the relay path a producer for droneID connects to.
+func relayPath(droneID, ticket string) string {
+	return "/device/" + droneID + "/ws/" + ticket
+}
+
+// deviceRelayTicket issues a ticket for the drone's next relay connection.
+//
+// POST /device/{drone_id}/relay-ticket (device credential)
+func deviceRelayTicket(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	ticket := issueRelayTicket(droneID, credentialID(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ticket": ticket, "path": relayPath(droneID, ticket)})
+}
+
+// deviceRelay admits a producer holding a relay ticket to the drone's own
+// topics on the relay.
+//
+// GET /device/{drone_id}/ws/{ticket}?role=producer&topic=<droneUID>_<label> (WebSocket)
+func deviceRelay(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	credID, ok := redeemRelayTicket(chi.URLParam(r, "ticket"), droneID)
+	if !ok {
+		slog.Warn("rejected relay connection: invalid ticket", "drone_id", droneID, "remote_addr", r.RemoteAddr)
+		http.Error(w, "invalid or expired relay ticket", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("role") == "subscriber" || !strings.HasPrefix(q.Get("topic"), droneID+"_") {
+		http.Error(w, "drones may only publish to their own topics", http.StatusForbidden)
+		return
+	}
+
+	var untrack func()
+	defer func() {
+		if untrack != nil {
+			untrack()
+		}
+	}()
+	server.HandleWebSocket(hijackTracker{ResponseWriter: w, track: func(conn net.Conn) {
+		untrack = trackDeviceConn(droneID, credID, conn.Close)
+	}}, r)
+}
+
+// relayAuth guards the relay's own endpoints, /ws and /tcp: subscribers must be signed in or
+// be the server itself, and drones publish through deviceRelay. Only the
+// server subscribes to cmd and pty topics, so every shell session goes
+// through rceSession and is recorded.
+func relayAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("role") == "subscriber" {
+			internal := subtle.ConstantTimeCompare([]byte(r.Header.Get(relayTokenHeader)), []byte(relayInternalToken)) == 1
+			if !internal && GetUserIDFromSession(r) == "" {
+				http.Error(w, "sign in to subscribe to the relay", http.StatusUnauthorized)
+				return
+			}
+			if !internal && execTopic(q.Get("topic")) {
+				slog.Warn("rejected direct subscription to a shell topic", "topic", q.Get("topic"), "user", GetUserIDFromSession(r))
+				http.Error(w, "open shells from the drone's RCE page", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Drones without a credential on record may still publish here while
+		// device auth is permissive.
+		if !deviceAuthPermissive || !legacyProducer(r, q.Get("topic")) {
+			slog.Warn("rejected unauthenticated relay producer", "topic", q.Get("topic"), "remote_addr", r.RemoteAddr)
+			http.Error(w, "publish through /device/{drone_id}/ws with a relay ticket", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// legacyProducer reports whether topic belongs to a drone that may connect
+// without a credential. Drone UIDs may contain "_", so every prefix of topic
+// ending before one is tried.
+func legacyProducer(r *http.Request, topic string) bool {
+	for i := strings.IndexByte(topic, '_'); i > 0; {
+		if authenticateDevice(r, topic[:i]) == nil {
+			return true
+		}
+		next := strings.IndexByte(topic[i+1:], '_')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
+
+// relayHeader returns the headers for the server's own relay connections.
+func relayHeader() http.Header {
+	return http.Header{relayTokenHeader: []string{relayInternalToken}}
+}
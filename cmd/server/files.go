@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	fileStageDir        = "file-transfers"
+	fileChunkSize       = 64 << 10
+	fileUploadLimit     = 1 << 30
+	fileTransferRetries = 3
+	fileCallTimeout     = 2 * time.Minute // a checksum of a large file can take a while on a Pi
+)
+
+// pullLocks serialises pulls that share a staging file.
+var pullLocks sync.Map
+
+// remoteFileError is an error reported by the drone, as opposed to a
+// transport failure; retrying will not help.
+type remoteFileError struct{ msg string }
+
+func (e *remoteFileError) Error() string { return e.msg }
+
+// fileTunnel is a connection to a drone's file topic on the relay.
+type fileTunnel struct {
+	conn   *websocket.Conn
+	dec    *json.Decoder
+	prefix string // keeps our request IDs apart from other subscribers'
+	seq    int
+}
+
+func dialFileTunnel(ctx context.Context, serverBase, topic string) (*fileTunnel, error) {
+	wsURL, err := relaySubscriberURL(serverBase, topic)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, relayHeader())
+	if err != nil {
+		return nil, fmt.Errorf("dial relay: %w", err)
+	}
+	b := make([]byte, 6)
+	rand.Read(b)
+	return &fileTunnel{
+		conn:   conn,
+		dec:    json.NewDecoder(&wsStreamReader{conn: conn}),
+		prefix: hex.EncodeToString(b),
+	}, nil
+}
+
+func (t *fileTunnel) Close() error {
+	return t.conn.Close()
+}
+
+// call sends req and waits for its response, skipping responses to other
+// subscribers' requests.
+func (t *fileTunnel) call(req data.FileRequest) (data.FileResponse, error) {
+	t.seq++
+	req.ID = fmt.Sprintf("%s-%d", t.prefix, t.seq)
+
+	t.conn.SetWriteDeadline(time.Now().Add(fileCallTimeout))
+	if err := t.conn.WriteJSON(req); err != nil {
+		return data.FileResponse{}, fmt.Errorf("send %s: %w", req.Op, err)
+	}
+
+	t.conn.SetReadDeadline(time.Now().Add(fileCallTimeout))
+	for {
+		var resp data.FileResponse
+		if err := t.dec.Decode(&resp); err != nil {
+			return data.FileResponse{}, fmt.Errorf("receive %s: %w", req.Op, err)
+		}
+		if resp.ID != req.ID {
+			continue
+		}
+		if resp.Error != "" {
+			return resp, &remoteFileError{msg: resp.Error}
+		}
+		return resp, nil
+	}
+}
+
+// wsStreamReader reads the payloads of consecutive WebSocket messages as one
+// stream, since the tunnel does not preserve JSON value boundaries.
+type wsStreamReader struct {
+	conn *websocket.Conn
+	cur  io.Reader
+}
+
+func (r *wsStreamReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			_, rd, err := r.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			r.cur = rd
+		}
+		n, err := r.cur.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// withFileTunnel runs fn on a fresh connection, reconnecting and running it
+// again after transport failures. fn must pick up where the last attempt left off.
+func withFileTunnel(ctx context.Context, serverBase, topic string, fn func(t *fileTunnel) error) error {
+	var err error
+	for attempt := 1; attempt <= fileTransferRetries; attempt++ {
+		var t *fileTunnel
+		t, err = dialFileTunnel(ctx, serverBase, topic)
+		if err == nil {
+			err = fn(t)
+			t.Close()
+		}
+		var remote *remoteFileError
+		if err == nil || errors.As(err, &remote) || ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("file transfer interrupted, retrying", "topic", topic, "attempt", attempt, "error", err)
+	}
+	return err
+}
+
+// droneEndpointTopic returns the relay topic of the drone's first endpoint
+// of type typ.
+func droneEndpointTopic(r *http.Request, typ data.EndpointType) (string, data.Drone, error) {
+	droneID := chi.URLParam(r, "drone_id")
+	if !validUID.MatchString(droneID) {
+		return "", data.Drone{}, fmt.Errorf("invalid drone_id")
+	}
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		return "", drone, fmt.Errorf("drone not found")
+	}
+	for _, ep := range drone.DeviceConfig.Tunnel.Endpoints {
+		if ep.Type != typ {
+			continue
+		}
+		label := ep.Label
+		if label == "" {
+			label = string(ep.Type)
+		}
+		return drone.UID + "_" + label, drone, nil
+	}
+	return "", drone, fmt.Errorf("no %s endpoint is configured for this drone", typ)
+}
+
+// listDroneFiles lists a directory on the drone, or the transfer roots when
+// no path is given.
+//
+// GET /device/{drone_id}/files?path=/abs/dir
+func listDroneFiles(w http.ResponseWriter, r *http.Request) {
+	topic, _, err := droneEndpointTopic(r, data.EndpointTypeFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp data.FileResponse
+	err = withFileTunnel(r.Context(), getServerPath(r), topic, func(t *fileTunnel) error {
+		resp, err = t.call(data.FileRequest{Op: "list", Path: r.URL.Query().Get("path")})
+		return err
+	})
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	if resp.Entries == nil {
+		resp.Entries = []data.FileEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp.Entries)
+}
+
+// downloadDroneFile pulls a file from the drone into a staging file, resuming
+// an earlier interrupted pull of the same file, verifies its checksum and
+// serves it.
+//
+// GET /device/{drone_id}/files/download?path=/abs/file
+func downloadDroneFile(w http.ResponseWriter, r *http.Request) {
+	topic, drone, err := droneEndpointTopic(r, data.EndpointTypeFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	remotePath := r.URL.Query().Get("path")
+	if remotePath == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+
+	pathSum := sha256.Sum256([]byte(remotePath))
+	stage := filepath.Join(fileStageDir, drone.UID, hex.EncodeToString(pathSum[:8])+".pull")
+	if err := os.MkdirAll(filepath.Dir(stage), 0755); err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	mu, _ := pullLocks.LoadOrStore(stage, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	var size int64
+	var sum string
+	err = withFileTunnel(r.Context(), getServerPath(r), topic, func(t *fileTunnel) error {
+		stat, err := t.call(data.FileRequest{Op: "stat", Path: remotePath, Checksum: true})
+		if err != nil {
+			return err
+		}
+		size, sum = stat.Size, stat.SHA256
+		return pullFile(t, remotePath, stage, size, sum)
+	})
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	defer os.Remove(stage)
+	defer os.Remove(stage + ".json")
+
+	if got, err := stagedSHA256(stage); err != nil || got != sum {
+		slog.Error("pulled file failed verification", "drone_id", drone.UID, "path", remotePath, "expected", sum, "got", got, "error", err)
+		http.Error(w, "checksum mismatch, please retry", http.StatusBadGateway)
+		return
+	}
+	slog.Info("file pulled from drone", "drone_id", drone.UID, "path", remotePath, "size", size, "user", GetUserIDFromSession(r))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(remotePath)))
+	w.Header().Set("X-Checksum-SHA256", sum)
+	http.ServeFile(w, r, stage)
+}
+
+// pullFile reads remotePath into stage from where the last pull stopped. The
+// stage is only resumed if it belongs to the same version of the file.
+func pullFile(t *fileTunnel, remotePath, stage string, size int64, sum string) error {
+	type stageMeta struct {
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+	want := stageMeta{Path: remotePath, Size: size, SHA256: sum}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	var have stageMeta
+	if b, err := os.ReadFile(stage + ".json"); err != nil || json.Unmarshal(b, &have) != nil || have != want {
+		flags |= os.O_TRUNC
+		b, _ := json.Marshal(want)
+		if err := os.WriteFile(stage+".json", b, 0644); err != nil {
+			return fmt.Errorf("write stage metadata: %w", err)
+		}
+	}
+	f, err := os.OpenFile(stage, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("open stage: %w", err)
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	for offset < size {
+		chunk, err := t.call(data.FileRequest{Op: "read", Path: remotePath, Offset: offset, Length: fileChunkSize})
+		if err != nil {
+			return err
+		}
+		if len(chunk.Data) == 0 {
+			return &remoteFileError{msg: "file changed during transfer, please retry"}
+		}
+		if _, err := f.Write(chunk.Data); err != nil {
+			return fmt.Errorf("write stage: %w", err)
+		}
+		offset += int64(len(chunk.Data))
+	}
+	return nil
+}
+
+// uploadDroneFile receives a file from the browser and pushes it to the
+// drone into dir, resuming if the connection drops part way.
+//
+// POST /device/{drone_id}/files/upload?dir=/abs/dir (multipart field "file")
+func uploadDroneFile(w http.ResponseWriter, r *http.Request) {
+	topic, drone, err := droneEndpointTopic(r, data.EndpointTypeFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		http.Error(w, "missing dir", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, fileUploadLimit)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart upload", http.StatusBadRequest)
+		return
+	}
+	part, err := mr.NextPart()
+	if err != nil || part.FormName() != "file" {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+	name := part.FileName()
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	remotePath := path.Join(dir, name)
+
+	if err := os.MkdirAll(filepath.Join(fileStageDir, drone.UID), 0755); err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	stage, err := os.CreateTemp(filepath.Join(fileStageDir, drone.UID), "*.push")
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(stage.Name())
+	defer stage.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(stage, h), part)
+	if err != nil {
+		http.Error(w, "upload failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	err = withFileTunnel(r.Context(), getServerPath(r), topic, func(t *fileTunnel) error {
+		return pushFile(t, stage, remotePath, size, sum)
+	})
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	slog.Info("file pushed to drone", "drone_id", drone.UID, "path", remotePath, "size", size, "user", GetUserIDFromSession(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": remotePath, "size": size, "sha256": sum})
+}
+
+// pushFile sends src to remotePath, starting from whatever an earlier
+// attempt already delivered, and commits it with its checksum.
+func pushFile(t *fileTunnel, src *os.File, remotePath string, size int64, sum string) error {
+	begin, err := t.call(data.FileRequest{Op: "begin_write", Path: remotePath, Size: size})
+	if err != nil {
+		return err
+	}
+
+	offset := begin.Offset
+	resyncs := 0
+	buf := make([]byte, fileChunkSize)
+	for offset < size {
+		n, err := src.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read stage: %w", err)
+		}
+		resp, err := t.call(data.FileRequest{Op: "write", Path: remotePath, Offset: offset, Data: buf[:n]})
+		var remote *remoteFileError
+		if errors.As(err, &remote) && resp.Offset != offset && resyncs < fileTransferRetries {
+			// The drone has a different amount of the file than we thought,
+			// e.g. after a write whose reply was lost; resume where it is.
+			slog.Info("file push resynced", "path", remotePath, "offset", offset, "expected", resp.Offset)
+			offset, resyncs = resp.Offset, resyncs+1
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		offset, resyncs = resp.Offset, 0
+	}
+
+	_, err = t.call(data.FileRequest{Op: "commit", Path: remotePath, SHA256: sum})
+	return err
+}
+
+func stagedSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileError reports errors from the drone as bad requests and transport
+// failures as a bad gateway.
+func writeFileError(w http.ResponseWriter, err error) {
+	var remote *remoteFileError
+	if errors.As(err, &remote) {
+		http.Error(w, remote.msg, http.StatusBadRequest)
+		return
+	}
+	slog.Warn("file transfer failed", "error", err)
+	http.Error(w, "drone unreachable: "+strings.TrimSpace(err.Error()), http.StatusBadGateway)
+}
@@ -2,15 +2,19 @@ package main
 
 import "fmt"
 
-func GenerateInstallerScript(serverURL, uuid string) string {
+// GenerateInstallerScript returns a script that installs the agent, exchanges
+// enrollToken for the drone's credential and fetches its config.
+func GenerateInstallerScript(serverURL, uuid, enrollToken string) string {
 	return fmt.Sprintf(`#!/bin/bash
 set -e
 
 ARCH=$(uname -m)
 
 INSTALL_DIR=/opt/dronnayak
-BIN_URL="%s${ARCH}"
-CONFIG_URL="%s/device/%s/config.json"
+BIN_URL="%[1]s${ARCH}"
+CONFIG_URL="%[2]s/device/%[3]s/config.json"
+ENROLL_URL="%[2]s/device/%[3]s/enroll"
+ENROLL_TOKEN="%[4]s"
 
 echo "Installing dronnayak for $ARCH"
 
@@ -23,8 +27,11 @@ echo "Downloading binary..."
 wget "$BIN_URL" -O dronnayak
 chmod +x dronnayak
 
+echo "Enrolling device..."
+(umask 077 && wget -q --post-data="" --header="Authorization: Bearer $ENROLL_TOKEN" "$ENROLL_URL" -O device.key)
+
 echo "Fetching config..."
-wget "$CONFIG_URL" -O config.json
+wget --header="Authorization: Bearer $(cat device.key)" "$CONFIG_URL" -O config.json
 
 echo "Installing systemd service..."
 cat <<EOF | sudo tee /etc/systemd/system/dronnayak.service
@@ -36,6 +43,7 @@ Wants=network-online.target
 [Service]
 Type=simple
 Restart=always
+RestartSec=5
 WorkingDirectory=/opt/dronnayak
 ExecStart=/opt/dronnayak/dronnayak
 
@@ -48,5 +56,5 @@ sudo systemctl enable dronnayak
 sudo systemctl start dronnayak
 
 echo "Installation complete"
-`, "https://pub-5a597633002347f38a547cb4b17dfd60.r2.dev/bin/", serverURL, uuid)
+`, "https://pub-5a597633002347f38a547cb4b17dfd60.r2.dev/bin/", serverURL, uuid, enrollToken)
 }
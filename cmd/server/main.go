@@ -77,8 +77,14 @@ func main() {
 
 	mongoURI := os.Getenv("MONGO_URI")
 	data.InitDB(mongoURI)
+	ensureIndexes()
 	initTemplates()
 
+	if os.Getenv("DEVICE_AUTH") == "permissive" {
+		deviceAuthPermissive = true
+		slog.Warn("device auth is permissive: drones without a credential are accepted")
+	}
+
 	server.Configure(server.Config{})
 
 	r := chi.NewRouter()
@@ -95,13 +101,31 @@ func main() {
 	r.Get("/logout", logout)
 	r.Get("/signup", signup)
 	r.Post("/signup", signup)
-	r.Get("/device/{drone_id}/config.json", DeviceConfigHandler)
-	r.Post("/device-status/{drone_id}", deviceStatus)
-	r.Get("/device-status/{drone_id}", deviceStatus)
-	r.Put("/device/{drone_id}/config", updateDeviceConfig)
+	r.Post("/device/{drone_id}/enroll", enrollDevice)
+	r.HandleFunc("/device/{drone_id}/ws/{ticket}", deviceRelay)
+
+	r.Group(func(rdev chi.Router) {
+		rdev.Use(DeviceAuth)
+
+		rdev.Post("/device-status/{drone_id}", deviceStatus)
+		rdev.Post("/device/{drone_id}/tlogs/{name}", uploadTLog)
+		rdev.Post("/device/{drone_id}/commands/results", commandResults)
+		rdev.Post("/device/{drone_id}/exec-audit", execAudit)
+		rdev.Get("/device/{drone_id}/mux", droneMux)
+		rdev.Post("/device/{drone_id}/probe", deviceProbe)
+		rdev.Post("/device/{drone_id}/relay-ticket", deviceRelayTicket)
+		rdev.Post("/device/{drone_id}/credentials", rotateCredential)
+	})
+
+	r.Group(func(rdev chi.Router) {
+		rdev.Use(DeviceOrSessionAuth)
+
+		rdev.Get("/device/{drone_id}/config.json", DeviceConfigHandler)
+		rdev.Get("/device-status/{drone_id}", deviceStatus)
+	})
 
-	r.HandleFunc("/ws", server.HandleWebSocket)
-	r.HandleFunc("/tcp", server.HandleTCPProxy)
+	r.With(relayAuth).HandleFunc("/ws", server.HandleWebSocket)
+	r.With(relayAuth).HandleFunc("/tcp", server.HandleTCPProxy)
 	r.HandleFunc("/status", server.HandleStatus)
 	r.HandleFunc("/health", server.HandleHealth)
 
@@ -115,18 +139,35 @@ func main() {
 		rauth.Post("/fleets/{fleet_id}/drones", createDrone)
 		rauth.Get("/fleets/{fleet_id}/drones/{drone_id}/install-command", getInstallCommand)
 		rauth.Get("/device/{drone_id}", deviceDetails)
+		rauth.Put("/device/{drone_id}/config", updateDeviceConfig)
+		rauth.Delete("/device/{drone_id}/credentials/{credential_id}", revokeCredential)
 		rauth.Delete("/device/{drone_id}", deviceDetails)
 		rauth.Get("/device/{drone_id}/flight-deck", deviceSubPage("drone-flight-deck"))
 		rauth.Get("/device/{drone_id}/rce", deviceSubPage("drone-rce"))
+		rauth.Get("/device/{drone_id}/rce/ws", rceSession)
+		rauth.Get("/device/{drone_id}/rce/sessions", rceSessions)
+		rauth.Get("/device/{drone_id}/rce/sessions/{session_id}", rceRecording)
 		rauth.Get("/device/{drone_id}/video", deviceSubPage("drone-video"))
 		rauth.Get("/device/{drone_id}/diagnostics", deviceSubPage("drone-diagnostics"))
+		rauth.Get("/device/{drone_id}/link", linkHistory)
 		rauth.Get("/device/{drone_id}/logs", logViewer)
 		rauth.Post("/device/{drone_id}/commands", createDroneCommand)
+		rauth.Get("/device/{drone_id}/tlogs/{name}", downloadTLog)
+		rauth.Get("/device/{drone_id}/files", listDroneFiles)
+		rauth.Get("/device/{drone_id}/files/download", downloadDroneFile)
+		rauth.Post("/device/{drone_id}/files/upload", uploadDroneFile)
+		rauth.Get("/device/{drone_id}/socks", manageSOCKSProxy)
+		rauth.Post("/device/{drone_id}/socks", manageSOCKSProxy)
+		rauth.Delete("/device/{drone_id}/socks", manageSOCKSProxy)
+		rauth.Get("/device/{drone_id}/proxy/{label}", openDroneProxy)
+		rauth.Get("/device/{drone_id}/proxy/{label}/*", openDroneProxy)
 		rauth.Post("/device/{drone_id}/worker", manageWorker)
 		rauth.Delete("/device/{drone_id}/worker", manageWorker)
 	})
 
 	r.Get("/device/{drone_id}/installer.sh", getInstallerScript)
+	r.Handle("/proxy/{grant}", http.HandlerFunc(proxyDroneHTTP))
+	r.Handle("/proxy/{grant}/*", http.HandlerFunc(proxyDroneHTTP))
 
 	addr := "0.0.0.0:8090"
 	slog.Info("server starting", "addr", addr)
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/dronnayak-core/internal/mux"
+	"github.com/KunalDuran/gowsrelay/client"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+const relayWriteTimeout = 30 * time.Second
+
+var muxUpgrader = websocket.Upgrader{ReadBufferSize: 32 << 10, WriteBufferSize: 32 << 10}
+
+// droneMux accepts a drone's multiplexed tunnel connection, which carries
+// one named stream per tunnel, and publishes each stream to the relay topic
+// it names, exactly as a tunnel with its own WebSocket would.
+//
+// GET /device/{drone_id}/mux (WebSocket)
+func droneMux(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	if !validUID.MatchString(droneID) {
+		http.Error(w, "invalid drone_id", http.StatusBadRequest)
+		return
+	}
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		http.Error(w, "drone not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := muxUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already replied
+	}
+	defer conn.Close()
+	defer trackDeviceConn(droneID, credentialID(r), conn.Close)()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	serverBase := getServerPath(r)
+	sess := mux.NewSession(&wsStreamReader{conn: conn}, wsMessageWriter{conn}, true)
+	defer sess.Close()
+	slog.Info("multiplexed tunnel connected", "drone_id", droneID, "remote", r.RemoteAddr)
+
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			slog.Info("multiplexed tunnel disconnected", "drone_id", droneID, "error", err)
+			return
+		}
+		topic := st.Name()
+		if !strings.HasPrefix(topic, droneID+"_") {
+			slog.Warn("mux: rejected stream for another drone's topic", "drone_id", droneID, "topic", topic)
+			st.Close()
+			continue
+		}
+		go relayStream(ctx, serverBase, droneID, st)
+	}
+}
+
+// relayStream publishes st to its topic until either side closes. The drone
+// reopens the stream if the relay connection drops.
+func relayStream(ctx context.Context, serverBase, droneID string, st *mux.Stream) {
+	defer st.Close()
+	cfg, err := relayProducerConfig(serverBase, droneID, st.Name())
+	if err != nil {
+		slog.Error("mux: invalid relay config", "topic", st.Name(), "error", err)
+		return
+	}
+	if err := client.CreateWebSocketTunnel(ctx, cfg, st); err != nil {
+		slog.Warn("mux: relay connection ended", "topic", st.Name(), "error", err)
+	}
+}
+
+// relayMux opens mux streams to a drone endpoint that accepts them (socks5
+// and http tunnels) over a subscriber connection to the endpoint's relay
+// topic. The connection is dialled on first use and again after it drops.
+type relayMux struct {
+	serverBase string
+	topic      string
+
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	sess   *mux.Session
+	closed bool
+}
+
+func newRelayMux(serverBase, topic string) *relayMux {
+	return &relayMux{serverBase: serverBase, topic: topic}
+}
+
+// Open starts a new stream to the drone.
+func (m *relayMux) Open() (*mux.Stream, error) {
+	sess, err := m.session()
+	if err != nil {
+		return nil, err
+	}
+	return sess.Open()
+}
+
+func (m *relayMux) session() (*mux.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, mux.ErrSessionClosed
+	}
+	if m.sess != nil {
+		select {
+		case <-m.sess.Done():
+			m.conn.Close()
+			m.sess = nil
+		default:
+			return m.sess, nil
+		}
+	}
+
+	wsURL, err := relaySubscriberURL(m.serverBase, m.topic)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, relayHeader())
+	if err != nil {
+		return nil, fmt.Errorf("dial relay: %w", err)
+	}
+	m.conn = conn
+	m.sess = mux.NewSession(&wsStreamReader{conn: conn}, wsMessageWriter{conn}, false)
+	return m.sess, nil
+}
+
+// Close ends every stream and the relay connection.
+func (m *relayMux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.sess != nil {
+		m.sess.Close()
+		m.conn.Close()
+	}
+	return nil
+}
+
+// wsMessageWriter sends each Write as one binary message. Callers serialise
+// writes.
+type wsMessageWriter struct{ conn *websocket.Conn }
+
+func (w wsMessageWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// linkHistoryLimit caps the samples returned by linkHistory.
+	linkHistoryLimit = 2000
+
+	// probeEchoIdle is how long a drone's probe echo worker stays subscribed
+	// after the last probe, on either path.
+	probeEchoIdle = 5 * time.Minute
+)
+
+// linkProbe is the body of a control path probe, echoed back as is.
+type linkProbe struct {
+	Seq    uint64 `json:"seq"`
+	SentAt int64  `json:"sent_at"` // drone clock, unix ns
+}
+
+// deviceProbe answers a drone's control path probe, and makes sure the echo
+// worker for its tunnel path probes is subscribed.
+//
+// POST /device/{drone_id}/probe
+func deviceProbe(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	if !validUID.MatchString(droneID) {
+		http.Error(w, "invalid drone_id", http.StatusBadRequest)
+		return
+	}
+
+	var probe linkProbe
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&probe); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(probe)
+
+	keepProbeEcho(getServerPath(r), droneID+"_"+data.ProbeTunnelLabel)
+}
+
+// probeEcho tracks the echo worker of one drone's probe topic.
+type probeEcho struct {
+	lastActive atomic.Int64 // unix ns
+}
+
+func (e *probeEcho) touch() {
+	e.lastActive.Store(time.Now().UnixNano())
+}
+
+var (
+	probeEchoesMu sync.Mutex
+	probeEchoes   = map[string]*probeEcho{} // topic -> running echo worker
+)
+
+// keepProbeEcho records probe activity on topic and starts its echo worker if
+// it is not running. The worker stops once the topic has been idle for
+// probeEchoIdle.
+func keepProbeEcho(wsBase, topic string) {
+	probeEchoesMu.Lock()
+	defer probeEchoesMu.Unlock()
+	if e, ok := probeEchoes[topic]; ok {
+		e.touch()
+		return
+	}
+
+	e := &probeEcho{}
+	e.touch()
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &TopicSender{}
+	echo := EchoWorker(sender)
+	fn := func(ctx context.Context, data []byte) error {
+		e.touch()
+		return echo(ctx, data)
+	}
+	teardown := func() {
+		cancel()
+		probeEchoesMu.Lock()
+		if probeEchoes[topic] == e {
+			delete(probeEchoes, topic)
+		}
+		probeEchoesMu.Unlock()
+	}
+	if err := StartTopicWorker(ctx, wsBase, topic, fn, teardown, sender); err != nil {
+		cancel()
+		slog.Debug("probe echo worker not started", "topic", topic, "error", err)
+		return
+	}
+	probeEchoes[topic] = e
+
+	go func() {
+		ticker := time.NewTicker(probeEchoIdle / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if time.Since(time.Unix(0, e.lastActive.Load())) > probeEchoIdle {
+					slog.Info("stopping idle probe echo worker", "topic", topic)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// linkSample is one status sample's link measurements.
+type linkSample struct {
+	SampledAt int64             `json:"sampled_at"`
+	Link      []data.LinkStats  `json:"link,omitempty"`
+	Radio     *data.RadioStatus `json:"radio,omitempty"`
+}
+
+// linkHistory returns the drone's link measurements from its status history,
+// oldest first.
+//
+// GET /device/{drone_id}/link?minutes=30
+func linkHistory(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	if !validUID.MatchString(droneID) {
+		http.Error(w, "invalid drone_id", http.StatusBadRequest)
+		return
+	}
+	minutes := 30
+	if v, err := strconv.Atoi(r.URL.Query().Get("minutes")); err == nil && v > 0 && v <= 24*60 {
+		minutes = v
+	}
+
+	filter := map[string]interface{}{
+		"drone_uid":  droneID,
+		"sampled_at": map[string]interface{}{"$gte": time.Now().Add(-time.Duration(minutes) * time.Minute).Unix()},
+	}
+	opts := options.Find().
+		SetSort(map[string]interface{}{"sampled_at": -1}).
+		SetLimit(linkHistoryLimit).
+		SetProjection(map[string]interface{}{"sampled_at": 1, "status.link": 1, "telemetry.radio": 1})
+	var history []data.StatusSample
+	if err := data.FindAll("drone_status_history", filter, &history, opts); err != nil {
+		slog.Error("failed to fetch link history", "drone_id", droneID, "error", err)
+		http.Error(w, "failed to fetch link history", http.StatusInternalServerError)
+		return
+	}
+
+	samples := make([]linkSample, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		h := history[i]
+		sample := linkSample{SampledAt: h.SampledAt, Link: h.Status.Link}
+		if h.Telemetry != nil {
+			sample.Radio = h.Telemetry.Radio
+		}
+		if sample.Link != nil || sample.Radio != nil {
+			samples = append(samples, sample)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
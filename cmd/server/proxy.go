@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/KunalDuran/dronnayak-core/internal/mux"
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// proxyRewriteLimit caps the size of an HTML or CSS response whose paths are
+// rewritten; larger responses are passed through unchanged.
+const proxyRewriteLimit = 8 << 20
+
+// proxySandbox is the Content-Security-Policy put on every proxied response.
+// Without allow-same-origin the onboard page runs in an opaque origin, so its
+// scripts cannot read dashboard pages or send the Lax session cookie along
+// with requests to them.
+const proxySandbox = "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+
+// proxyGrants maps grant -> proxyGrant. A sandboxed page's own requests do not
+// carry the session cookie either, so proxied paths are authorised by a grant
+// in the path instead, issued to a signed-in user and valid for as long as
+// their session.
+var proxyGrants sync.Map
+
+type proxyGrant struct {
+	session string
+	droneID string
+	label   string
+}
+
+// proxyTransports maps relay topic -> *proxyConn, so idle connections to the
+// drone's http endpoint are reused across requests. An entry lives while a
+// grant for its endpoint does.
+var proxyTransports sync.Map
+
+// proxyConn is an http.Transport whose connections are mux streams over relay.
+type proxyConn struct {
+	transport *http.Transport
+	relay     *relayMux
+}
+
+func (g proxyGrant) topic() string {
+	return g.droneID + "_" + g.label
+}
+
+var (
+	htmlPathAttr = regexp.MustCompile(`(?i)(\s(?:href|src|action|poster|formaction)\s*=\s*["']?)/([^/]|$)`)
+	cssURLPath   = regexp.MustCompile(`(?i)(url\(\s*["']?)/([^/])`)
+)
+
+// streamConn adapts a mux stream to net.Conn for http.Transport. Streams have
+// no deadlines; the transport closes the connection when a request is
+// cancelled, which unblocks it.
+type streamConn struct {
+	*mux.Stream
+	topic string
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "mux" }
+func (a streamAddr) String() string  { return string(a) }
+
+func (c streamConn) LocalAddr() net.Addr                { return streamAddr("server") }
+func (c streamConn) RemoteAddr() net.Addr               { return streamAddr(c.topic) }
+func (c streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func proxyTransport(serverBase, topic string) *http.Transport {
+	if c, ok := proxyTransports.Load(topic); ok {
+		return c.(*proxyConn).transport
+	}
+	relay := newRelayMux(serverBase, topic)
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			st, err := relay.Open()
+			if err != nil {
+				return nil, err
+			}
+			return streamConn{Stream: st, topic: topic}, nil
+		},
+		MaxIdleConnsPerHost:   8,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	}
+	actual, _ := proxyTransports.LoadOrStore(topic, &proxyConn{transport: t, relay: relay})
+	return actual.(*proxyConn).transport
+}
+
+// closeProxyTransport closes the topic's idle connections and relay
+// subscription, if any.
+func closeProxyTransport(topic string) {
+	if c, ok := proxyTransports.LoadAndDelete(topic); ok {
+		c.(*proxyConn).transport.CloseIdleConnections()
+		c.(*proxyConn).relay.Close()
+		slog.Debug("proxy: closed relay connection", "topic", topic)
+	}
+}
+
+// dropProxyGrant forgets a grant, and closes its endpoint's transport unless
+// another grant still uses it.
+func dropProxyGrant(grantID string) {
+	v, ok := proxyGrants.LoadAndDelete(grantID)
+	if !ok {
+		return
+	}
+	topic := v.(proxyGrant).topic()
+	inUse := false
+	proxyGrants.Range(func(_, v interface{}) bool {
+		inUse = v.(proxyGrant).topic() == topic
+		return !inUse
+	})
+	if !inUse {
+		closeProxyTransport(topic)
+	}
+}
+
+// openDroneProxy sends the user to the proxy for the drone's http endpoint
+// with the given label, under a grant tied to their session.
+//
+// GET /device/{drone_id}/proxy/{label}/...
+func openDroneProxy(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	label := chi.URLParam(r, "label")
+	if !validUID.MatchString(droneID) {
+		http.Error(w, "invalid drone_id", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	grant := ""
+	proxyGrants.Range(func(k, v interface{}) bool {
+		if v.(proxyGrant) == (proxyGrant{session: cookie.Value, droneID: droneID, label: label}) {
+			grant = k.(string)
+			return false
+		}
+		return true
+	})
+	if grant == "" {
+		grant = newSecret()
+		proxyGrants.Store(grant, proxyGrant{session: cookie.Value, droneID: droneID, label: label})
+	}
+
+	target := "/proxy/" + grant + strings.TrimPrefix(r.URL.Path, "/device/"+droneID+"/proxy/"+label)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// dropProxyGrants forgets the proxy grants issued to a session.
+func dropProxyGrants(session string) {
+	var dropped []string
+	proxyGrants.Range(func(k, v interface{}) bool {
+		if v.(proxyGrant).session == session {
+			dropped = append(dropped, k.(string))
+		}
+		return true
+	})
+	for _, grantID := range dropped {
+		dropProxyGrant(grantID)
+	}
+}
+
+// proxyDroneHTTP reverse-proxies a request, including WebSocket upgrades, to
+// the onboard web service behind a grant's drone http endpoint. Paths are
+// served under the grant's prefix: redirects, cookie paths and root-relative
+// links in HTML and CSS are rewritten to stay inside it. Links built by
+// scripts at runtime are not rewritten. Responses are sandboxed, see
+// proxySandbox.
+//
+// ANY /proxy/{grant}/...
+func proxyDroneHTTP(w http.ResponseWriter, r *http.Request) {
+	grantID := chi.URLParam(r, "grant")
+	v, ok := proxyGrants.Load(grantID)
+	if !ok {
+		http.Error(w, "proxy link expired, open it again from the drone page", http.StatusNotFound)
+		return
+	}
+	grant := v.(proxyGrant)
+	if _, ok := sessions.Load(grant.session); !ok {
+		dropProxyGrant(grantID)
+		http.Error(w, "proxy link expired, open it again from the drone page", http.StatusNotFound)
+		return
+	}
+	droneID, label := grant.droneID, grant.label
+
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			closeProxyTransport(grant.topic())
+		}
+		http.Error(w, "drone not found", http.StatusNotFound)
+		return
+	}
+	entry, ok := findHTTPEndpoint(drone, label)
+	if !ok {
+		closeProxyTransport(grant.topic())
+		http.Error(w, fmt.Sprintf("no http endpoint labelled %q is configured for this drone", label), http.StatusNotFound)
+		return
+	}
+
+	prefix := "/proxy/" + grantID
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	if rest == "" {
+		target := prefix + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	host := entry.Host
+	if host == "" {
+		host = "localhost"
+	}
+	upstream := net.JoinHostPort(host, entry.Port)
+	rp := &httputil.ReverseProxy{
+		Transport: proxyTransport(getServerPath(r), grant.topic()),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = upstream
+			pr.Out.URL.Path = rest
+			pr.Out.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+			pr.Out.Host = upstream
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+			stripSessionCookie(pr.Out)
+			if pr.Out.Header.Get("Origin") != "" {
+				pr.Out.Header.Set("Origin", "http://"+upstream)
+			}
+			// Only gzip can be decoded for rewriting.
+			if strings.Contains(pr.In.Header.Get("Accept-Encoding"), "gzip") {
+				pr.Out.Header.Set("Accept-Encoding", "gzip")
+			} else {
+				pr.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set("Content-Security-Policy", proxySandbox)
+			resp.Header.Set("Referrer-Policy", "no-referrer") // the grant is in the URL
+			return rewriteProxyResponse(resp, prefix, upstream)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("proxy: request failed", "drone_id", droneID, "label", label, "path", rest, "error", err)
+			w.Header().Set("Content-Security-Policy", proxySandbox)
+			http.Error(w, "onboard service unavailable", http.StatusBadGateway)
+		},
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// findHTTPEndpoint returns the drone's http endpoint whose label (or type,
+// when unlabelled) is label.
+func findHTTPEndpoint(drone data.Drone, label string) (data.TunnelEntry, bool) {
+	for _, ep := range drone.DeviceConfig.Tunnel.Endpoints {
+		if ep.Type != data.EndpointTypeHTTP {
+			continue
+		}
+		name := ep.Label
+		if name == "" {
+			name = string(ep.Type)
+		}
+		if name == label {
+			return ep, true
+		}
+	}
+	return data.TunnelEntry{}, false
+}
+
+// stripSessionCookie keeps the dashboard session out of onboard services.
+func stripSessionCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != "session" {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// rewriteProxyResponse maps upstream paths in resp under prefix.
+func rewriteProxyResponse(resp *http.Response, prefix, upstream string) error {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		resp.Header.Set("Location", rewriteProxyLocation(loc, prefix, upstream))
+	}
+
+	if setCookies := resp.Header.Values("Set-Cookie"); len(setCookies) > 0 {
+		resp.Header.Del("Set-Cookie")
+		for _, line := range setCookies {
+			c, err := http.ParseSetCookie(line)
+			if err != nil || c.Name == "session" {
+				continue // must not replace the dashboard session
+			}
+			if c.Path == "" || !strings.HasPrefix(c.Path, "/") {
+				c.Path = "/"
+			}
+			c.Path = prefix + c.Path
+			c.Domain = ""
+			resp.Header.Add("Set-Cookie", c.String())
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var pattern *regexp.Regexp
+	switch mediaType {
+	case "text/html":
+		pattern = htmlPathAttr
+	case "text/css":
+		pattern = cssURLPath
+	default:
+		return nil
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "gzip" {
+		return nil
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, proxyRewriteLimit+1))
+	if err != nil {
+		return err
+	}
+	if len(raw) > proxyRewriteLimit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	body := raw
+	if encoding == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return fmt.Errorf("decode gzip body: %w", err)
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return fmt.Errorf("decode gzip body: %w", err)
+		}
+		resp.Header.Del("Content-Encoding")
+	}
+
+	body = pattern.ReplaceAll(body, []byte("${1}"+prefix+"/${2}"))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	return nil
+}
+
+// rewriteProxyLocation maps a redirect to the upstream, or to a root-relative
+// path, under prefix.
+func rewriteProxyLocation(loc, prefix, upstream string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	if u.IsAbs() {
+		upstreamHost, _, _ := net.SplitHostPort(upstream)
+		if u.Host != upstream && u.Hostname() != upstreamHost {
+			return loc // somewhere else entirely
+		}
+		u.Scheme, u.Host = "", ""
+	} else if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return loc // protocol-relative or relative to the current page
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+	return u.String()
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	rceSessionDir          = "rce-sessions"
+	rceSessionHistoryLimit = 50
+)
+
+// rceUpgrader only accepts same-origin browsers, so another site cannot open
+// a shell with the operator's session cookie.
+var rceUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+// rceSession proxies an RCE page WebSocket to the drone's cmd or pty topic on
+// the relay and records the session.
+//
+// GET /device/{drone_id}/rce/ws?topic=<droneUID>_<label>&mode=pty|cmd
+func rceSession(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	topic := r.URL.Query().Get("topic")
+	kind := data.EndpointType(r.URL.Query().Get("mode"))
+	if !validUID.MatchString(droneID) || !strings.HasPrefix(topic, droneID+"_") {
+		http.Error(w, "invalid drone_id or topic", http.StatusBadRequest)
+		return
+	}
+	if kind != data.EndpointTypeCmd && kind != data.EndpointTypePTY {
+		http.Error(w, "mode must be cmd or pty", http.StatusBadRequest)
+		return
+	}
+	var drone data.Drone
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
+		http.Error(w, "drone not found", http.StatusNotFound)
+		return
+	}
+
+	wsURL, err := relaySubscriberURL(getServerPath(r), topic)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	relay, _, err := websocket.DefaultDialer.DialContext(r.Context(), wsURL, relayHeader())
+	if err != nil {
+		slog.Error("rce: relay dial failed", "topic", topic, "error", err)
+		http.Error(w, "relay unavailable", http.StatusBadGateway)
+		return
+	}
+	defer relay.Close()
+
+	browser, err := rceUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already replied
+	}
+	defer browser.Close()
+
+	session := data.RCESession{
+		ID:        primitive.NewObjectID(),
+		DroneUID:  droneID,
+		Topic:     topic,
+		Kind:      kind,
+		User:      GetUserIDFromSession(r),
+		StartedAt: time.Now(),
+	}
+	session.File = filepath.Join(rceSessionDir, droneID, session.ID.Hex()+".cast")
+
+	rec, err := newSessionRecorder(session.File, session.StartedAt, fmt.Sprintf("%s %s by %s", topic, kind, session.User))
+	if err != nil {
+		slog.Error("rce: cannot record session, refusing to connect", "topic", topic, "error", err)
+		browser.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "session recording unavailable"), time.Now().Add(time.Second))
+		return
+	}
+	if err := data.InsertOne("rce_sessions", session); err != nil {
+		slog.Error("rce: failed to store session", "topic", topic, "error", err)
+	}
+	slog.Info("rce session started", "drone_id", droneID, "topic", topic, "kind", kind, "user", session.User, "session_id", session.ID.Hex())
+
+	var bytesIn, bytesOut atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// operator -> drone
+	go func() {
+		defer wg.Done()
+		defer relay.Close()
+		for {
+			msgType, msg, err := browser.ReadMessage()
+			if err != nil {
+				relay.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				return
+			}
+			bytesIn.Add(int64(len(msg)))
+			rec.input(kind, msg)
+			if err := relay.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	// drone -> operator
+	go func() {
+		defer wg.Done()
+		defer browser.Close()
+		for {
+			msgType, msg, err := relay.ReadMessage()
+			if err != nil {
+				code, reason := websocket.CloseGoingAway, "relay connection lost"
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseNoStatusReceived && closeErr.Code != websocket.CloseAbnormalClosure {
+					code, reason = closeErr.Code, closeErr.Text
+				}
+				browser.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+				return
+			}
+			bytesOut.Add(int64(len(msg)))
+			rec.output(msg)
+			if err := browser.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	if err := rec.Close(); err != nil {
+		slog.Error("rce: failed to finish recording", "file", session.File, "error", err)
+	}
+	ended := time.Now()
+	update := map[string]interface{}{
+		"ended_at":    ended,
+		"duration_ms": ended.Sub(session.StartedAt).Milliseconds(),
+		"bytes_in":    bytesIn.Load(),
+		"bytes_out":   bytesOut.Load(),
+	}
+	if err := data.UpdateOne("rce_sessions", map[string]interface{}{"_id": session.ID}, update); err != nil {
+		slog.Error("rce: failed to update session", "session_id", session.ID.Hex(), "error", err)
+	}
+	slog.Info("rce session ended", "drone_id", droneID, "topic", topic, "user", session.User, "session_id", session.ID.Hex(), "duration_ms", update["duration_ms"])
+}
+
+// execTopic reports whether topic is a cmd or pty tunnel of some drone, from
+// its config or a start_tunnel command. Browsers reach those only through
+// rceSession, which records them. Drone UIDs may contain "_", so every prefix
+// of topic ending before one is tried.
+func execTopic(topic string) bool {
+	for i := strings.IndexByte(topic, '_'); i > 0; {
+		droneID, label := topic[:i], topic[i+1:]
+		var drone data.Drone
+		if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err == nil {
+			entries := drone.DeviceConfig.Tunnel.Endpoints
+			var cmds []data.DroneCommands
+			if err := data.FindAll("drone_commands", map[string]interface{}{"drone_uid": droneID, "type": "start_tunnel"}, &cmds); err != nil {
+				slog.Warn("failed to fetch tunnel commands", "drone_id", droneID, "error", err)
+				return true // fail closed
+			}
+			for _, cmd := range cmds {
+				var entry data.TunnelEntry
+				if json.Unmarshal(cmd.Payload, &entry) == nil {
+					entries = append(entries, entry)
+				}
+			}
+			for _, entry := range entries {
+				name := entry.Label
+				if name == "" {
+					name = string(entry.Type)
+				}
+				if name == label && (entry.Type == data.EndpointTypeCmd || entry.Type == data.EndpointTypePTY) {
+					return true
+				}
+			}
+		}
+		next := strings.IndexByte(label, '_')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
+
+// rceSessions lists the drone's most recent recorded sessions as JSON.
+func rceSessions(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	if !validUID.MatchString(droneID) {
+		http.Error(w, "invalid drone_id", http.StatusBadRequest)
+		return
+	}
+
+	sessions := []data.RCESession{}
+	opts := options.Find().SetSort(map[string]interface{}{"started_at": -1}).SetLimit(rceSessionHistoryLimit)
+	if err := data.FindAll("rce_sessions", map[string]interface{}{"drone_uid": droneID}, &sessions, opts); err != nil {
+		slog.Error("failed to fetch rce sessions", "drone_id", droneID, "error", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// rceRecording serves a session recording in asciicast v2 format, as an
+// attachment when ?download=1 is set.
+func rceRecording(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "session_id"))
+	if !validUID.MatchString(droneID) || err != nil {
+		http.Error(w, "invalid drone_id or session_id", http.StatusBadRequest)
+		return
+	}
+
+	var session data.RCESession
+	if err := data.FindOne("rce_sessions", map[string]interface{}{"_id": id, "drone_uid": droneID}, &session); err != nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+droneID+"-"+session.ID.Hex()+`.cast"`)
+	}
+	http.ServeFile(w, r, session.File)
+}
+
+// sessionRecorder writes a session as asciicast v2: a JSON header line, then
+// one [seconds, code, data] line per event, where code is "o" for output,
+// "i" for input, "r" for a terminal resize and "m" for a marker such as a
+// signal sent from the page.
+type sessionRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	start   time.Time
+	partial []byte // incomplete UTF-8 sequence at the end of the last output
+}
+
+func newSessionRecorder(path string, start time.Time, title string) (*sessionRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create recording dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+
+	rec := &sessionRecorder{f: f, enc: json.NewEncoder(f), start: start}
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     80,
+		"height":    24,
+		"timestamp": start.Unix(),
+		"title":     title,
+	}
+	if err := rec.enc.Encode(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write recording header: %w", err)
+	}
+	return rec, nil
+}
+
+func (s *sessionRecorder) event(code, payload string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.start).Seconds()
+	if err := s.enc.Encode([]interface{}{elapsed, code, payload}); err != nil {
+		slog.Warn("rce: failed to write recording event", "error", err)
+	}
+}
+
+// output records data sent by the drone. A UTF-8 sequence split across
+// messages is held back until it is complete so it is not recorded as
+// replacement characters.
+func (s *sessionRecorder) output(msg []byte) {
+	s.mu.Lock()
+	buf := append(s.partial, msg...)
+	cut := len(buf)
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	s.partial = append([]byte(nil), buf[cut:]...)
+	s.mu.Unlock()
+
+	if cut > 0 {
+		s.event("o", string(buf[:cut]))
+	}
+}
+
+// input records a message sent by the operator. For pty sessions it decodes
+// the input frames: keystrokes are recorded as input, resizes as "r" events
+// and signals as markers.
+func (s *sessionRecorder) input(kind data.EndpointType, msg []byte) {
+	if kind != data.EndpointTypePTY {
+		s.event("i", string(msg))
+		return
+	}
+
+	for len(msg) > 0 {
+		if len(msg) < 5 || int(binary.BigEndian.Uint32(msg[1:5])) > len(msg)-5 {
+			s.event("i", string(msg)) // not a frame; keep it as sent
+			return
+		}
+		n := int(binary.BigEndian.Uint32(msg[1:5]))
+		frameKind, payload := msg[0], msg[5:5+n]
+		msg = msg[5+n:]
+
+		if frameKind == 0 {
+			s.event("i", string(payload))
+			continue
+		}
+		var ctrl struct {
+			Type   string `json:"type"`
+			Cols   int    `json:"cols"`
+			Rows   int    `json:"rows"`
+			Signal string `json:"signal"`
+		}
+		if err := json.Unmarshal(payload, &ctrl); err != nil {
+			continue
+		}
+		switch ctrl.Type {
+		case "resize":
+			s.event("r", fmt.Sprintf("%dx%d", ctrl.Cols, ctrl.Rows))
+		case "signal":
+			s.event("m", "signal "+ctrl.Signal)
+		}
+	}
+}
+
+func (s *sessionRecorder) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.partial) > 0 {
+		s.enc.Encode([]interface{}{time.Since(s.start).Seconds(), "o", string(s.partial)})
+	}
+	return s.f.Close()
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -13,12 +19,26 @@ import (
 	"github.com/KunalDuran/dronnayak-core/internal/data"
 	"github.com/KunalDuran/dronnayak-core/internal/web"
 	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	tlogStoreDir          = "tlogs"
+	commandHistoryLimit   = 25
+	execAuditHistoryLimit = 50
+
+	// statusHistoryRetention is how long status samples are kept, unless
+	// STATUS_HISTORY_RETENTION (a duration such as 168h) says otherwise.
+	statusHistoryRetention = 30 * 24 * time.Hour
+)
+
 var (
-	tmpl     map[string]*template.Template
-	validUID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,50}$`)
+	tmpl          map[string]*template.Template
+	validUID      = regexp.MustCompile(`^[A-Za-z0-9_-]{1,50}$`)
+	validTLogName = regexp.MustCompile(`^[0-9TZ-]+\.tlog$`)
 )
 
 func initTemplates() {
@@ -202,15 +222,39 @@ func deviceDetails(w http.ResponseWriter, r *http.Request) {
 
 	drone.DeviceConfig.Server.URL = web.CleanServerURL(getServerPath(r))
 
+	drone.DeviceConfig.ApplyDefaults()
+	tlogConfig := drone.DeviceConfig.MAVLink.TLog
+
 	view := struct {
 		data.Drone
 		StatsIntervalSec int64
 		WSRelayBase      string
 		LiveTunnelTopics []string
+		TLogMaxAgeMin    int64
+		TLogMaxFileMB    int64
+		TLogMaxTotalMB   int64
+		ExecTimeoutSec   int64
+		ExecMaxOutputKB  int
+		Commands         []data.DroneCommands
+		ExecAudit        []data.ExecAudit
 	}{
 		Drone:            drone,
 		StatsIntervalSec: int64(drone.DeviceConfig.Stats.Interval / time.Second),
 		WSRelayBase:      "//" + drone.DeviceConfig.Server.URL + drone.DeviceConfig.Tunnel.WSPath,
+		TLogMaxAgeMin:    int64(tlogConfig.MaxFileAge / time.Minute),
+		TLogMaxFileMB:    tlogConfig.MaxFileSize >> 20,
+		TLogMaxTotalMB:   tlogConfig.MaxTotalSize >> 20,
+		ExecTimeoutSec:   int64(drone.DeviceConfig.Exec.Timeout / time.Second),
+		ExecMaxOutputKB:  drone.DeviceConfig.Exec.MaxOutput >> 10,
+	}
+
+	commandOpts := options.Find().SetSort(map[string]interface{}{"created_at": -1}).SetLimit(commandHistoryLimit)
+	if err := data.FindAll("drone_commands", map[string]interface{}{"drone_uid": droneID}, &view.Commands, commandOpts); err != nil {
+		slog.Warn("failed to fetch command history", "drone_id", droneID, "error", err)
+	}
+	auditOpts := options.Find().SetSort(map[string]interface{}{"started_at": -1}).SetLimit(execAuditHistoryLimit)
+	if err := data.FindAll("drone_exec_audit", map[string]interface{}{"drone_uid": droneID}, &view.ExecAudit, auditOpts); err != nil {
+		slog.Warn("failed to fetch exec audit", "drone_id", droneID, "error", err)
 	}
 
 	// do a webrequest on /status for tunnel data
@@ -289,8 +333,6 @@ func createDrone(w http.ResponseWriter, r *http.Request) {
 	// Build MAVLink config
 	mavlinkConfig := data.MAVLinkConfig{
 		Enabled:         r.Form.Get("mavlink_enabled") == "on",
-		SerialPort:      r.Form.Get("serial_port"),
-		TCPAddress:      r.Form.Get("tcp_address"),
 		StreamFrequency: 10,
 		OutSystemID:     255,
 	}
@@ -301,30 +343,78 @@ func createDrone(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Build MAVLink endpoints from endpoint rows submitted by the form.
+	mavTypes := r.Form["mavlink_endpoint_type[]"]
+	mavAddresses := r.Form["mavlink_endpoint_address[]"]
+	mavBauds := r.Form["mavlink_endpoint_baud[]"]
+	for i, rawType := range mavTypes {
+		ep := data.MAVLinkEndpoint{Type: data.MAVLinkEndpointType(strings.TrimSpace(rawType))}
+		if i < len(mavAddresses) {
+			ep.Address = strings.TrimSpace(mavAddresses[i])
+		}
+		if ep.Type == data.MAVLinkEndpointSerial && i < len(mavBauds) {
+			if baud, err := strconv.Atoi(strings.TrimSpace(mavBauds[i])); err == nil {
+				ep.BaudRate = baud
+			}
+		}
+		mavlinkConfig.Endpoints = append(mavlinkConfig.Endpoints, ep)
+	}
+
 	// Build Tunnel config from endpoint rows submitted by the form.
 	var tunnelEndpoints []data.TunnelEntry
 	epTypes := r.Form["endpoint_type[]"]
+	epHosts := r.Form["endpoint_host[]"]
 	epPorts := r.Form["endpoint_port[]"]
+	epDevices := r.Form["endpoint_device[]"]
+	epBauds := r.Form["endpoint_baud[]"]
 	epLabels := r.Form["endpoint_label[]"]
+	epPriorities := r.Form["endpoint_priority[]"]
+	epMaxKbps := r.Form["endpoint_max_kbps[]"]
 	for i, rawType := range epTypes {
 		entry := data.TunnelEntry{Type: data.EndpointType(strings.TrimSpace(rawType))}
-		if i < len(epPorts) {
-			entry.Port = strings.TrimSpace(epPorts[i])
+		switch entry.Type {
+		case data.EndpointTypeSerial:
+			if i < len(epDevices) {
+				entry.Device = strings.TrimSpace(epDevices[i])
+			}
+			if i < len(epBauds) {
+				if baud, err := strconv.Atoi(strings.TrimSpace(epBauds[i])); err == nil {
+					entry.BaudRate = baud
+				}
+			}
+		case data.EndpointTypeTCP, data.EndpointTypeUDP, data.EndpointTypeHTTP:
+			if i < len(epHosts) {
+				entry.Host = strings.TrimSpace(epHosts[i])
+			}
+			if i < len(epPorts) {
+				entry.Port = strings.TrimSpace(epPorts[i])
+			}
 		}
 		if i < len(epLabels) {
 			entry.Label = strings.TrimSpace(epLabels[i])
 		}
 		if entry.Label == "" {
-			if entry.Type == data.EndpointTypeTCP {
-				entry.Label = entry.Port
-			} else {
-				entry.Label = string(entry.Type)
+			entry.Label = defaultTunnelLabel(entry)
+		}
+		if i < len(epPriorities) {
+			entry.Priority = data.TunnelPriority(strings.TrimSpace(epPriorities[i]))
+		}
+		if i < len(epMaxKbps) {
+			if kbps, err := strconv.Atoi(strings.TrimSpace(epMaxKbps[i])); err == nil && kbps > 0 {
+				entry.MaxKbps = kbps
 			}
 		}
 		tunnelEndpoints = append(tunnelEndpoints, entry)
 	}
 	if len(tunnelEndpoints) == 0 {
-		tunnelEndpoints = []data.TunnelEntry{{Type: data.EndpointTypeTCP, Port: "5760", Label: "5760"}}
+		tunnelEndpoints = []data.TunnelEntry{{Type: data.EndpointTypeTCP, Port: "5760", Label: "5760", Priority: data.TunnelPriorityControl}}
+	}
+
+	var allowedSubnets []string
+	for _, cidr := range strings.Split(r.Form.Get("tunnel_allowed_subnets"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			allowedSubnets = append(allowedSubnets, cidr)
+		}
 	}
 
 	// Build Stats config
@@ -343,12 +433,17 @@ func createDrone(w http.ResponseWriter, r *http.Request) {
 			URL: serverURL,
 		},
 		Tunnel: data.TunnelConfig{
-			Endpoints: tunnelEndpoints,
+			Endpoints:      tunnelEndpoints,
+			AllowedSubnets: allowedSubnets,
+			Multiplex:      r.Form.Get("tunnel_multiplex") == "on",
 		},
 		Stats: data.StatsConfig{
 			Enabled:  statsEnabled,
 			Interval: statsInterval,
 		},
+		Probe: data.ProbeConfig{
+			Enabled: r.Form.Get("probe_enabled") == "on",
+		},
 	}
 
 	deviceConfig.ApplyDefaults()
@@ -429,6 +524,7 @@ func updateDeviceConfig(w http.ResponseWriter, r *http.Request) {
 	cfg.UUID = droneID
 	serverURL := getServerPath(r)
 	cfg.Server.URL = serverURL
+	cfg.Version = time.Now().UnixNano()
 	cfg.ApplyDefaults()
 
 	if err := cfg.Validate(); err != nil {
@@ -442,7 +538,13 @@ func updateDeviceConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slog.Info("drone config updated", "drone_id", droneID)
+	// Ask the drone to pick up the new config on its next poll; the periodic
+	// version check catches it otherwise.
+	if _, err := queueDroneCommand(droneID, "reload_config", nil); err != nil {
+		slog.Warn("failed to queue reload_config", "drone_id", droneID, "error", err)
+	}
+
+	slog.Info("drone config updated", "drone_id", droneID, "version", cfg.Version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(cfg)
 }
@@ -466,29 +568,53 @@ func deviceStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024) // 1MB limit
-	var status data.ResourceStats
-	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+	// A single sample is sent live; a JSON array is a batch replayed from the drone's offline queue.
+	r.Body = http.MaxBytesReader(w, r.Body, 8*1024*1024) // 8MB limit
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	status.LastUpdated = time.Now().Unix()
-	if err := data.UpsertOne("drone", map[string]interface{}{"uid": droneID}, map[string]interface{}{"status": status}); err != nil {
+	var samples []data.ResourceStats
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &samples)
+	} else {
+		var status data.ResourceStats
+		err = json.Unmarshal(trimmed, &status)
+		samples = []data.ResourceStats{status}
+	}
+	if err != nil || len(samples) == 0 {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := storeStatusSamples(droneID, samples); err != nil {
 		slog.Error("failed to update drone status", "drone_id", droneID, "error", err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
 
 	var droneCommand []data.DroneCommands
-	if err := data.FindAll("drone_commands", map[string]interface{}{"drone_uid": droneID, "status": "pending"}, &droneCommand); err != nil {
+	if err := data.FindAll("drone_commands", map[string]interface{}{"drone_uid": droneID, "status": data.CommandPending}, &droneCommand); err != nil {
 		slog.Error("failed to find drone commands", "drone_id", droneID, "error", err)
 		http.Error(w, "drone not found", http.StatusNotFound)
 		return
 	}
 
-	for _, command := range droneCommand {
-		if err := data.UpdateOne("drone_commands", map[string]interface{}{"drone_uid": droneID, "_id": command.ID}, map[string]interface{}{"status": "done"}); err != nil {
+	now := time.Now()
+	for i, command := range droneCommand {
+		if command.Type == "rotate_credential" && bearerToken(r) == "" {
+			payload, err := firstCredentialPayload(droneID)
+			if err != nil {
+				slog.Error("failed to issue first credential", "drone_id", droneID, "error", err)
+				http.Error(w, "failed to issue credential", http.StatusInternalServerError)
+				return
+			}
+			droneCommand[i].Payload = payload // delivered once, never stored
+		}
+		update := map[string]interface{}{"status": data.CommandDelivered, "delivered_at": now, "updated_at": now}
+		if err := data.UpdateOne("drone_commands", map[string]interface{}{"drone_uid": droneID, "_id": command.ID}, update); err != nil {
 			slog.Error("failed to update drone commands", "drone_id", droneID, "error", err)
 			http.Error(w, "drone not found", http.StatusNotFound)
 			return
@@ -499,6 +625,85 @@ func deviceStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(droneCommand)
 }
 
+// ensureIndexes creates the indexes the server's queries rely on: status
+// history is read per drone in sample order, and expires after the retention
+// period.
+func ensureIndexes() {
+	retention := statusHistoryRetention
+	if v := os.Getenv("STATUS_HISTORY_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			slog.Warn("invalid STATUS_HISTORY_RETENTION, using default", "value", v, "default", retention)
+		} else {
+			retention = d
+		}
+	}
+
+	err := data.CreateIndexes("drone_status_history", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "drone_uid", Value: 1}, {Key: "sampled_at", Value: 1}}},
+		{Keys: bson.D{{Key: "received_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(retention / time.Second))},
+	})
+	if err != nil {
+		// An existing TTL index with another retention must be dropped by hand first.
+		slog.Error("failed to create status history indexes", "retention", retention, "error", err)
+		return
+	}
+	slog.Info("status history indexes ready", "retention", retention)
+}
+
+// storeStatusSamples appends samples to the drone's status history and makes
+// the newest one the drone's current status, unless the stored status is
+// newer (e.g. a live report overtook a replayed batch). A sample's
+// LastUpdated is when it was taken.
+func storeStatusSamples(droneID string, samples []data.ResourceStats) error {
+	received := time.Now()
+	now := received.Unix()
+
+	history := make([]interface{}, 0, len(samples))
+	latest := 0
+	for i := range samples {
+		if samples[i].SampledAt == 0 {
+			samples[i].SampledAt = now
+		}
+		samples[i].LastUpdated = samples[i].SampledAt
+		if samples[i].SampledAt >= samples[latest].SampledAt {
+			latest = i
+		}
+		history = append(history, data.StatusSample{
+			DroneUID:   droneID,
+			SampledAt:  samples[i].SampledAt,
+			ReceivedAt: received,
+			Status:     samples[i],
+			Telemetry:  samples[i].Telemetry,
+		})
+	}
+
+	if err := data.Insert("drone_status_history", history); err != nil {
+		return fmt.Errorf("insert status history: %w", err)
+	}
+
+	status := samples[latest]
+	update := map[string]interface{}{"status": status}
+	if status.Telemetry != nil {
+		update["telemetry"] = status.Telemetry
+	}
+	filter := map[string]interface{}{
+		"uid": droneID,
+		"$or": []interface{}{
+			map[string]interface{}{"status.sampled_at": map[string]interface{}{"$lt": status.SampledAt}},
+			map[string]interface{}{"status.sampled_at": map[string]interface{}{"$exists": false}},
+		},
+	}
+	if err := data.UpdateOne("drone", filter, update); err != nil {
+		return fmt.Errorf("update drone status: %w", err)
+	}
+
+	if len(samples) > 1 {
+		slog.Info("replayed status samples stored", "drone_id", droneID, "count", len(samples))
+	}
+	return nil
+}
+
 // getInstallCommand returns the install command for a specific drone
 func getInstallCommand(w http.ResponseWriter, r *http.Request) {
 	fleetID := chi.URLParam(r, "fleet_id")
@@ -520,8 +725,17 @@ func getInstallCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Each install command carries a fresh enrollment token, which invalidates
+	// any earlier command that was not used.
+	token, err := issueEnrollment(droneID)
+	if err != nil {
+		slog.Error("failed to issue enrollment token", "drone_id", droneID, "error", err)
+		http.Error(w, "failed to issue enrollment token", http.StatusInternalServerError)
+		return
+	}
+
 	serverURL := getServerPath(r)
-	command := "wget -O - " + serverURL + "/device/" + droneID + "/installer.sh > install.sh && sudo sh install.sh"
+	command := "wget -O - '" + serverURL + "/device/" + droneID + "/installer.sh?token=" + token + "' > install.sh && sudo sh install.sh"
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"command": command})
@@ -540,8 +754,15 @@ func getInstallerScript(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var drone data.Drone
+	token := r.URL.Query().Get("token")
+	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil || !validEnrollment(drone, token) {
+		http.Error(w, "invalid or expired enrollment token, generate a new install command", http.StatusUnauthorized)
+		return
+	}
+
 	serverURL := getServerPath(r)
-	script := GenerateInstallerScript(serverURL, droneID)
+	script := GenerateInstallerScript(serverURL, droneID, token)
 
 	w.Header().Set("Content-Type", "text/x-shellscript")
 	w.Write([]byte(script))
@@ -584,31 +805,233 @@ func createDroneCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Type == "update_agent" {
+		var upd data.AgentUpdate
+		if err := json.Unmarshal(req.Payload, &upd); err != nil || upd.Version == "" || upd.URL == "" || len(upd.SHA256) == 0 {
+			http.Error(w, "update_agent requires version, url and sha256", http.StatusBadRequest)
+			return
+		}
+	}
+
 	var drone data.Drone
 	if err := data.FindOne("drone", map[string]interface{}{"uid": droneID}, &drone); err != nil {
 		http.Error(w, "drone not found", http.StatusNotFound)
 		return
 	}
 
+	if req.Type == "start_tunnel" {
+		var entry data.TunnelEntry
+		if err := json.Unmarshal(req.Payload, &entry); err != nil {
+			http.Error(w, "invalid start_tunnel payload", http.StatusBadRequest)
+			return
+		}
+		if err := drone.DeviceConfig.Tunnel.CheckEndpoint(entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if entry.Type == data.EndpointTypePTY && !drone.DeviceConfig.Exec.AllowPTY {
+			http.Error(w, "interactive shells are not allowed by this drone's exec policy", http.StatusBadRequest)
+			return
+		}
+		if entry.Type == data.EndpointTypeSerial && drone.DeviceConfig.MAVLink.Enabled && slices.Contains(drone.DeviceConfig.MAVLinkSerialDevices(""), entry.Device) {
+			http.Error(w, "serial device "+entry.Device+" is used by MAVLink", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cmd, err := queueDroneCommand(droneID, req.Type, req.Payload)
+	if err != nil {
+		slog.Error("failed to create drone command", "drone_id", droneID, "error", err)
+		http.Error(w, "failed to create drone command", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("drone command created", "drone_id", droneID, "type", cmd.Type)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cmd)
+}
+
+// defaultTunnelLabel names a tunnel endpoint that was saved without a label.
+func defaultTunnelLabel(entry data.TunnelEntry) string {
+	var label string
+	switch entry.Type {
+	case data.EndpointTypeTCP:
+		label = entry.Port
+	case data.EndpointTypeUDP:
+		label = "udp-" + entry.Port
+	case data.EndpointTypeHTTP:
+		label = "http-" + entry.Port
+	case data.EndpointTypeSerial:
+		return "serial-" + filepath.Base(entry.Device)
+	default:
+		return string(entry.Type)
+	}
+	if !entry.IsLocal() {
+		label = entry.Host + "-" + label
+	}
+	return label
+}
+
+// queueDroneCommand stores a pending command for the drone to pick up on its next status report.
+func queueDroneCommand(droneID, cmdType string, payload json.RawMessage) (data.DroneCommands, error) {
 	now := time.Now()
 	cmd := data.DroneCommands{
 		ID:        data.GenerateObjectID(),
 		DroneUID:  droneID,
-		Type:      req.Type,
-		Payload:   req.Payload,
-		Status:    "pending",
+		Type:      cmdType,
+		Payload:   payload,
+		Status:    data.CommandPending,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
-
 	if err := data.InsertOne("drone_commands", cmd); err != nil {
-		slog.Error("failed to create drone command", "drone_id", droneID, "error", err)
-		http.Error(w, "failed to create drone command", http.StatusInternalServerError)
+		return cmd, err
+	}
+	return cmd, nil
+}
+
+// commandResults records the outcome of commands reported by the drone.
+func commandResults(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	if droneID == "" {
+		http.Error(w, "missing drone_id", http.StatusBadRequest)
 		return
 	}
 
-	slog.Info("drone command created", "drone_id", droneID, "type", cmd.Type)
-	w.Header().Set("Content-Type", "application/json")
+	r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024)
+
+	var results []data.CommandResult
+	if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	for _, result := range results {
+		update := map[string]interface{}{
+			"status":      data.CommandAcknowledged,
+			"error":       "",
+			"executed_at": result.ExecutedAt,
+			"updated_at":  now,
+		}
+		if !result.Success {
+			update["status"] = data.CommandFailed
+			update["error"] = result.Error
+		}
+		if err := data.UpdateOne("drone_commands", map[string]interface{}{"drone_uid": droneID, "_id": result.ID}, update); err != nil {
+			slog.Error("failed to update drone command result", "drone_id", droneID, "command_id", result.ID.Hex(), "error", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("drone command result", "drone_id", droneID, "command_id", result.ID.Hex(), "status", update["status"])
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// execAudit stores the audit trail of commands run through the drone's cmd tunnels.
+func execAudit(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	if !validUID.MatchString(droneID) {
+		http.Error(w, "invalid drone_id", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4*1024*1024)
+
+	var records []data.ExecAudit
+	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(records) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, len(records))
+	for i, rec := range records {
+		rec.DroneUID = droneID
+		rec.ReceivedAt = now
+		docs[i] = rec
+		if !rec.Allowed {
+			slog.Warn("drone rejected command", "drone_id", droneID, "command", rec.Command, "error", rec.Error)
+		}
+	}
+	if err := data.Insert("drone_exec_audit", docs); err != nil {
+		slog.Error("failed to store exec audit", "drone_id", droneID, "error", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("exec audit stored", "drone_id", droneID, "count", len(records))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadTLog stores a .tlog file pushed by the drone in response to an upload_tlog command.
+func uploadTLog(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	name := chi.URLParam(r, "name")
+	if !validUID.MatchString(droneID) || !validTLogName.MatchString(name) {
+		http.Error(w, "invalid drone_id or name", http.StatusBadRequest)
+		return
+	}
+
+	dir := filepath.Join(tlogStoreDir, droneID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("failed to create tlog dir", "drone_id", droneID, "error", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<30) // 1GB limit
+
+	// Write to a temp file first so a partial upload never replaces a complete one.
+	tmp, err := os.CreateTemp(dir, name+".*.part")
+	if err != nil {
+		slog.Error("failed to create tlog file", "drone_id", droneID, "error", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.Error("failed to receive tlog", "drone_id", droneID, "name", name, "error", err)
+		http.Error(w, "failed to receive file", http.StatusBadRequest)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		slog.Error("failed to store tlog", "drone_id", droneID, "name", name, "error", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("tlog received", "drone_id", droneID, "name", name, "bytes", n)
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(cmd)
+}
+
+// downloadTLog serves a .tlog file previously uploaded by the drone.
+func downloadTLog(w http.ResponseWriter, r *http.Request) {
+	droneID := chi.URLParam(r, "drone_id")
+	name := chi.URLParam(r, "name")
+	if !validUID.MatchString(droneID) || !validTLogName.MatchString(name) {
+		http.Error(w, "invalid drone_id or name", http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(tlogStoreDir, droneID, name)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "log not uploaded yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeFile(w, r, path)
 }
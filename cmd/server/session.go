@@ -65,6 +65,8 @@ func logout(w http.ResponseWriter, r *http.Request) {
 		if userID, ok := sessions.LoadAndDelete(cookie.Value); ok {
 			slog.Info("user logged out", "email", userID)
 		}
+		stopSOCKSProxies(cookie.Value)
+		dropProxyGrants(cookie.Value)
 	}
 	http.SetCookie(w, &http.Cookie{
 		Name:   "session",
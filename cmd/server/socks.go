@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KunalDuran/dronnayak-core/internal/data"
+	"github.com/go-chi/chi/v5"
+)
+
+const socksHandshakeTimeout = 30 * time.Second
+
+// socksProxies maps session token + "|" + drone UID -> *socksProxy.
+var socksProxies sync.Map
+
+// socksProxy is a SOCKS5 listener on the server that belongs to one login
+// session and forwards every connection as a mux stream to a drone's socks5
+// endpoint, where the target is dialled subject to the tunnel allowlist.
+// Every client must authenticate with the generated username and password.
+//
+// It listens on SOCKS_BIND, 127.0.0.1 by default, so it is reached through
+// an SSH port forward unless the server is configured to expose it.
+type socksProxy struct {
+	key      string
+	token    string
+	droneUID string
+	topic    string
+	username string
+	password string
+	ln       net.Listener
+	relay    *relayMux
+
+	closeOnce sync.Once
+}
+
+type socksProxyInfo struct {
+	Topic    string `json:"topic"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// manageSOCKSProxy starts (POST), describes (GET) or stops (DELETE) the
+// caller's SOCKS5 proxy into the drone's network.
+//
+// GET|POST|DELETE /device/{drone_id}/socks
+func manageSOCKSProxy(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		http.Error(w, "missing session", http.StatusUnauthorized)
+		return
+	}
+	droneID := chi.URLParam(r, "drone_id")
+	if !validUID.MatchString(droneID) {
+		http.Error(w, "invalid drone_id", http.StatusBadRequest)
+		return
+	}
+	key := cookie.Value + "|" + droneID
+
+	switch r.Method {
+	case http.MethodDelete:
+		if v, ok := socksProxies.Load(key); ok {
+			v.(*socksProxy).Close()
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case http.MethodGet:
+		v, ok := socksProxies.Load(key)
+		if !ok {
+			http.Error(w, "no proxy running", http.StatusNotFound)
+			return
+		}
+		writeSOCKSProxyInfo(w, r, v.(*socksProxy))
+		return
+	}
+
+	if v, ok := socksProxies.Load(key); ok {
+		writeSOCKSProxyInfo(w, r, v.(*socksProxy))
+		return
+	}
+
+	topic, drone, err := droneEndpointTopic(r, data.EndpointTypeSOCKS5)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := newSOCKSProxy(key, cookie.Value, drone.UID, topic, getServerPath(r))
+	if err != nil {
+		slog.Error("socks: failed to start proxy", "drone_id", droneID, "error", err)
+		http.Error(w, "failed to start proxy", http.StatusInternalServerError)
+		return
+	}
+	if existing, loaded := socksProxies.LoadOrStore(key, p); loaded {
+		p.ln.Close()
+		p = existing.(*socksProxy)
+	} else {
+		go p.serve()
+		slog.Info("socks proxy started", "drone_id", droneID, "topic", topic, "addr", p.ln.Addr(), "user", GetUserIDFromSession(r))
+	}
+	writeSOCKSProxyInfo(w, r, p)
+}
+
+func writeSOCKSProxyInfo(w http.ResponseWriter, r *http.Request, p *socksProxy) {
+	addr := p.ln.Addr().(*net.TCPAddr)
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(socksProxyInfo{
+		Topic:    p.topic,
+		Host:     host,
+		Port:     addr.Port,
+		Username: p.username,
+		Password: p.password,
+	})
+}
+
+func newSOCKSProxy(key, token, droneUID, topic, serverBase string) (*socksProxy, error) {
+	bind := os.Getenv("SOCKS_BIND")
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(bind, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	creds := make([]byte, 16)
+	rand.Read(creds)
+	return &socksProxy{
+		key:      key,
+		token:    token,
+		droneUID: droneUID,
+		topic:    topic,
+		username: "u" + hex.EncodeToString(creds[:4]),
+		password: hex.EncodeToString(creds[4:]),
+		ln:       ln,
+		relay:    newRelayMux(serverBase, topic),
+	}, nil
+}
+
+// Close stops the listener and the relay connection.
+func (p *socksProxy) Close() error {
+	p.closeOnce.Do(func() {
+		socksProxies.CompareAndDelete(p.key, p)
+		p.ln.Close()
+		p.relay.Close()
+		slog.Info("socks proxy stopped", "drone_id", p.droneUID, "topic", p.topic)
+	})
+	return nil
+}
+
+func (p *socksProxy) serve() {
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			p.Close()
+			return
+		}
+		// The proxy must not outlive the login session it was started from.
+		if _, ok := sessions.Load(p.token); !ok {
+			c.Close()
+			p.Close()
+			return
+		}
+		go p.handle(c)
+	}
+}
+
+// handle authenticates a SOCKS5 client, then opens a stream to the drone,
+// completes the method negotiation with it and hands the rest of the
+// connection (the CONNECT request and the data) through unchanged.
+func (p *socksProxy) handle(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	if err := p.authenticate(c); err != nil {
+		slog.Warn("socks: client rejected", "drone_id", p.droneUID, "remote", c.RemoteAddr(), "error", err)
+		return
+	}
+
+	st, err := p.relay.Open()
+	if err != nil {
+		slog.Error("socks: failed to open stream", "topic", p.topic, "error", err)
+		return
+	}
+	defer st.Close()
+
+	// Streams have no deadlines; give up on a drone that does not answer.
+	timer := time.AfterFunc(socksHandshakeTimeout, func() { st.Close() })
+	if _, err := st.Write([]byte{5, 1, 0}); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(st, reply); err != nil || reply[1] != 0 {
+		slog.Warn("socks: drone rejected handshake", "topic", p.topic, "error", err)
+		return
+	}
+	if !timer.Stop() {
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(st, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, st)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// authenticate runs the server side of the method negotiation, which always
+// requires username/password authentication (RFC 1929).
+func (p *socksProxy) authenticate(c net.Conn) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != 5 {
+		return fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+
+	if !slices.Contains(methods, 0x02) {
+		c.Write([]byte{5, 0xff})
+		return fmt.Errorf("no acceptable authentication method")
+	}
+	if _, err := c.Write([]byte{5, 0x02}); err != nil {
+		return err
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	ver := make([]byte, 2)
+	if _, err := io.ReadFull(c, ver); err != nil {
+		return err
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(c, plen); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(user, []byte(p.username)) != 1 || subtle.ConstantTimeCompare(pass, []byte(p.password)) != 1 {
+		c.Write([]byte{1, 1})
+		return fmt.Errorf("invalid credentials")
+	}
+	_, err := c.Write([]byte{1, 0})
+	return err
+}
+
+// stopSOCKSProxies stops every proxy started from the login session token.
+func stopSOCKSProxies(token string) {
+	socksProxies.Range(func(k, v interface{}) bool {
+		if strings.HasPrefix(k.(string), token+"|") {
+			v.(*socksProxy).Close()
+		}
+		return true
+	})
+}
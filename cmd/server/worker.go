@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/KunalDuran/gowsrelay/client"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
 )
@@ -17,6 +18,30 @@ import (
 // WorkerFunc processes a single binary message received from a relay topic.
 type WorkerFunc func(ctx context.Context, data []byte) error
 
+// TopicSender publishes binary messages back onto a worker's relay topic,
+// e.g. replies that should reach the drone. It is only connected while the
+// worker is subscribed.
+type TopicSender struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// Send writes data to the topic as a single binary message.
+func (s *TopicSender) Send(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return fmt.Errorf("worker is not subscribed")
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (s *TopicSender) bind(conn *websocket.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+}
+
 type workerEntry struct {
 	cancel context.CancelFunc
 	done   <-chan struct{}
@@ -29,8 +54,9 @@ var (
 
 // StartTopicWorker subscribes to the relay topic and calls fn for each binary
 // message. teardown is deferred when the goroutine exits — use it to close
-// resources opened during worker setup (e.g. a file handle).
-func StartTopicWorker(parentCtx context.Context, wsBase, topic string, fn WorkerFunc, teardown func()) error {
+// resources opened during worker setup (e.g. a file handle). sender, if not
+// nil, is connected to the topic for the lifetime of the subscription.
+func StartTopicWorker(parentCtx context.Context, wsBase, topic string, fn WorkerFunc, teardown func(), sender *TopicSender) error {
 	workersMu.Lock()
 	defer workersMu.Unlock()
 
@@ -58,13 +84,21 @@ func StartTopicWorker(parentCtx context.Context, wsBase, topic string, fn Worker
 		if teardown != nil {
 			defer teardown()
 		}
-		runTopicWorker(ctx, wsURL, topic, fn)
+		runTopicWorker(ctx, wsURL, topic, fn, sender)
 	}()
 
 	slog.Info("worker started", "topic", topic)
 	return nil
 }
 
+// TopicWorkerRunning reports whether a worker is subscribed to topic.
+func TopicWorkerRunning(topic string) bool {
+	workersMu.RLock()
+	defer workersMu.RUnlock()
+	_, exists := workers[topic]
+	return exists
+}
+
 // StopTopicWorker cancels the running worker for topic and waits for it to exit.
 func StopTopicWorker(topic string) {
 	workersMu.RLock()
@@ -78,14 +112,19 @@ func StopTopicWorker(topic string) {
 	slog.Info("worker stopped", "topic", topic)
 }
 
-func runTopicWorker(ctx context.Context, wsURL, topic string, fn WorkerFunc) {
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+func runTopicWorker(ctx context.Context, wsURL, topic string, fn WorkerFunc, sender *TopicSender) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, relayHeader())
 	if err != nil {
 		slog.Error("worker: dial failed", "topic", topic, "error", err)
 		return
 	}
 	defer conn.Close()
 
+	if sender != nil {
+		sender.bind(conn)
+		defer sender.bind(nil)
+	}
+
 	// Force-close the WebSocket when context is cancelled so ReadMessage unblocks.
 	go func() {
 		<-ctx.Done()
@@ -133,11 +172,27 @@ func relaySubscriberURL(serverBase, topic string) (string, error) {
 	return u.String(), nil
 }
 
+// relayProducerConfig returns the tunnel config for publishing to one of
+// droneID's topics on the relay, as the drone does.
+func relayProducerConfig(serverBase, droneID, topic string) (client.TunnelConfig, error) {
+	u, err := url.Parse(serverBase)
+	if err != nil {
+		return client.TunnelConfig{}, fmt.Errorf("parse server base: %w", err)
+	}
+	scheme := "ws"
+	if u.Scheme == "https" {
+		scheme = "wss"
+	}
+	return client.TunnelConfig{Topic: topic, Host: u.Host, Path: relayPath(droneID, issueRelayTicket(droneID, "")), Scheme: scheme}, nil
+}
+
 // manageWorker handles POST (start) and DELETE (stop) for topic workers.
 //
 // POST   /device/{drone_id}/worker
 //
 //	{"type": "file-writer", "topic": "<droneUID>_<label>", "options": {"path": "/tmp/out.bin"}}
+//	{"type": "udp-forwarder", "topic": "<droneUID>_<label>", "options": {"address": "10.0.0.5:14550"}}
+//	{"type": "echo", "topic": "<droneUID>_<label>"}
 //
 // DELETE /device/{drone_id}/worker?topic=<droneUID>_<label>
 func manageWorker(w http.ResponseWriter, r *http.Request) {
@@ -173,12 +228,17 @@ func manageWorker(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "type and topic are required", http.StatusBadRequest)
 		return
 	}
+	if execTopic(req.Topic) {
+		http.Error(w, "workers cannot attach to cmd or pty tunnels", http.StatusForbidden)
+		return
+	}
 
 	wsBase := getServerPath(r)
 
 	var (
 		fn       WorkerFunc
 		teardown func()
+		sender   *TopicSender
 		err      error
 		filePath string
 	)
@@ -193,12 +253,35 @@ func manageWorker(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+	case "udp-forwarder":
+		var opts struct {
+			Address string `json:"address"`
+		}
+		if err := json.Unmarshal(req.Options, &opts); err != nil || opts.Address == "" {
+			http.Error(w, "udp-forwarder requires options.address", http.StatusBadRequest)
+			return
+		}
+		sender = &TopicSender{}
+		fn, teardown, err = UDPForwarderWorker(opts.Address, sender)
+		if err != nil {
+			slog.Error("failed to init udp-forwarder worker", "error", err)
+			http.Error(w, "failed to create udp forwarder: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	case "echo":
+		sender = &TopicSender{}
+		fn = EchoWorker(sender)
+
 	default:
 		http.Error(w, "unknown worker type: "+req.Type, http.StatusBadRequest)
 		return
 	}
 
-	if err := StartTopicWorker(context.Background(), wsBase, req.Topic, fn, teardown); err != nil {
+	if err := StartTopicWorker(context.Background(), wsBase, req.Topic, fn, teardown, sender); err != nil {
+		if teardown != nil {
+			teardown() // release the file or socket the worker was set up with
+		}
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
 )
@@ -32,3 +34,54 @@ func FileWriterWorker(filePath string) (WorkerFunc, func(), error) {
 	}
 	return fn, teardown, nil
 }
+
+// UDPForwarderWorker sends every received message to address as one UDP
+// datagram, and publishes each datagram that comes back from address to the
+// topic through sender, so the drone receives replies datagram by datagram.
+func UDPForwarderWorker(address string, sender *TopicSender) (WorkerFunc, func(), error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolve udp address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial udp: %w", err)
+	}
+	slog.Info("udp forwarder opened", "address", address, "local", conn.LocalAddr().String())
+
+	go func() {
+		buf := make([]byte, 65507)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// ICMP port unreachable surfaces here while nothing listens on address; keep going.
+				slog.Debug("udp forwarder read error", "address", address, "error", err)
+				continue
+			}
+			if err := sender.Send(buf[:n]); err != nil {
+				slog.Debug("udp forwarder reply dropped", "address", address, "error", err)
+			}
+		}
+	}()
+
+	fn := func(_ context.Context, data []byte) error {
+		_, err := conn.Write(data)
+		return err
+	}
+	teardown := func() {
+		conn.Close()
+		slog.Info("udp forwarder closed", "address", address)
+	}
+	return fn, teardown, nil
+}
+
+// EchoWorker publishes every received message back to the topic through
+// sender unchanged, e.g. for drones to measure round trips through the relay.
+func EchoWorker(sender *TopicSender) WorkerFunc {
+	return func(_ context.Context, data []byte) error {
+		return sender.Send(data)
+	}
+}
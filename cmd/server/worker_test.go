@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// openFDs returns how many file descriptors the process has open.
+func openFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count open files: %v", err)
+	}
+	return len(entries)
+}
+
+func TestManageWorkerConflictReleasesForwarder(t *testing.T) {
+	// A relay that keeps worker subscriptions open.
+	subscribed := make(chan struct{}, 1)
+	upgrader := websocket.Upgrader{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		subscribed <- struct{}{}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer relay.Close()
+
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer target.Close()
+
+	const topic = "forwarded" // no drone prefix, so no exec topic lookup
+	defer StopTopicWorker(topic)
+
+	post := func() int {
+		body := `{"type":"udp-forwarder","topic":"` + topic + `","options":{"address":"` + target.LocalAddr().String() + `"}}`
+		r := httptest.NewRequest(http.MethodPost, "/device/d1/workers", strings.NewReader(body))
+		r.Host = strings.TrimPrefix(relay.URL, "http://")
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("drone_id", "d1")
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		manageWorker(w, r)
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusCreated {
+		t.Fatalf("first start: status %d, want %d", code, http.StatusCreated)
+	}
+	select {
+	case <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not subscribe")
+	}
+
+	before := openFDs(t)
+	if code := post(); code != http.StatusConflict {
+		t.Fatalf("second start: status %d, want %d", code, http.StatusConflict)
+	}
+	if after := openFDs(t); after != before {
+		t.Fatalf("open files went from %d to %d: the second forwarder's socket leaked", before, after)
+	}
+}
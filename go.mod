@@ -11,8 +11,10 @@ require (
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/matoous/go-nanoid/v2 v2.1.0
+	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	go.mongodb.org/mongo-driver v1.17.0
 	golang.org/x/crypto v0.26.0
+	golang.org/x/sys v0.36.0
 )
 
 require (
@@ -22,7 +24,6 @@ require (
 	github.com/montanaflynn/stats v0.7.1 // indirect
 	github.com/pion/transport/v2 v2.2.4 // indirect
 	github.com/shirou/gopsutil v3.21.11+incompatible // indirect
-	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07 // indirect
 	github.com/tklauser/go-sysconf v0.3.15 // indirect
 	github.com/tklauser/numcpus v0.10.0 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
@@ -32,6 +33,5 @@ require (
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
 	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.36.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 )
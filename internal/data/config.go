@@ -1,18 +1,36 @@
 package data
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 )
 
+// Where a running client got its config from.
+const (
+	ConfigSourceServer    = "server"    // fetched from the server
+	ConfigSourceCache     = "cache"     // last config fetched from the server, read from disk
+	ConfigSourceBootstrap = "bootstrap" // local config.json
+)
+
 // Config holds all application configuration
 type Config struct {
 	// Device identification
 	UUID string `json:"uuid" bson:"uuid"`
 
+	// Version changes every time the config is saved on the server
+	Version int64 `json:"version" bson:"version"`
+
 	// MAVLink configuration
 	MAVLink MAVLinkConfig `json:"mavlink" bson:"mavlink"`
 
@@ -24,52 +42,315 @@ type Config struct {
 
 	// Stats configuration
 	Stats StatsConfig `json:"stats" bson:"stats"`
+
+	// Link latency and loss measurement, reported with stats
+	Probe ProbeConfig `json:"probe" bson:"probe"`
+
+	// Agent self-update configuration
+	Update UpdateConfig `json:"update" bson:"update"`
+
+	// What the cmd tunnel endpoint may execute
+	Exec ExecPolicy `json:"exec" bson:"exec"`
+
+	// Where the file tunnel endpoint may read and write
+	Files FileTransferConfig `json:"files" bson:"files"`
 }
 
 type MAVLinkConfig struct {
-	Enabled         bool   `json:"enabled" bson:"enabled"`                   // Default: false
-	SerialPort      string `json:"serial_port" bson:"serial_port"`           // Override auto-detection
-	BaudRate        int    `json:"baud_rate" bson:"baud_rate"`               // Default: 57600
-	TCPAddress      string `json:"tcp_address" bson:"tcp_address"`           // Default: 0.0.0.0:5760
-	StreamFrequency int    `json:"stream_frequency" bson:"stream_frequency"` // Hz, 0 = disabled
-	OutSystemID     byte   `json:"out_system_id" bson:"out_system_id"`       // Default: 255
+	Enabled         bool              `json:"enabled" bson:"enabled"`                   // Default: false
+	SerialPort      string            `json:"serial_port" bson:"serial_port"`           // Override auto-detection
+	BaudRate        int               `json:"baud_rate" bson:"baud_rate"`               // Default: 57600
+	TCPAddress      string            `json:"tcp_address" bson:"tcp_address"`           // Default: 0.0.0.0:5760
+	StreamFrequency int               `json:"stream_frequency" bson:"stream_frequency"` // Hz, 0 = disabled
+	OutSystemID     byte              `json:"out_system_id" bson:"out_system_id"`       // Default: 255
+	Endpoints       []MAVLinkEndpoint `json:"endpoints" bson:"endpoints"`               // Default: serial + tcp-server built from the fields above
+	TLog            TLogConfig        `json:"tlog" bson:"tlog"`                         // Onboard .tlog recording
+}
+
+// TLogConfig controls onboard recording of every MAVLink frame in .tlog format.
+type TLogConfig struct {
+	Enabled      bool          `json:"enabled" bson:"enabled"`               // Default: false
+	Directory    string        `json:"directory" bson:"directory"`           // Default: tlogs (relative to the working directory)
+	MaxFileSize  int64         `json:"max_file_size" bson:"max_file_size"`   // bytes, rotate when exceeded, default: 64 MiB
+	MaxFileAge   time.Duration `json:"max_file_age" bson:"max_file_age"`     // rotate when exceeded, default: 1h
+	MaxTotalSize int64         `json:"max_total_size" bson:"max_total_size"` // bytes, oldest logs are deleted beyond this, default: 1 GiB
 }
 
+type MAVLinkEndpointType string
+
+const (
+	MAVLinkEndpointSerial       MAVLinkEndpointType = "serial"
+	MAVLinkEndpointTCPServer    MAVLinkEndpointType = "tcp-server"
+	MAVLinkEndpointTCPClient    MAVLinkEndpointType = "tcp-client"
+	MAVLinkEndpointUDPServer    MAVLinkEndpointType = "udp-server"
+	MAVLinkEndpointUDPClient    MAVLinkEndpointType = "udp-client"
+	MAVLinkEndpointUDPBroadcast MAVLinkEndpointType = "udp-broadcast"
+)
+
+// MAVLinkEndpoint describes a single endpoint attached to the MAVLink node.
+type MAVLinkEndpoint struct {
+	Type         MAVLinkEndpointType `json:"type" bson:"type"`
+	Address      string              `json:"address" bson:"address"`                                 // host:port; serial device path (empty = auto-detect); broadcast address for udp-broadcast
+	BaudRate     int                 `json:"baud_rate,omitempty" bson:"baud_rate,omitempty"`         // serial only, default: MAVLinkConfig.BaudRate
+	LocalAddress string              `json:"local_address,omitempty" bson:"local_address,omitempty"` // udp-broadcast only, default: 0.0.0.0:<port of Address>
+
+	// Filtering applies to frames forwarded to this endpoint; frames it sends are never filtered.
+	AllowMessages []uint32           `json:"allow_messages,omitempty" bson:"allow_messages,omitempty"` // message IDs to forward, empty = all
+	DenyMessages  []uint32           `json:"deny_messages,omitempty" bson:"deny_messages,omitempty"`   // message IDs to drop
+	RateLimits    []MAVLinkRateLimit `json:"rate_limits,omitempty" bson:"rate_limits,omitempty"`       // per-message max forwarding rates
+}
+
+// MAVLinkRateLimit caps how often a message ID is forwarded to an endpoint.
+type MAVLinkRateLimit struct {
+	MessageID uint32  `json:"message_id" bson:"message_id"`
+	MaxRate   float64 `json:"max_rate" bson:"max_rate"` // Hz
+}
+
+// ServerConfig lists the servers a drone may talk to. URL is preferred;
+// FailoverURLs are tried in order while it is unreachable, and the drone
+// fails back once a more preferred server is healthy again.
 type ServerConfig struct {
-	URL string `json:"url" bson:"url"` // Base server URL
+	URL                 string        `json:"url" bson:"url"`                                                         // Base server URL
+	FailoverURLs        []string      `json:"failover_urls,omitempty" bson:"failover_urls,omitempty"`                 // Tried in order after URL
+	DiscoveryURL        string        `json:"discovery_url,omitempty" bson:"discovery_url,omitempty"`                 // ServerDiscovery document; once fetched, its list replaces URL and FailoverURLs
+	ConfigCheckInterval time.Duration `json:"config_check_interval" bson:"config_check_interval"`                     // How often to poll for a new config version, default: 5m
+	HealthCheckInterval time.Duration `json:"health_check_interval,omitempty" bson:"health_check_interval,omitempty"` // How often servers are health checked, default: 30s
+	FailoverAfter       int           `json:"failover_after,omitempty" bson:"failover_after,omitempty"`               // Consecutive failed or passed checks before switching server, default: 3
+}
+
+// ServerDiscovery is the document served at ServerConfig.DiscoveryURL.
+type ServerDiscovery struct {
+	Servers []string `json:"servers"` // Base server URLs, most preferred first
+}
+
+// Servers returns URL followed by FailoverURLs, without duplicates.
+func (s ServerConfig) Servers() []string {
+	return uniqueServerURLs(append([]string{s.URL}, s.FailoverURLs...))
+}
+
+// uniqueServerURLs drops empty and repeated URLs, and trailing slashes, keeping order.
+func uniqueServerURLs(urls []string) []string {
+	seen := make(map[string]bool, len(urls))
+	var unique []string
+	for _, u := range urls {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		unique = append(unique, u)
+	}
+	return unique
+}
+
+// CheckServerURL reports whether u can be used as a base server URL.
+func CheckServerURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("invalid server URL %q: %w", u, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("server URL %q must be an absolute http or https URL", u)
+	}
+	return nil
+}
+
+// FetchServerDiscovery downloads the discovery document at discoveryURL and
+// returns its servers, most preferred first.
+func FetchServerDiscovery(discoveryURL string) ([]string, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(discoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch server discovery: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server discovery returned status %d", resp.StatusCode)
+	}
+
+	var doc ServerDiscovery
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode server discovery: %w", err)
+	}
+	servers := uniqueServerURLs(doc.Servers)
+	for _, u := range servers {
+		if err := CheckServerURL(u); err != nil {
+			return nil, err
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("server discovery lists no servers")
+	}
+	return servers, nil
 }
 
 type EndpointType string
 
 const (
-	EndpointTypeTCP EndpointType = "tcp"
-	EndpointTypeCmd EndpointType = "cmd"
+	EndpointTypeTCP    EndpointType = "tcp"
+	EndpointTypeUDP    EndpointType = "udp"
+	EndpointTypeCmd    EndpointType = "cmd"
+	EndpointTypeSerial EndpointType = "serial"
+	EndpointTypePTY    EndpointType = "pty"
+	EndpointTypeFile   EndpointType = "file"
+	EndpointTypeSOCKS5 EndpointType = "socks5"
+	EndpointTypeHTTP   EndpointType = "http"
+)
+
+// TunnelPriority ranks a tunnel's uplink traffic against the others'.
+type TunnelPriority string
+
+const (
+	TunnelPriorityControl TunnelPriority = "control" // telemetry and control; always sent first
+	TunnelPriorityNormal  TunnelPriority = "normal"
+	TunnelPriorityBulk    TunnelPriority = "bulk" // video, file transfers; backs off when the uplink saturates
 )
 
+// ProbeTunnelLabel is the label of the tunnel link probes are echoed on.
+const ProbeTunnelLabel = "probe"
+
 // TunnelEntry describes a single tunnel endpoint in config.
 type TunnelEntry struct {
-	Type  EndpointType `json:"type" bson:"type"`   // "tcp" or "cmd"
-	Port  string       `json:"port" bson:"port"`   // required for "tcp" type
-	Label string       `json:"label" bson:"label"` // optional human-readable label / tunnel suffix
+	Type     EndpointType   `json:"type" bson:"type"`                               // "tcp", "udp", "serial", "cmd", "pty", "file", "socks5" or "http"
+	Host     string         `json:"host,omitempty" bson:"host,omitempty"`           // "tcp", "udp" and "http" target, default: localhost
+	Port     string         `json:"port" bson:"port"`                               // required for "tcp", "udp" and "http" types
+	Device   string         `json:"device,omitempty" bson:"device,omitempty"`       // required for "serial", e.g. /dev/ttyUSB0
+	BaudRate int            `json:"baud_rate,omitempty" bson:"baud_rate,omitempty"` // "serial" only, default: 57600
+	Label    string         `json:"label" bson:"label"`                             // optional human-readable label / tunnel suffix
+	Priority TunnelPriority `json:"priority,omitempty" bson:"priority,omitempty"`   // "control", "normal" or "bulk", default: normal
+	MaxKbps  int            `json:"max_kbps,omitempty" bson:"max_kbps,omitempty"`   // uplink cap in kbit/s, 0 for none
+}
+
+// IsLocal reports whether the endpoint targets the drone itself.
+func (e TunnelEntry) IsLocal() bool {
+	if e.Host == "" || e.Host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(e.Host)
+	return ip != nil && ip.IsLoopback()
 }
 
 type TunnelConfig struct {
-	Endpoints []TunnelEntry `json:"endpoints" bson:"endpoints"` // per-tunnel endpoint config
-	WSPath    string        `json:"ws_path" bson:"ws_path"`     // WebSocket path, default: /ws
+	Endpoints      []TunnelEntry `json:"endpoints" bson:"endpoints"`                                 // per-tunnel endpoint config
+	WSPath         string        `json:"ws_path" bson:"ws_path"`                                     // WebSocket path, default: /ws
+	AllowedSubnets []string      `json:"allowed_subnets,omitempty" bson:"allowed_subnets,omitempty"` // CIDRs tunnels may reach besides localhost, e.g. 192.168.144.0/24
+	Multiplex      bool          `json:"multiplex" bson:"multiplex"`                                 // carry all tunnels over one connection to the server, default: false
+}
+
+// CheckEndpoint reports whether the tunnel endpoint may be opened. Localhost
+// is always allowed; any other host must be an IP address inside one of
+// AllowedSubnets. Hostnames are rejected so DNS cannot route around the list.
+// Serial endpoints must name a device.
+func (t TunnelConfig) CheckEndpoint(e TunnelEntry) error {
+	switch e.Priority {
+	case "", TunnelPriorityControl, TunnelPriorityNormal, TunnelPriorityBulk:
+	default:
+		return fmt.Errorf("unknown tunnel priority %q", e.Priority)
+	}
+	if e.MaxKbps < 0 {
+		return fmt.Errorf("invalid bandwidth cap: %d kbps", e.MaxKbps)
+	}
+	if e.Label == ProbeTunnelLabel {
+		return fmt.Errorf("tunnel label %q is reserved for link probes", e.Label)
+	}
+
+	switch e.Type {
+	case EndpointTypeCmd, EndpointTypePTY, EndpointTypeFile, EndpointTypeSOCKS5:
+		if e.Host != "" {
+			return fmt.Errorf("%s endpoints do not take a host", e.Type)
+		}
+		return nil
+	case EndpointTypeSerial:
+		if e.Host != "" {
+			return fmt.Errorf("serial endpoints do not take a host")
+		}
+		if e.Device == "" {
+			return fmt.Errorf("serial endpoints require a device")
+		}
+		if e.BaudRate < 0 {
+			return fmt.Errorf("invalid baud rate: %d", e.BaudRate)
+		}
+		return nil
+	}
+	if e.IsLocal() {
+		return nil
+	}
+
+	ip := net.ParseIP(e.Host)
+	if ip == nil {
+		return fmt.Errorf("tunnel host %q must be an IP address", e.Host)
+	}
+	for _, cidr := range t.AllowedSubnets {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid allowed subnet %q: %w", cidr, err)
+		}
+		if subnet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tunnel host %s is not in an allowed subnet", e.Host)
 }
 
 type StatsConfig struct {
-	Enabled  bool          `json:"enabled" bson:"enabled"`   // Default: true
-	Interval time.Duration `json:"interval" bson:"interval"` // Default: 5s
-	Endpoint string        `json:"endpoint" bson:"endpoint"` // Default: /device-status/{uuid}
+	Enabled    bool          `json:"enabled" bson:"enabled"`         // Default: true
+	Interval   time.Duration `json:"interval" bson:"interval"`       // Default: 5s
+	Endpoint   string        `json:"endpoint" bson:"endpoint"`       // Default: /device-status/{uuid}
+	QueueDir   string        `json:"queue_dir" bson:"queue_dir"`     // Offline sample queue, default: queue (relative to the working directory)
+	QueueLimit int           `json:"queue_limit" bson:"queue_limit"` // Max queued samples, oldest dropped first, default: 17280 (24h at 5s)
+	BatchSize  int           `json:"batch_size" bson:"batch_size"`   // Max samples per replay request, default: 50
+}
+
+// ProbeConfig controls the link probes sent to the server over the control
+// path and through the relay.
+type ProbeConfig struct {
+	Enabled  bool          `json:"enabled" bson:"enabled"`   // Default: false
+	Interval time.Duration `json:"interval" bson:"interval"` // Default: 2s
+	Timeout  time.Duration `json:"timeout" bson:"timeout"`   // unanswered probes count as lost after this, default: 5s
+}
+
+type UpdateConfig struct {
+	PublicKey      string        `json:"public_key" bson:"public_key"`             // Base64 ed25519 key; when set, updates must carry a valid signature
+	CheckInTimeout time.Duration `json:"check_in_timeout" bson:"check_in_timeout"` // A new version that has not reached the server by then is rolled back, default: 2m
+}
+
+// ExecPolicy restricts what the cmd tunnel endpoint may run. Commands are
+// executed directly, never through a shell, and only when allowed by
+// AllowedCommands or AllowedPatterns; with both empty nothing may run.
+type ExecPolicy struct {
+	AllowedCommands []string      `json:"allowed_commands" bson:"allowed_commands"` // programs that may run with any arguments, by name (looked up in PATH) or absolute path
+	AllowedPatterns []string      `json:"allowed_patterns" bson:"allowed_patterns"` // regexes that must match the whole command line, e.g. journalctl -u \w+ -n \d+
+	AllowPTY        bool          `json:"allow_pty" bson:"allow_pty"`               // pty endpoints may start interactive login shells, default: off
+	RunAs           string        `json:"run_as" bson:"run_as"`                     // user to run commands and pty shells as, default: the agent's user
+	WorkDir         string        `json:"work_dir" bson:"work_dir"`                 // default: the agent's working directory
+	Timeout         time.Duration `json:"timeout" bson:"timeout"`                   // commands still running are killed, default: 30s
+	MaxOutput       int           `json:"max_output" bson:"max_output"`             // bytes kept per output stream, default: 64 KiB
+	AuditDir        string        `json:"audit_dir" bson:"audit_dir"`               // audit records awaiting delivery, default: audit (relative to the working directory)
+	AuditLimit      int           `json:"audit_limit" bson:"audit_limit"`           // max undelivered audit records, oldest dropped first, default: 10000
+}
+
+// FileTransferConfig restricts the file tunnel endpoint to a set of
+// directories. With no roots, file transfer is disabled.
+type FileTransferConfig struct {
+	Roots []string `json:"roots" bson:"roots"` // absolute directories that may be listed, read and written, including subdirectories
 }
 
 // LoadConfigV2 fetches the device config from the server API.
-// serverURL is the base server URL (e.g. "http://localhost:8090"), uuid is the device ID.
-func LoadConfigV2(serverURL, uuid string) (*Config, error) {
+// serverURL is the base server URL (e.g. "http://localhost:8090"), uuid is the
+// device ID and credential the device's token, if it has one.
+func LoadConfigV2(serverURL, uuid, credential string) (*Config, error) {
 	url := fmt.Sprintf("%s/device/%s/config.json?raw=true", serverURL, uuid)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build config request: %w", err)
+	}
+	if credential != "" {
+		req.Header.Set("Authorization", "Bearer "+credential)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch config from server: %w", err)
 	}
@@ -114,6 +395,38 @@ func LoadConfig(configPath string) (*Config, error) {
 	return &config, nil
 }
 
+// SaveConfig writes config to configPath atomically, so a crash mid-write
+// never leaves a truncated file behind.
+func SaveConfig(configPath string, config *Config) error {
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), filepath.Base(configPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp config file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync config: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close config: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), configPath); err != nil {
+		return fmt.Errorf("failed to replace config: %w", err)
+	}
+	return nil
+}
+
 func (c *Config) ApplyDefaults() {
 	if c.MAVLink.BaudRate == 0 {
 		c.MAVLink.BaudRate = 57600
@@ -124,6 +437,45 @@ func (c *Config) ApplyDefaults() {
 	if c.MAVLink.OutSystemID == 0 {
 		c.MAVLink.OutSystemID = 255
 	}
+	if len(c.MAVLink.Endpoints) == 0 {
+		c.MAVLink.Endpoints = []MAVLinkEndpoint{
+			{Type: MAVLinkEndpointSerial, Address: c.MAVLink.SerialPort},
+			{Type: MAVLinkEndpointTCPServer, Address: c.MAVLink.TCPAddress},
+		}
+	}
+	if c.MAVLink.TLog.Directory == "" {
+		c.MAVLink.TLog.Directory = "tlogs"
+	}
+	if c.MAVLink.TLog.MaxFileSize == 0 {
+		c.MAVLink.TLog.MaxFileSize = 64 << 20
+	}
+	if c.MAVLink.TLog.MaxFileAge == 0 {
+		c.MAVLink.TLog.MaxFileAge = time.Hour
+	}
+	if c.MAVLink.TLog.MaxTotalSize == 0 {
+		c.MAVLink.TLog.MaxTotalSize = 1 << 30
+	}
+	for i := range c.MAVLink.Endpoints {
+		ep := &c.MAVLink.Endpoints[i]
+		if ep.Type == MAVLinkEndpointSerial && ep.BaudRate == 0 {
+			ep.BaudRate = c.MAVLink.BaudRate
+		}
+		if ep.Type == MAVLinkEndpointUDPBroadcast && ep.LocalAddress == "" {
+			if _, port, err := net.SplitHostPort(ep.Address); err == nil {
+				ep.LocalAddress = net.JoinHostPort("0.0.0.0", port)
+			}
+		}
+	}
+
+	if c.Server.ConfigCheckInterval == 0 {
+		c.Server.ConfigCheckInterval = 5 * time.Minute
+	}
+	if c.Server.HealthCheckInterval == 0 {
+		c.Server.HealthCheckInterval = 30 * time.Second
+	}
+	if c.Server.FailoverAfter == 0 {
+		c.Server.FailoverAfter = 3
+	}
 
 	if c.Tunnel.WSPath == "" {
 		c.Tunnel.WSPath = "/ws"
@@ -135,6 +487,39 @@ func (c *Config) ApplyDefaults() {
 	if c.Stats.Endpoint == "" {
 		c.Stats.Endpoint = fmt.Sprintf("/device-status/%s", c.UUID)
 	}
+	if c.Stats.QueueDir == "" {
+		c.Stats.QueueDir = "queue"
+	}
+	if c.Stats.QueueLimit == 0 {
+		c.Stats.QueueLimit = 17280
+	}
+	if c.Stats.BatchSize == 0 {
+		c.Stats.BatchSize = 50
+	}
+
+	if c.Probe.Interval == 0 {
+		c.Probe.Interval = 2 * time.Second
+	}
+	if c.Probe.Timeout == 0 {
+		c.Probe.Timeout = 5 * time.Second
+	}
+
+	if c.Update.CheckInTimeout == 0 {
+		c.Update.CheckInTimeout = 2 * time.Minute
+	}
+
+	if c.Exec.Timeout == 0 {
+		c.Exec.Timeout = 30 * time.Second
+	}
+	if c.Exec.MaxOutput == 0 {
+		c.Exec.MaxOutput = 64 << 10
+	}
+	if c.Exec.AuditDir == "" {
+		c.Exec.AuditDir = "audit"
+	}
+	if c.Exec.AuditLimit == 0 {
+		c.Exec.AuditLimit = 10000
+	}
 }
 
 func (c *Config) Validate() error {
@@ -146,17 +531,199 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid baud rate: %d", c.MAVLink.BaudRate)
 	}
 
+	for i, ep := range c.MAVLink.Endpoints {
+		if err := ep.Validate(); err != nil {
+			return fmt.Errorf("mavlink endpoint %d: %w", i, err)
+		}
+	}
+
+	if tl := c.MAVLink.TLog; tl.Enabled {
+		if tl.MaxFileSize <= 0 || tl.MaxTotalSize <= 0 {
+			return fmt.Errorf("tlog sizes must be greater than 0")
+		}
+		if tl.MaxFileSize > tl.MaxTotalSize {
+			return fmt.Errorf("tlog max file size must not exceed max total size")
+		}
+		if tl.MaxFileAge < time.Minute {
+			return fmt.Errorf("tlog max file age must be at least 1 minute")
+		}
+	}
+
 	if c.Server.URL == "" {
 		return fmt.Errorf("server URL is required")
 	}
 
+	if c.Server.ConfigCheckInterval != 0 && c.Server.ConfigCheckInterval < 10*time.Second {
+		return fmt.Errorf("config check interval must be at least 10 seconds")
+	}
+
+	for _, u := range c.Server.FailoverURLs {
+		if err := CheckServerURL(u); err != nil {
+			return fmt.Errorf("failover %w", err)
+		}
+	}
+	if c.Server.DiscoveryURL != "" {
+		if err := CheckServerURL(c.Server.DiscoveryURL); err != nil {
+			return fmt.Errorf("discovery %w", err)
+		}
+	}
+	if c.Server.HealthCheckInterval != 0 && c.Server.HealthCheckInterval < 5*time.Second {
+		return fmt.Errorf("server health check interval must be at least 5 seconds")
+	}
+	if c.Server.FailoverAfter < 0 {
+		return fmt.Errorf("failover after must not be negative")
+	}
+
+	for _, cidr := range c.Tunnel.AllowedSubnets {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid allowed subnet %q: %w", cidr, err)
+		}
+	}
+
+	for i, ep := range c.Tunnel.Endpoints {
+		if err := c.Tunnel.CheckEndpoint(ep); err != nil {
+			return fmt.Errorf("tunnel endpoint %d: %w", i, err)
+		}
+		if ep.Type == EndpointTypeSerial && c.MAVLink.Enabled {
+			for _, dev := range c.MAVLinkSerialDevices("") {
+				if dev == ep.Device {
+					return fmt.Errorf("tunnel endpoint %d: serial device %s is used by MAVLink", i, dev)
+				}
+			}
+		}
+	}
+
 	if c.Stats.Interval < time.Second {
 		return fmt.Errorf("stats interval must be at least 1 second")
 	}
 
+	if c.Stats.QueueLimit < 0 || c.Stats.BatchSize < 0 {
+		return fmt.Errorf("stats queue limit and batch size must not be negative")
+	}
+
+	if c.Probe.Interval != 0 && c.Probe.Interval < 500*time.Millisecond {
+		return fmt.Errorf("probe interval must be at least 500ms")
+	}
+	if c.Probe.Timeout < 0 {
+		return fmt.Errorf("probe timeout must not be negative")
+	}
+
+	if c.Update.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.Update.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("update public key must be a base64 ed25519 public key")
+		}
+	}
+
+	if c.Update.CheckInTimeout != 0 && c.Update.CheckInTimeout < 30*time.Second {
+		return fmt.Errorf("update check-in timeout must be at least 30 seconds")
+	}
+
+	if err := c.Exec.Validate(); err != nil {
+		return fmt.Errorf("exec policy: %w", err)
+	}
+
+	for _, root := range c.Files.Roots {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("file transfer root %q must be an absolute path", root)
+		}
+	}
+
 	return nil
 }
 
+// MAVLinkSerialDevices returns the serial devices configured for MAVLink.
+// Endpoints without a device fall back to SerialPort, then to autoDetected;
+// pass "" when the auto-detected port is unknown to leave them out.
+func (c *Config) MAVLinkSerialDevices(autoDetected string) []string {
+	var devices []string
+	for _, ep := range c.MAVLink.Endpoints {
+		if ep.Type != MAVLinkEndpointSerial {
+			continue
+		}
+		dev := ep.Address
+		if dev == "" {
+			dev = c.MAVLink.SerialPort
+		}
+		if dev == "" {
+			dev = autoDetected
+		}
+		if dev != "" {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
+
+func (p ExecPolicy) Validate() error {
+	for _, name := range p.AllowedCommands {
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("allowed command %q must be a program name or path", name)
+		}
+		if strings.Contains(name, "/") && !filepath.IsAbs(name) {
+			return fmt.Errorf("allowed command %q must be a name or an absolute path", name)
+		}
+	}
+	if _, err := p.CompilePatterns(); err != nil {
+		return err
+	}
+	if p.Timeout < 0 || p.MaxOutput < 0 || p.AuditLimit < 0 {
+		return fmt.Errorf("timeout, max output and audit limit must not be negative")
+	}
+	return nil
+}
+
+// CompilePatterns compiles AllowedPatterns, anchored so each must match the
+// whole command line.
+func (p ExecPolicy) CompilePatterns() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(p.AllowedPatterns))
+	for _, pattern := range p.AllowedPatterns {
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+func (e MAVLinkEndpoint) Validate() error {
+	for _, rl := range e.RateLimits {
+		if rl.MaxRate <= 0 {
+			return fmt.Errorf("rate limit for message %d must be greater than 0", rl.MessageID)
+		}
+	}
+
+	switch e.Type {
+	case MAVLinkEndpointSerial:
+		if e.BaudRate < 0 {
+			return fmt.Errorf("invalid baud rate: %d", e.BaudRate)
+		}
+		return nil
+	case MAVLinkEndpointTCPServer, MAVLinkEndpointTCPClient, MAVLinkEndpointUDPServer, MAVLinkEndpointUDPClient:
+		if _, _, err := net.SplitHostPort(e.Address); err != nil {
+			return fmt.Errorf("%s requires a host:port address: %w", e.Type, err)
+		}
+		return nil
+	case MAVLinkEndpointUDPBroadcast:
+		host, _, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			return fmt.Errorf("%s requires a broadcast host:port address: %w", e.Type, err)
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("%s requires an IPv4 broadcast address, got %q", e.Type, host)
+		}
+		if e.LocalAddress != "" {
+			if _, _, err := net.SplitHostPort(e.LocalAddress); err != nil {
+				return fmt.Errorf("invalid local address %q: %w", e.LocalAddress, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown endpoint type %q", e.Type)
+	}
+}
+
 func NewDefaultDeviceConfig(uuid, serverURL string) Config {
 	return Config{
 		UUID: uuid,
@@ -166,13 +733,20 @@ func NewDefaultDeviceConfig(uuid, serverURL string) Config {
 			TCPAddress:      "0.0.0.0:5760",
 			StreamFrequency: 10,
 			OutSystemID:     255,
+			Endpoints: []MAVLinkEndpoint{
+				{Type: MAVLinkEndpointSerial, BaudRate: 57600},
+				{Type: MAVLinkEndpointTCPServer, Address: "0.0.0.0:5760"},
+			},
 		},
 		Server: ServerConfig{
-			URL: serverURL,
+			URL:                 serverURL,
+			ConfigCheckInterval: 5 * time.Minute,
+			HealthCheckInterval: 30 * time.Second,
+			FailoverAfter:       3,
 		},
 		Tunnel: TunnelConfig{
 			Endpoints: []TunnelEntry{
-				{Type: EndpointTypeTCP, Port: "5760", Label: "5760"},
+				{Type: EndpointTypeTCP, Port: "5760", Label: "5760", Priority: TunnelPriorityControl},
 			},
 			WSPath: "/ws",
 		},
@@ -181,5 +755,14 @@ func NewDefaultDeviceConfig(uuid, serverURL string) Config {
 			Interval: 5 * time.Second,
 			Endpoint: fmt.Sprintf("/device-status/%s", uuid),
 		},
+		Probe: ProbeConfig{
+			Enabled:  true,
+			Interval: 2 * time.Second,
+			Timeout:  5 * time.Second,
+		},
+		Exec: ExecPolicy{
+			// Read-only diagnostics; extend per device as needed.
+			AllowedCommands: []string{"uptime", "uname", "df", "free", "ps", "journalctl"},
+		},
 	}
 }
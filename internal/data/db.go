@@ -130,6 +130,16 @@ func UpsertOne(collection string, filter map[string]interface{}, update map[stri
 	return err
 }
 
+// CreateIndexes creates the given indexes on collection. Indexes that already
+// exist with the same options are left alone.
+func CreateIndexes(collection string, models []mongo.IndexModel) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	slog.Debug("db create indexes", "collection", collection, "count", len(models))
+	_, err := GetCollection(collection).Indexes().CreateMany(ctx, models)
+	return err
+}
+
 func DeleteOne(collection string, filter map[string]interface{}) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
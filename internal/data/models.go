@@ -27,7 +27,31 @@ type Drone struct {
 	FleetID     string        `json:"fleet_id" bson:"fleet_id"`
 	Status      ResourceStats `json:"status" bson:"status"`
 
+	Telemetry VehicleTelemetry `json:"telemetry" bson:"telemetry"`
+
 	DeviceConfig Config `json:"device_config" bson:"device_config"`
+
+	// Credentials the drone may authenticate with. During a rotation the new
+	// one is added, and older ones are dropped once it is first used.
+	Credentials []DeviceCredential `json:"credentials,omitempty" bson:"credentials,omitempty"`
+
+	// Enrollment lets the installer obtain the drone's first credential.
+	Enrollment *DeviceEnrollment `json:"-" bson:"enrollment,omitempty"`
+}
+
+// DeviceCredential is a secret a drone authenticates its requests and
+// tunnels with. The drone presents "<ID>.<secret>"; only a hash is stored.
+type DeviceCredential struct {
+	ID        string    `json:"id" bson:"id"`
+	Hash      string    `json:"-" bson:"hash"` // hex SHA-256 of the secret
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// DeviceEnrollment is a one-time token, included in the install command, that
+// the installer exchanges for the drone's first credential.
+type DeviceEnrollment struct {
+	Hash      string    `json:"-" bson:"hash"` // hex SHA-256 of the token
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
 }
 
 type DroneCommands struct {
@@ -37,12 +61,105 @@ type DroneCommands struct {
 	Type    string          `json:"type" bson:"type"`
 	Payload json.RawMessage `json:"payload" bson:"payload"`
 
-	Status string `json:"status" bson:"status"` // pending, done, failed
+	Status string `json:"status" bson:"status"` // pending, delivered, acknowledged, failed
+	Error  string `json:"error,omitempty" bson:"error,omitempty"`
 
 	CreatedAt time.Time `json:"created_at" bson:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
 
-	ExecutedAt *time.Time `json:"executed_at" bson:"executed_at,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at" bson:"delivered_at,omitempty"`
+	ExecutedAt  *time.Time `json:"executed_at" bson:"executed_at,omitempty"`
+}
+
+// Drone command lifecycle: a command is pending until the drone polls, then
+// delivered until the drone reports whether it acknowledged (succeeded) or failed.
+const (
+	CommandPending      = "pending"
+	CommandDelivered    = "delivered"
+	CommandAcknowledged = "acknowledged"
+	CommandFailed       = "failed"
+)
+
+// AgentUpdate is the payload of an update_agent command. Checksums and
+// signatures are keyed by architecture as reported by `uname -m`.
+type AgentUpdate struct {
+	Version    string            `json:"version"`
+	URL        string            `json:"url"`                  // "{arch}" is replaced with the drone's architecture
+	SHA256     map[string]string `json:"sha256"`               // hex digest of the binary
+	Signatures map[string]string `json:"signatures,omitempty"` // base64 ed25519 signature of the raw SHA-256 digest
+}
+
+// CommandResult is posted by the drone once it has executed a command.
+type CommandResult struct {
+	ID         primitive.ObjectID `json:"id"`
+	Success    bool               `json:"success"`
+	Error      string             `json:"error,omitempty"`
+	ExecutedAt time.Time          `json:"executed_at"`
+}
+
+// ExecAudit records a command received on a drone's cmd endpoint, whether or
+// not the execution policy allowed it.
+type ExecAudit struct {
+	DroneUID   string    `json:"drone_uid,omitempty" bson:"drone_uid"`
+	Command    string    `json:"command" bson:"command"`
+	Allowed    bool      `json:"allowed" bson:"allowed"`
+	RunAs      string    `json:"run_as,omitempty" bson:"run_as,omitempty"`
+	ExitCode   int       `json:"exit_code" bson:"exit_code"` // -1 if the command did not run to completion
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at" bson:"started_at"`
+	DurationMS int64     `json:"duration_ms" bson:"duration_ms"`
+	ReceivedAt time.Time `json:"received_at,omitempty" bson:"received_at"`
+}
+
+// RCESession describes a shell session opened from the RCE page. What was
+// typed and shown is kept in the session's recording file.
+type RCESession struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	DroneUID   string             `json:"drone_uid" bson:"drone_uid"`
+	Topic      string             `json:"topic" bson:"topic"`
+	Kind       EndpointType       `json:"kind" bson:"kind"` // cmd or pty
+	User       string             `json:"user" bson:"user"`
+	StartedAt  time.Time          `json:"started_at" bson:"started_at"`
+	EndedAt    *time.Time         `json:"ended_at,omitempty" bson:"ended_at,omitempty"` // nil while the session is open
+	DurationMS int64              `json:"duration_ms" bson:"duration_ms"`
+	BytesIn    int64              `json:"bytes_in" bson:"bytes_in"`   // sent by the operator
+	BytesOut   int64              `json:"bytes_out" bson:"bytes_out"` // sent by the drone
+	File       string             `json:"-" bson:"file"`
+}
+
+// FileRequest is one operation on a drone's file tunnel. Paths are absolute
+// and must be inside one of the device's file transfer roots.
+type FileRequest struct {
+	ID       string `json:"id"`
+	Op       string `json:"op"` // list, stat, read, begin_write, write, commit
+	Path     string `json:"path"`
+	Offset   int64  `json:"offset,omitempty"`
+	Length   int    `json:"length,omitempty"` // read only
+	Size     int64  `json:"size,omitempty"`   // begin_write only
+	Data     []byte `json:"data,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`   // commit only
+	Checksum bool   `json:"checksum,omitempty"` // stat only
+}
+
+// FileResponse answers the FileRequest with the same ID.
+type FileResponse struct {
+	ID      string      `json:"id"`
+	Error   string      `json:"error,omitempty"`
+	Entries []FileEntry `json:"entries,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime *time.Time  `json:"mod_time,omitempty"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Offset  int64       `json:"offset,omitempty"` // next offset to read or write
+	Data    []byte      `json:"data,omitempty"`
+	EOF     bool        `json:"eof,omitempty"`
+}
+
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
 }
 
 type ResourceStats struct {
@@ -55,9 +172,162 @@ type ResourceStats struct {
 	Platform    string        `json:"platform"`
 	BootTime    uint64        `json:"boot_time"`
 
+	MAVLinkRoutes []MAVLinkRoute `json:"mavlink_routes,omitempty" bson:"mavlink_routes,omitempty"`
+
+	TLogs []TLogFile `json:"tlogs,omitempty" bson:"tlogs,omitempty"`
+
+	Tunnels []TunnelHealth `json:"tunnels,omitempty" bson:"tunnels,omitempty"`
+
+	// Server the drone is reporting to, out of those it may fail over between.
+	Server *ServerStatus `json:"server,omitempty" bson:"server,omitempty"`
+
+	// Link quality to the server since the previous sample, one entry per probed path.
+	Link []LinkStats `json:"link,omitempty" bson:"link,omitempty"`
+
+	// Telemetry is stored on Drone.Telemetry so a report without it keeps the last known vehicle state.
+	Telemetry *VehicleTelemetry `json:"telemetry,omitempty" bson:"-"`
+
+	AgentVersion string `json:"agent_version,omitempty" bson:"agent_version,omitempty"`
+
+	// Config the drone is running: where it was loaded from (see ConfigSource*) and its version.
+	ConfigSource  string `json:"config_source,omitempty" bson:"config_source,omitempty"`
+	ConfigVersion int64  `json:"config_version,omitempty" bson:"config_version,omitempty"`
+
+	SampledAt   int64 `json:"sampled_at" bson:"sampled_at"` // set by the drone when the sample was taken
 	LastUpdated int64 `json:"last_updated" bson:"last_updated"`
 }
 
+// ServerStatus is the server a drone is using and the servers it picks from.
+type ServerStatus struct {
+	Active      string   `json:"active" bson:"active"`
+	Servers     []string `json:"servers,omitempty" bson:"servers,omitempty"`       // most preferred first
+	Discovered  bool     `json:"discovered,omitempty" bson:"discovered,omitempty"` // Servers came from the discovery document
+	ActiveSince int64    `json:"active_since" bson:"active_since"`
+	Failovers   int      `json:"failovers" bson:"failovers"`                       // server switches since the agent started
+	LastError   string   `json:"last_error,omitempty" bson:"last_error,omitempty"` // last failed health check of a server in use
+}
+
+// StatusSample is one status report kept in the drone's status history.
+type StatusSample struct {
+	DroneUID   string            `json:"drone_uid" bson:"drone_uid"`
+	SampledAt  int64             `json:"sampled_at" bson:"sampled_at"`
+	ReceivedAt time.Time         `json:"received_at" bson:"received_at"` // a date, so the history's TTL index expires it
+	Status     ResourceStats     `json:"status" bson:"status"`
+	Telemetry  *VehicleTelemetry `json:"telemetry,omitempty" bson:"telemetry,omitempty"`
+}
+
+// VehicleTelemetry is the latest decoded state of the autopilot attached to a drone.
+type VehicleTelemetry struct {
+	SystemID     uint8  `json:"system_id" bson:"system_id"`
+	VehicleType  string `json:"vehicle_type" bson:"vehicle_type"`
+	Autopilot    string `json:"autopilot" bson:"autopilot"`
+	Armed        bool   `json:"armed" bson:"armed"`
+	CustomMode   uint32 `json:"custom_mode" bson:"custom_mode"`
+	SystemStatus string `json:"system_status" bson:"system_status"`
+
+	// GLOBAL_POSITION_INT
+	Latitude    float64 `json:"latitude" bson:"latitude"`         // degrees
+	Longitude   float64 `json:"longitude" bson:"longitude"`       // degrees
+	AltitudeMSL float64 `json:"altitude_msl" bson:"altitude_msl"` // meters
+	AltitudeRel float64 `json:"altitude_rel" bson:"altitude_rel"` // meters above home
+	GroundSpeed float64 `json:"ground_speed" bson:"ground_speed"` // m/s
+	ClimbRate   float64 `json:"climb_rate" bson:"climb_rate"`     // m/s, positive up
+	Heading     float64 `json:"heading" bson:"heading"`           // degrees
+
+	// ATTITUDE
+	Roll  float64 `json:"roll" bson:"roll"`   // degrees
+	Pitch float64 `json:"pitch" bson:"pitch"` // degrees
+	Yaw   float64 `json:"yaw" bson:"yaw"`     // degrees
+
+	// GPS_RAW_INT
+	GPSFixType    string  `json:"gps_fix_type" bson:"gps_fix_type"`
+	GPSSatellites uint8   `json:"gps_satellites" bson:"gps_satellites"`
+	GPSHDOP       float64 `json:"gps_hdop" bson:"gps_hdop"`
+
+	// SYS_STATUS / BATTERY_STATUS
+	BatteryVoltage   float64 `json:"battery_voltage" bson:"battery_voltage"`     // volts
+	BatteryCurrent   float64 `json:"battery_current" bson:"battery_current"`     // amps, -1 = unknown
+	BatteryRemaining int8    `json:"battery_remaining" bson:"battery_remaining"` // percent, -1 = unknown
+	BatteryConsumed  int32   `json:"battery_consumed" bson:"battery_consumed"`   // mAh, -1 = unknown
+	CPULoad          float64 `json:"cpu_load" bson:"cpu_load"`                   // percent
+
+	// RADIO_STATUS, if the vehicle has a telemetry radio that reports it
+	Radio *RadioStatus `json:"radio,omitempty" bson:"radio,omitempty"`
+
+	LastHeartbeat int64 `json:"last_heartbeat" bson:"last_heartbeat"`
+	LastUpdated   int64 `json:"last_updated" bson:"last_updated"`
+}
+
+// RadioStatus is the latest RADIO_STATUS from the vehicle's telemetry radio.
+// Signal and noise levels are in the radio's own units (0-254).
+type RadioStatus struct {
+	RSSI        uint8  `json:"rssi" bson:"rssi"`
+	RemoteRSSI  uint8  `json:"remote_rssi" bson:"remote_rssi"`
+	Noise       uint8  `json:"noise" bson:"noise"`
+	RemoteNoise uint8  `json:"remote_noise" bson:"remote_noise"`
+	TxBuffer    uint8  `json:"tx_buffer" bson:"tx_buffer"` // percent free
+	RxErrors    uint16 `json:"rx_errors" bson:"rx_errors"`
+	Fixed       uint16 `json:"fixed" bson:"fixed"` // packets with corrected errors
+	LastUpdated int64  `json:"last_updated" bson:"last_updated"`
+}
+
+// TLogFile describes a .tlog recording kept on the drone.
+type TLogFile struct {
+	Name     string `json:"name" bson:"name"`
+	Size     int64  `json:"size" bson:"size"`
+	Modified int64  `json:"modified" bson:"modified"`
+	Active   bool   `json:"active" bson:"active"` // currently being written
+}
+
+// Tunnel states reported in TunnelHealth.
+const (
+	TunnelStateConnecting = "connecting"
+	TunnelStateUp         = "up"
+	TunnelStateBackoff    = "backoff" // waiting to reconnect
+)
+
+// TunnelHealth is the client's view of one of its tunnels.
+type TunnelHealth struct {
+	ID          string `json:"id" bson:"id"` // relay topic
+	Label       string `json:"label" bson:"label"`
+	State       string `json:"state" bson:"state"` // one of TunnelState*
+	StartedAt   int64  `json:"started_at" bson:"started_at"`
+	ConnectedAt int64  `json:"connected_at,omitempty" bson:"connected_at,omitempty"` // while up
+	UptimeSec   int64  `json:"uptime_sec" bson:"uptime_sec"`                         // total time up since StartedAt
+	Reconnects  int    `json:"reconnects" bson:"reconnects"`
+	BytesIn     int64  `json:"bytes_in" bson:"bytes_in"`   // from the server to the endpoint
+	BytesOut    int64  `json:"bytes_out" bson:"bytes_out"` // from the endpoint to the server
+	LastError   string `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	LastErrorAt int64  `json:"last_error_at,omitempty" bson:"last_error_at,omitempty"`
+}
+
+// Paths measured by link probes.
+const (
+	LinkPathControl = "control" // HTTP requests to the server
+	LinkPathTunnel  = "tunnel"  // echoed through the relay like tunnel traffic
+)
+
+// LinkStats summarises the probes on one path over a sampling window. Sent
+// counts the probes that were answered or timed out during the window.
+type LinkStats struct {
+	Path     string  `json:"path" bson:"path"` // one of LinkPath*
+	Sent     int     `json:"sent" bson:"sent"`
+	Lost     int     `json:"lost" bson:"lost"`
+	RTTMinMS float64 `json:"rtt_min_ms" bson:"rtt_min_ms"`
+	RTTAvgMS float64 `json:"rtt_avg_ms" bson:"rtt_avg_ms"`
+	RTTMaxMS float64 `json:"rtt_max_ms" bson:"rtt_max_ms"`
+	JitterMS float64 `json:"jitter_ms" bson:"jitter_ms"` // mean difference between consecutive RTTs
+}
+
+// MAVLinkRoute is one entry of the client's MAVLink routing table: a
+// system/component pair and the channel it was last seen on.
+type MAVLinkRoute struct {
+	SystemID    uint8  `json:"system_id" bson:"system_id"`
+	ComponentID uint8  `json:"component_id" bson:"component_id"`
+	Channel     string `json:"channel" bson:"channel"`
+	LastSeen    int64  `json:"last_seen" bson:"last_seen"`
+}
+
 type DiskInfo struct {
 	Path       string  `json:"path"`
 	MountPoint string  `json:"mount_point"`
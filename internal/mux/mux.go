@@ -0,0 +1,421 @@
+// Package mux carries many byte streams over a single ordered byte stream,
+// such as a tunnel, so one tunnel can serve several TCP connections at once.
+//
+// Every frame is [type 1B][stream ID 4B BE][length 4B BE][payload]. The side
+// that opens streams picks random IDs, so several openers (e.g. two server
+// processes subscribed to the same relay topic) can share the accepting side;
+// openers ignore frames for streams they do not know.
+//
+// Each direction of a stream has its own window: a side may have at most
+// InitialWindow bytes sent but not yet read by the other side, which grants
+// more as its reader catches up. A slow stream therefore never stalls the
+// others. A Read returns data from at most one frame, so writes of up to
+// MaxPayload bytes keep their boundaries for readers with large enough
+// buffers (datagram and serial tunnels rely on this).
+package mux
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	frameOpen   byte = 1 // payload is the stream name, if any
+	frameData   byte = 2
+	frameClose  byte = 3
+	frameWindow byte = 4 // payload is a 4-byte window increment
+
+	headerSize = 9
+
+	// MaxPayload is the largest payload sent in one frame.
+	MaxPayload = 32 << 10
+
+	// InitialWindow is how many bytes a side may send on a new stream before
+	// the other side grants more.
+	InitialWindow = 256 << 10
+)
+
+var (
+	// ErrSessionClosed is returned by operations on a closed session.
+	ErrSessionClosed = errors.New("mux: session closed")
+
+	errWindowExceeded = errors.New("mux: peer exceeded stream window")
+)
+
+// Session multiplexes streams. Incoming frames are read from r; each
+// outgoing frame is passed to w in a single Write, in a buffer w may keep.
+type Session struct {
+	w       io.Writer
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	accept  chan *Stream // nil if the session does not accept streams
+	err     error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession starts reading frames from r. If accept is set, streams opened
+// by the other side are delivered by Accept; otherwise their frames are ignored.
+func NewSession(r io.Reader, w io.Writer, accept bool) *Session {
+	s := &Session{
+		w:       w,
+		streams: make(map[uint32]*Stream),
+		done:    make(chan struct{}),
+	}
+	if accept {
+		s.accept = make(chan *Stream, 16)
+	}
+	go s.readLoop(r)
+	return s
+}
+
+// Open starts a new unnamed stream.
+func (s *Session) Open() (*Stream, error) {
+	return s.OpenNamed("")
+}
+
+// OpenNamed starts a new stream; the accepting side sees name in Stream.Name,
+// e.g. to pick what the stream connects to.
+func (s *Session) OpenNamed(name string) (*Stream, error) {
+	if len(name) > MaxPayload {
+		return nil, fmt.Errorf("mux: stream name too long")
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	var id uint32
+	for id == 0 || s.streams[id] != nil {
+		var b [4]byte
+		rand.Read(b[:])
+		id = binary.BigEndian.Uint32(b[:])
+	}
+	st := newStream(s, id, name)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, []byte(name)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the other side to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	if s.accept == nil {
+		return nil, fmt.Errorf("mux: session does not accept streams")
+	}
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Close closes the session and all its streams. It does not close r or w.
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionClosed)
+	return nil
+}
+
+// Done is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, or nil while it is running.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) shutdown(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = map[uint32]*Stream{}
+		s.mu.Unlock()
+
+		for _, st := range streams {
+			st.remoteClosed(err)
+		}
+		close(s.done)
+	})
+}
+
+func (s *Session) readLoop(r io.Reader) {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			s.shutdown(fmt.Errorf("mux: read: %w", err))
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		n := binary.BigEndian.Uint32(header[5:9])
+		if n > MaxPayload {
+			s.shutdown(fmt.Errorf("mux: frame of %d bytes exceeds limit", n))
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			s.shutdown(fmt.Errorf("mux: read: %w", err))
+			return
+		}
+
+		s.mu.Lock()
+		st := s.streams[id]
+		if typ == frameOpen && st == nil && s.accept != nil && s.err == nil {
+			st = newStream(s, id, string(payload))
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		s.mu.Unlock()
+		if st == nil {
+			// On the accepting side every live stream is known, so the
+			// opener is talking to a stream that no longer exists (e.g.
+			// after the accepting side restarted); tell it so it does not
+			// wait forever. Openers ignore other openers' streams.
+			if typ == frameData && s.accept != nil {
+				s.writeFrame(frameClose, id, nil)
+			}
+			continue
+		}
+
+		switch typ {
+		case frameData:
+			if !st.deliver(payload) {
+				s.remove(id)
+				st.remoteClosed(errWindowExceeded)
+				s.writeFrame(frameClose, id, nil)
+			}
+		case frameWindow:
+			if len(payload) == 4 {
+				st.grant(int(binary.BigEndian.Uint32(payload)))
+			}
+		case frameClose:
+			s.remove(id)
+			st.remoteClosed(io.EOF)
+		}
+	}
+}
+
+// FrameStream returns the stream a frame written by a session belongs to,
+// and whether the frame is urgent: stream opens and window grants carry no
+// stream data, so a writer that reorders frames may send them ahead of
+// everything else without breaking any stream's order. Other frames must be
+// sent in order with the rest of their stream's.
+func FrameStream(frame []byte) (id uint32, urgent bool) {
+	if len(frame) < headerSize {
+		return 0, false
+	}
+	typ := frame[0]
+	return binary.BigEndian.Uint32(frame[1:5]), typ == frameOpen || typ == frameWindow
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+	}
+	if _, err := s.w.Write(frame); err != nil {
+		go s.shutdown(fmt.Errorf("mux: write: %w", err))
+		return err
+	}
+	return nil
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// Stream is one bidirectional byte stream within a session.
+type Stream struct {
+	sess *Session
+	id   uint32
+	name string
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	chunks     [][]byte // received payloads not yet read
+	buffered   int      // bytes in chunks
+	unacked    int      // bytes read since the last window grant
+	sendWindow int      // bytes we may still send
+	readErr    error    // set once the other side closed the stream
+	closed     bool     // set once we closed the stream
+	closeOnce  sync.Once
+}
+
+func newStream(s *Session, id uint32, name string) *Stream {
+	st := &Stream{sess: s, id: id, name: name, sendWindow: InitialWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID returns the stream's identifier within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Name returns the name the stream was opened with.
+func (st *Stream) Name() string {
+	return st.name
+}
+
+// Read reads data sent by the other side, from at most one frame; it returns
+// io.EOF once the other side has closed the stream and everything sent has
+// been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.chunks) == 0 && st.readErr == nil && !st.closed {
+		st.cond.Wait()
+	}
+	if st.closed {
+		st.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if len(st.chunks) == 0 {
+		err := st.readErr
+		st.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, st.chunks[0])
+	if n == len(st.chunks[0]) {
+		st.chunks[0] = nil
+		st.chunks = st.chunks[1:]
+	} else {
+		st.chunks[0] = st.chunks[0][n:]
+	}
+	st.buffered -= n
+	st.unacked += n
+	grant := 0
+	if st.unacked >= InitialWindow/2 && st.readErr == nil {
+		grant, st.unacked = st.unacked, 0
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(grant))
+		st.sess.writeFrame(frameWindow, st.id, b[:])
+	}
+	return n, nil
+}
+
+// Write sends p, split into frames of at most MaxPayload bytes, waiting
+// while the other side's window is full.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.closed && st.readErr == nil {
+			st.cond.Wait()
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if st.readErr != nil {
+			err := st.readErr
+			st.mu.Unlock()
+			if err == io.EOF {
+				err = io.ErrClosedPipe
+			}
+			return written, err
+		}
+		n := min(len(p), MaxPayload, st.sendWindow)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(frameData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream in both directions and tells the other side.
+func (st *Stream) Close() error {
+	st.closeOnce.Do(func() {
+		st.mu.Lock()
+		st.closed = true
+		remote := st.readErr != nil
+		st.chunks, st.buffered = nil, 0
+		st.cond.Broadcast()
+		st.mu.Unlock()
+
+		st.sess.remove(st.id)
+		if !remote {
+			st.sess.writeFrame(frameClose, st.id, nil)
+		}
+	})
+	return nil
+}
+
+// deliver queues data from the other side. It reports false if the other
+// side sent more than its window allowed.
+func (st *Stream) deliver(p []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return true
+	}
+	if st.buffered+st.unacked+len(p) > InitialWindow {
+		return false
+	}
+	if len(p) > 0 {
+		st.chunks = append(st.chunks, p)
+		st.buffered += len(p)
+		st.cond.Broadcast()
+	}
+	return true
+}
+
+// grant lets the stream send n more bytes.
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) remoteClosed(err error) {
+	st.mu.Lock()
+	if st.readErr == nil {
+		st.readErr = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
@@ -0,0 +1,550 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns an opening and an accepting session talking over net.Pipe.
+func pair(t *testing.T) (opener, acceptor *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	opener = NewSession(a, a, false)
+	acceptor = NewSession(b, b, true)
+	t.Cleanup(func() {
+		opener.Close()
+		acceptor.Close()
+		a.Close()
+		b.Close()
+	})
+	return opener, acceptor
+}
+
+// rawPeer returns a session and the other end of its connection, on which
+// the test speaks the frame format directly.
+func rawPeer(t *testing.T, accept bool) (*Session, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	s := NewSession(a, a, accept)
+	t.Cleanup(func() {
+		s.Close()
+		a.Close()
+		b.Close()
+	})
+	return s, b
+}
+
+func encode(typ byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	return frame
+}
+
+func writeRaw(t *testing.T, conn net.Conn, typ byte, id uint32, payload []byte) {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(encode(typ, id, payload)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+type rawFrame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+	err     error
+}
+
+// readRawAsync reads one frame in the background, for when the session
+// writes it from the test's own goroutine.
+func readRawAsync(conn net.Conn) <-chan rawFrame {
+	result := make(chan rawFrame, 1)
+	go func() {
+		typ, id, payload, err := readRaw(conn, time.Second)
+		result <- rawFrame{typ, id, payload, err}
+	}()
+	return result
+}
+
+func readRaw(conn net.Conn, timeout time.Duration) (typ byte, id uint32, payload []byte, err error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload = make([]byte, binary.BigEndian.Uint32(header[5:9]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:5]), payload, nil
+}
+
+func accept(t *testing.T, s *Session) *Stream {
+	t.Helper()
+	result := make(chan *Stream, 1)
+	go func() {
+		st, err := s.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		result <- st
+	}()
+	select {
+	case st := <-result:
+		if st == nil {
+			t.FailNow()
+		}
+		return st
+	case <-time.After(time.Second):
+		t.Fatal("accept timed out")
+		return nil
+	}
+}
+
+func TestOpenAndExchange(t *testing.T) {
+	opener, acceptor := pair(t)
+
+	st, err := opener.OpenNamed("tcp_22")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	remote := accept(t, acceptor)
+	if remote.Name() != "tcp_22" || remote.ID() != st.ID() {
+		t.Fatalf("accepted stream %d %q, want %d %q", remote.ID(), remote.Name(), st.ID(), "tcp_22")
+	}
+
+	if _, err := st.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, err := remote.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("read %q, %v; want %q", buf[:n], err, "ping")
+	}
+	if _, err := remote.Write([]byte("pong")); err != nil {
+		t.Fatalf("write back: %v", err)
+	}
+	n, err = st.Read(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("read back %q, %v; want %q", buf[:n], err, "pong")
+	}
+
+	st.Close()
+	if _, err := remote.Read(buf); err != io.EOF {
+		t.Fatalf("read after remote close: %v, want EOF", err)
+	}
+	if _, err := remote.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write after remote close: %v, want %v", err, io.ErrClosedPipe)
+	}
+	if _, err := st.Read(buf); err != io.ErrClosedPipe {
+		t.Fatalf("read after close: %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestReadKeepsFrameBoundaries(t *testing.T) {
+	opener, acceptor := pair(t)
+	st, err := opener.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	remote := accept(t, acceptor)
+
+	for _, msg := range []string{"first", "second"} {
+		if _, err := st.Write([]byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	buf := make([]byte, 64)
+	for _, want := range []string{"first", "second"} {
+		n, err := remote.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("read %q, %v; want %q", buf[:n], err, want)
+		}
+	}
+
+	// A short buffer gets the rest of the frame on the next Read.
+	st.Write([]byte("abcdef"))
+	n, _ := remote.Read(buf[:4])
+	m, _ := remote.Read(buf[4:])
+	if got := string(buf[:n+m]); got != "abcdef" || n != 4 {
+		t.Fatalf("split read %q (%d+%d), want %q", got, n, m, "abcdef")
+	}
+}
+
+func TestWriteSplitsLargePayloads(t *testing.T) {
+	s, conn := rawPeer(t, false)
+	opened := readRawAsync(conn)
+	st, err := s.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if f := <-opened; f.err != nil || f.typ != frameOpen || f.id != st.ID() {
+		t.Fatalf("open frame: type %d id %d, %v", f.typ, f.id, f.err)
+	}
+
+	payload := bytes.Repeat([]byte("x"), 2*MaxPayload+10)
+	go st.Write(payload)
+	for _, want := range []int{MaxPayload, MaxPayload, 10} {
+		typ, id, p, err := readRaw(conn, time.Second)
+		if err != nil || typ != frameData || id != st.ID() || len(p) != want {
+			t.Fatalf("data frame: type %d id %d len %d, %v; want data on %d of %d bytes", typ, id, len(p), err, st.ID(), want)
+		}
+	}
+}
+
+func TestWindowBlocksWriterUntilRead(t *testing.T) {
+	opener, acceptor := pair(t)
+	st, err := opener.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	remote := accept(t, acceptor)
+
+	payload := make([]byte, InitialWindow+MaxPayload)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(payload)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("write beyond the window finished without a read: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	got := make([]byte, 0, len(payload))
+	buf := make([]byte, MaxPayload)
+	for len(got) < len(payload) {
+		n, err := remote.Read(buf)
+		if err != nil {
+			t.Fatalf("read after %d bytes: %v", len(got), err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("data corrupted across window grants")
+	}
+}
+
+func TestWindowGrant(t *testing.T) {
+	s, conn := rawPeer(t, true)
+	const id = 7
+	writeRaw(t, conn, frameOpen, id, nil)
+	st := accept(t, s)
+
+	chunk := make([]byte, MaxPayload)
+	for sent := 0; sent < InitialWindow; sent += len(chunk) {
+		writeRaw(t, conn, frameData, id, chunk)
+	}
+
+	granted := readRawAsync(conn)
+	buf := make([]byte, MaxPayload)
+	read := 0
+	for read < InitialWindow/2 {
+		n, err := st.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		read += n
+	}
+	f := <-granted
+	if f.err != nil || f.typ != frameWindow || f.id != id || len(f.payload) != 4 {
+		t.Fatalf("grant frame: type %d id %d payload %x, %v", f.typ, f.id, f.payload, f.err)
+	}
+	if n := binary.BigEndian.Uint32(f.payload); n != InitialWindow/2 {
+		t.Fatalf("granted %d bytes, want %d", n, InitialWindow/2)
+	}
+
+	// Sending to the full window again is now allowed.
+	for sent := 0; sent < InitialWindow/2; sent += len(chunk) {
+		writeRaw(t, conn, frameData, id, chunk)
+	}
+	select {
+	case <-s.Done():
+		t.Fatalf("session ended: %v", s.Err())
+	default:
+	}
+}
+
+func TestDeliverOverflowClosesStream(t *testing.T) {
+	s, conn := rawPeer(t, true)
+	const id = 9
+	writeRaw(t, conn, frameOpen, id, nil)
+	st := accept(t, s)
+
+	chunk := make([]byte, MaxPayload)
+	for sent := 0; sent < InitialWindow; sent += len(chunk) {
+		writeRaw(t, conn, frameData, id, chunk)
+	}
+	go conn.Write(encode(frameData, id, []byte("one too many")))
+
+	typ, gotID, _, err := readRaw(conn, time.Second)
+	if err != nil || typ != frameClose || gotID != id {
+		t.Fatalf("expected close of stream %d, got type %d id %d, %v", id, typ, gotID, err)
+	}
+
+	// What fitted the window is still readable, then the error surfaces.
+	buf := make([]byte, MaxPayload)
+	read := 0
+	for {
+		n, err := st.Read(buf)
+		read += n
+		if err != nil {
+			if !errors.Is(err, errWindowExceeded) {
+				t.Fatalf("read error %v, want %v", err, errWindowExceeded)
+			}
+			break
+		}
+	}
+	if read != InitialWindow {
+		t.Fatalf("read %d bytes before the error, want %d", read, InitialWindow)
+	}
+	if _, err := st.Write([]byte("x")); !errors.Is(err, errWindowExceeded) {
+		t.Fatalf("write after overflow: %v, want %v", err, errWindowExceeded)
+	}
+
+	// The session itself carries on.
+	writeRaw(t, conn, frameOpen, id+1, []byte("next"))
+	if st := accept(t, s); st.Name() != "next" {
+		t.Fatalf("accepted %q after overflow, want %q", st.Name(), "next")
+	}
+}
+
+func TestUnknownStream(t *testing.T) {
+	t.Run("acceptor closes it", func(t *testing.T) {
+		_, conn := rawPeer(t, true)
+		writeRaw(t, conn, frameData, 42, []byte("stale"))
+		typ, id, _, err := readRaw(conn, time.Second)
+		if err != nil || typ != frameClose || id != 42 {
+			t.Fatalf("got type %d id %d, %v; want close of stream 42", typ, id, err)
+		}
+	})
+
+	t.Run("opener ignores it", func(t *testing.T) {
+		s, conn := rawPeer(t, false)
+		writeRaw(t, conn, frameData, 42, []byte("someone else's"))
+		writeRaw(t, conn, frameWindow, 42, []byte{0, 0, 0, 1})
+		writeRaw(t, conn, frameClose, 42, nil)
+		if typ, id, _, err := readRaw(conn, 50*time.Millisecond); err == nil {
+			t.Fatalf("opener answered with type %d on stream %d", typ, id)
+		}
+		select {
+		case <-s.Done():
+			t.Fatalf("session ended: %v", s.Err())
+		default:
+		}
+	})
+
+	t.Run("close of unknown stream", func(t *testing.T) {
+		s, conn := rawPeer(t, true)
+		writeRaw(t, conn, frameClose, 42, nil)
+		if typ, id, _, err := readRaw(conn, 50*time.Millisecond); err == nil {
+			t.Fatalf("acceptor answered a close with type %d on stream %d", typ, id)
+		}
+		writeRaw(t, conn, frameOpen, 43, nil)
+		if st := accept(t, s); st.ID() != 43 {
+			t.Fatalf("accepted stream %d, want 43", st.ID())
+		}
+	})
+}
+
+func TestOversizedFrameEndsSession(t *testing.T) {
+	s, conn := rawPeer(t, true)
+	header := make([]byte, headerSize)
+	header[0] = frameData
+	binary.BigEndian.PutUint32(header[5:9], MaxPayload+1)
+	conn.Write(header)
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session survived an oversized frame")
+	}
+	if s.Err() == nil {
+		t.Fatal("no error recorded")
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	opener, acceptor := pair(t)
+	st, err := opener.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	remote := accept(t, acceptor)
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := acceptor.Accept()
+		acceptErr <- err
+	}()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := remote.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	acceptor.Close()
+	if err := <-acceptErr; err != ErrSessionClosed {
+		t.Fatalf("accept after close: %v, want %v", err, ErrSessionClosed)
+	}
+	if err := <-readErr; err != ErrSessionClosed {
+		t.Fatalf("read after close: %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := remote.Write([]byte("x")); err != ErrSessionClosed {
+		t.Fatalf("write after close: %v, want %v", err, ErrSessionClosed)
+	}
+
+	opener.Close()
+	if _, err := opener.Open(); err != ErrSessionClosed {
+		t.Fatalf("open after close: %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := st.Write([]byte("x")); err != ErrSessionClosed {
+		t.Fatalf("write on closed session: %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestReadEndsWithTransport(t *testing.T) {
+	s, conn := rawPeer(t, false)
+	opened := readRawAsync(conn)
+	st, err := s.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	<-opened
+
+	conn.Close()
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after transport closed: %v, want it to wrap EOF", err)
+	}
+	<-s.Done()
+}
+
+func TestCloseRaces(t *testing.T) {
+	opener, acceptor := pair(t)
+
+	go func() {
+		for {
+			st, err := acceptor.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := opener.Open()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					if _, err := st.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+			msg := bytes.Repeat([]byte{byte(i)}, 4096)
+			for j := 0; j < i; j++ {
+				if _, err := st.Write(msg); err != nil {
+					return
+				}
+			}
+			// Close from both ends at once, and twice.
+			go st.Close()
+			st.Close()
+		}()
+	}
+	wg.Wait()
+
+	// Closing the session while streams are still open must not hang
+	// readers or writers.
+	var streams []*Stream
+	for range 8 {
+		st, err := opener.Open()
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		streams = append(streams, st)
+	}
+	for _, st := range streams {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := st.Write(make([]byte, MaxPayload)); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := st.Read(make([]byte, MaxPayload)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	go opener.Close()
+	acceptor.Close()
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("streams hung after the session closed")
+	}
+}
+
+func TestFrameStream(t *testing.T) {
+	for _, tc := range []struct {
+		typ    byte
+		urgent bool
+	}{
+		{frameOpen, true},
+		{frameData, false},
+		{frameClose, false},
+		{frameWindow, true},
+	} {
+		frame := make([]byte, headerSize)
+		frame[0] = tc.typ
+		binary.BigEndian.PutUint32(frame[1:5], 0xdeadbeef)
+		id, urgent := FrameStream(frame)
+		if id != 0xdeadbeef || urgent != tc.urgent {
+			t.Errorf("frame type %d: id %x urgent %v, want %x %v", tc.typ, id, urgent, 0xdeadbeef, tc.urgent)
+		}
+	}
+	if id, urgent := FrameStream([]byte{frameOpen}); id != 0 || urgent {
+		t.Errorf("short frame: id %x urgent %v", id, urgent)
+	}
+}